@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// mintBatch is a safeMintBatch transaction minting the tokens of several
+// jobs. Its jobs share the transaction, so replacements of a stuck batch are
+// kept here rather than on any one job.
+type mintBatch struct {
+	ID       string   `json:"id"`
+	Contract string   `json:"contract"`
+	Jobs     []string `json:"jobs"` // in the order of the tokens they mint
+	TxHash   string   `json:"tx_hash"`
+	RawTx    string   `json:"raw_tx"`
+	Replaced []string `json:"replaced,omitempty"`
+}
+
+func batchKey(id string) string {
+	return "batch/" + id
+}
+
+// batchReplacements serializes fee bumps of batches: every job of a stuck
+// batch notices it, only the first one may replace the transaction.
+var batchReplacements sync.Mutex
+
+// batcher collects the jobs of a campaign ready to mint and sends them
+// together once there are size of them or the first one has waited for wait.
+// Workers hand their job over and move on to the next one, so a batch can
+// fill up with more jobs than there are workers.
+type batcher struct {
+	size int
+	wait time.Duration
+	send func(ctx context.Context, contract common.Address, jobs []*mintJob)
+
+	mu      sync.Mutex
+	pending map[string]*pendingBatch // by campaign
+	held    map[string]bool          // IDs of the jobs handed over until their batch is done
+}
+
+type pendingBatch struct {
+	ctx      context.Context
+	contract common.Address
+	jobs     []*mintJob
+	timer    *time.Timer
+}
+
+// newBatcher returns nil, minting every job on its own, for sizes below 2.
+// send mints the jobs of a batch and sees them through to the end.
+func newBatcher(size int, wait time.Duration, send func(context.Context, common.Address, []*mintJob)) *batcher {
+	if size < 2 {
+		return nil
+	}
+	return &batcher{size: size, wait: wait, send: send, pending: map[string]*pendingBatch{}, held: map[string]bool{}}
+}
+
+// Add hands the job over to the open batch of its campaign and returns right
+// away. A job already held is left alone.
+func (b *batcher) Add(ctx context.Context, c *campaign, contract common.Address, job *mintJob) {
+	b.mu.Lock()
+	if b.held[job.ID] {
+		b.mu.Unlock()
+		return
+	}
+	b.held[job.ID] = true
+	p, ok := b.pending[c.ID]
+	if !ok {
+		p = &pendingBatch{ctx: ctx, contract: contract}
+		p.timer = time.AfterFunc(b.wait, func() { b.flush(c.ID, p) })
+		b.pending[c.ID] = p
+	}
+	p.jobs = append(p.jobs, job)
+	full := len(p.jobs) >= b.size
+	if full {
+		// the next job starts a new batch
+		b.take(c.ID, p)
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.sendBatch(p)
+	}
+}
+
+// Holds reports whether the job was handed over and its batch isn't done.
+func (b *batcher) Holds(id string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held[id]
+}
+
+// flush sends the batch unless it was already sent.
+func (b *batcher) flush(key string, p *pendingBatch) {
+	b.mu.Lock()
+	taken := b.take(key, p)
+	b.mu.Unlock()
+	if taken {
+		b.sendBatch(p)
+	}
+}
+
+// take closes the batch to new jobs, reporting false if it already was. The
+// caller holds b.mu.
+func (b *batcher) take(key string, p *pendingBatch) bool {
+	if b.pending[key] != p {
+		return false
+	}
+	delete(b.pending, key)
+	p.timer.Stop()
+	return true
+}
+
+// sendBatch sends a batch taken from the pending ones and lets go of its jobs
+// once they are done.
+func (b *batcher) sendBatch(p *pendingBatch) {
+	b.send(p.ctx, p.contract, p.jobs)
+
+	b.mu.Lock()
+	for _, job := range p.jobs {
+		delete(b.held, job.ID)
+	}
+	b.mu.Unlock()
+}
+
+// processBatch mints the jobs of a batch and settles them from the receipt,
+// the rest of processJob for the jobs handed over to the batcher.
+func (m *minter) processBatch(ctx context.Context, contract common.Address, jobs []*mintJob) {
+	if err := m.mintJobs(ctx, contract, jobs); err != nil {
+		log.Printf("minting a batch of %d jobs: %v", len(jobs), err)
+		if ctx.Err() != nil {
+			// the batch may still go out, the sweeper resumes the jobs
+			return
+		}
+		for _, job := range jobs {
+			m.fail(job, err)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *mintJob) {
+			defer wg.Done()
+			if err := m.finalize(ctx, job); err != nil {
+				log.Printf("job %s for code %s failed: %v", job.ID, job.Code, err)
+			}
+		}(job)
+	}
+	wg.Wait()
+}
+
+// mintJobs mints the tokens of the jobs, all of one campaign, in one
+// transaction. Every job is marked submitted before the transaction is
+// broadcast, and back again if it was never sent.
+func (m *minter) mintJobs(ctx context.Context, contract common.Address, jobs []*mintJob) error {
+	err := m.sendJobs(ctx, contract, jobs)
+	if err != nil {
+		for _, job := range jobs {
+			if err := m.unsent(job); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+func (m *minter) sendJobs(ctx context.Context, contract common.Address, jobs []*mintJob) error {
+	c, err := m.campaign(jobs[0].Campaign)
+	if err != nil {
+		return err
+	}
+	meta, method, args, err := m.mintCall(ctx, c, jobs)
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) == 1 {
+		job := jobs[0]
+		_, err = m.transactWith(ctx, m.mintKey(contract), meta, contract, func(tx *types.Transaction) error {
+			raw, err := tx.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			return m.submitted(job, contract, tx.Hash(), raw)
+		}, method, args...)
+		return err
+	}
+
+	batch := &mintBatch{ID: newJobID(), Contract: contract.Hex()}
+	for _, job := range jobs {
+		batch.Jobs = append(batch.Jobs, job.ID)
+	}
+	_, err = m.transactWith(ctx, m.mintKey(contract), meta, contract, func(tx *types.Transaction) error {
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		batch.TxHash = tx.Hash().Hex()
+		batch.RawTx = hexutil.Encode(raw)
+		if err := m.store.Set(batchKey(batch.ID), batch); err != nil {
+			return err
+		}
+		for i, job := range jobs {
+			job.Batch = batch.ID
+			job.BatchIndex = i
+			if err := m.submitted(job, contract, tx.Hash(), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, method, args...)
+	return err
+}
+
+// mintCall returns the call minting the tokens of the jobs of the campaign:
+// safeMint for a single job and safeMintBatch for more, their soulbound
+// overloads for soulbound campaigns, the ones setting the royalty of the
+// tokens for campaigns with a royalty sharing the contract of their chain,
+// and a unit of the edition per job for ERC-1155 campaigns.
+func (m *minter) mintCall(ctx context.Context, c *campaign, jobs []*mintJob) (*bind.MetaData, string, []interface{}, error) {
+	if c.Standard == standardERC1155 {
+		method, args, err := m.editionCall(ctx, c, jobs)
+		return nftlink.NFTLinkEditionsMetaData, method, args, err
+	}
+	// the default royalty of the contract is the one of the campaigns minting
+	// to a contract of their own
+	tokenRoyalty := c.Royalty != nil && !m.ownContract(c)
+
+	if len(jobs) == 1 {
+		to, uri := common.HexToAddress(jobs[0].Wallet), jobs[0].TokenURI
+		switch {
+		case tokenRoyalty:
+			return nftlink.NFTLinkMetaData, "safeMintWithRoyalty", []interface{}{to, uri, c.Soulbound, common.HexToAddress(c.Royalty.Receiver), big.NewInt(int64(c.Royalty.BasisPoints))}, nil
+		case c.Soulbound:
+			return nftlink.NFTLinkMetaData, safeMintSoulbound, []interface{}{to, uri, true}, nil
+		}
+		return nftlink.NFTLinkMetaData, "safeMint", []interface{}{to, uri}, nil
+	}
+	to := []common.Address{}
+	uris := []string{}
+	for _, job := range jobs {
+		to = append(to, common.HexToAddress(job.Wallet))
+		uris = append(uris, job.TokenURI)
+	}
+	switch {
+	case tokenRoyalty:
+		return nftlink.NFTLinkMetaData, "safeMintBatchWithRoyalty", []interface{}{to, uris, c.Soulbound, common.HexToAddress(c.Royalty.Receiver), big.NewInt(int64(c.Royalty.BasisPoints))}, nil
+	case c.Soulbound:
+		return nftlink.NFTLinkMetaData, safeMintBatchSoulbound, []interface{}{to, uris, true}, nil
+	}
+	return nftlink.NFTLinkMetaData, "safeMintBatch", []interface{}{to, uris}, nil
+}
+
+// bumpBatch replaces the stuck transaction of the job's batch, unless another
+// job of the batch already did, and brings the job up to date with the
+// transactions sent for the batch.
+func (m *minter) bumpBatch(ctx context.Context, job *mintJob) error {
+	batchReplacements.Lock()
+	defer batchReplacements.Unlock()
+
+	batch := &mintBatch{}
+	found, err := m.store.Get(batchKey(job.Batch), batch)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("batch %s of job %s not found", job.Batch, job.ID)
+	}
+
+	if batch.TxHash == job.TxHash {
+		tx, err := m.replace(ctx, job.RawTx)
+		if err != nil {
+			if isNonceError(err) {
+				// the stuck transaction was mined in the meantime
+				return nil
+			}
+			return err
+		}
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		batch.Replaced = append(batch.Replaced, batch.TxHash)
+		batch.TxHash = tx.Hash().Hex()
+		batch.RawTx = hexutil.Encode(raw)
+		if err := m.store.Set(batchKey(batch.ID), batch); err != nil {
+			return err
+		}
+	}
+
+	job.Replaced = batch.Replaced
+	job.TxHash = batch.TxHash
+	job.RawTx = batch.RawTx
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+
+	// every hash but the first one is a replacement
+	replacements := append(append([]string{}, batch.Replaced[1:]...), batch.TxHash)
+	return m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		claim.ReplacementTxs = replacements
+		return nil
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestBatcher(t *testing.T) {
+	var cases = []struct {
+		name      string
+		size      int
+		campaigns []string // one job per entry
+		want      map[string][]int
+	}{
+		{"Full batch", 3, []string{"", "", ""}, map[string][]int{"": {3}}},
+		{"Sent after waiting", 3, []string{"", ""}, map[string][]int{"": {2}}},
+		{"Overflow", 2, []string{"", "", ""}, map[string][]int{"": {2, 1}}},
+		{"One batch per campaign", 3, []string{"lot-a", "lot-b", "lot-a"}, map[string][]int{"lot-a": {2}, "lot-b": {1}}},
+		{"More jobs than workers", 8, []string{"", "", "", "", "", "", "", ""}, map[string][]int{"": {8}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			sent := map[string][]int{}
+			b := newBatcher(tc.size, 50*time.Millisecond, func(ctx context.Context, contract common.Address, jobs []*mintJob) {
+				mu.Lock()
+				defer mu.Unlock()
+				sent[jobs[0].Campaign] = append(sent[jobs[0].Campaign], len(jobs))
+				wg.Add(-len(jobs))
+			})
+
+			// a single worker hands every job over in turn
+			wg.Add(len(tc.campaigns))
+			for i, id := range tc.campaigns {
+				job := newMintJob("code", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+				job.Campaign = id
+				b.Add(context.Background(), &campaign{ID: id}, common.Address{}, job)
+				if !b.Holds(job.ID) {
+					t.Errorf("job %d not held", i)
+				}
+				// handing it over again doesn't add it twice
+				b.Add(context.Background(), &campaign{ID: id}, common.Address{}, job)
+			}
+			wg.Wait()
+
+			mu.Lock()
+			defer mu.Unlock()
+			for id, want := range tc.want {
+				got := sent[id]
+				if len(got) != len(want) {
+					t.Fatalf("campaign %q sent batches of %v, want %v", id, got, want)
+				}
+				for i := range want {
+					if got[i] != want[i] {
+						t.Errorf("campaign %q sent batches of %v, want %v", id, got, want)
+					}
+				}
+			}
+		})
+	}
+
+	if newBatcher(1, time.Second, nil) != nil {
+		t.Errorf("batches of one are not disabled")
+	}
+}
+
+// capturingBackend signs and keeps transactions instead of sending them.
+type capturingBackend struct {
+	*fixedEstimate
+	sent []*types.Transaction
+}
+
+func (c *capturingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.sent = append(c.sent, tx)
+	return nil
+}
+
+func TestMintJobsBatch(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	backend := &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 500000}}
+	m.client = backend
+
+	wallets := []string{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "0x71C7656EC7ab88b098defB751B7401B5f6d8976F"}
+	jobs := []*mintJob{}
+	for i, code := range []string{"U6fxRAqxMo", "wKcZ2ceDLs"} {
+		store.Set(code, &ClaimPrize{UUID: code})
+		job := newMintJob(code, wallets[i])
+		job.TokenURI = "Qm" + code
+		if _, err := m.claims.Reserve(code, job.Wallet, job.ID); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err := m.mintJobs(context.Background(), common.HexToAddress(m.contractAddress), jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 1 {
+		t.Fatalf("sent %d transactions, want 1", len(backend.sent))
+	}
+	tx := backend.sent[0]
+
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	method, err := parsed.MethodById(tx.Data()[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method.Name != "safeMintBatch" {
+		t.Fatalf("sent %s, want safeMintBatch", method.Name)
+	}
+	args, err := method.Inputs.Unpack(tx.Data()[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, uris := args[0].([]common.Address), args[1].([]string)
+
+	batch := &mintBatch{}
+	if found, err := store.Get(batchKey(jobs[0].Batch), batch); err != nil || !found {
+		t.Fatalf("batch %q not saved: %v", jobs[0].Batch, err)
+	}
+	if batch.TxHash != tx.Hash().Hex() {
+		t.Errorf("batch saved transaction %s, want %s", batch.TxHash, tx.Hash().Hex())
+	}
+
+	for i, job := range jobs {
+		if job.Batch != batch.ID || job.BatchIndex != i || job.TxHash != tx.Hash().Hex() || job.State != jobSubmitted {
+			t.Errorf("job %d not submitted in the batch: %+v", i, job)
+		}
+		if to[i] != common.HexToAddress(job.Wallet) || uris[i] != job.TokenURI {
+			t.Errorf("token %d mints %s to %s, want %s to %s", i, uris[i], to[i].Hex(), job.TokenURI, job.Wallet)
+		}
+		if batch.Jobs[i] != job.ID {
+			t.Errorf("batch lists job %s at %d, want %s", batch.Jobs[i], i, job.ID)
+		}
+		claim, _, err := m.claims.Get(job.Code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claim.Status != claimSubmitted || claim.TxHash != job.TxHash {
+			t.Errorf("claim %s not submitted with the batch: %+v", job.Code, claim)
+		}
+	}
+}
+
+func TestMintedTokenInBatch(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := common.HexToAddress(m.contractAddress)
+
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := func(address common.Address, from common.Address, tokenID int64) *types.Log {
+		return &types.Log{
+			Address: address,
+			Topics: []common.Hash{
+				parsed.Events["Transfer"].ID,
+				common.BytesToHash(from.Bytes()),
+				common.BytesToHash(common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B").Bytes()),
+				common.BigToHash(big.NewInt(tokenID)),
+			},
+		}
+	}
+	other := m.signer.Address()
+
+	receipt := &types.Receipt{
+		Status: types.ReceiptStatusSuccessful,
+		Logs: []*types.Log{
+			transfer(contract, common.Address{}, 7),
+			transfer(common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F"), common.Address{}, 99),
+			transfer(contract, other, 3),
+			transfer(contract, common.Address{}, 8),
+			transfer(contract, common.Address{}, 9),
+		},
+	}
+
+	for index, want := range []int64{7, 8, 9} {
+		tokenID, err := m.mintedToken(contract, receipt, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokenID.Int64() != want {
+			t.Errorf("token %d of the batch is %v, want %d", index, tokenID, want)
+		}
+	}
+	if _, err := m.mintedToken(contract, receipt, 3); err == nil {
+		t.Errorf("found a fourth token in a batch of three")
+	}
+}
+
+func TestBatchOfOne(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.batcher = newBatcher(4, 10*time.Millisecond, m.processBatch)
+
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+	job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.queue.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing else arrives, the job is minted on its own with safeMint
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		saved, _, err := m.queue.Get(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.State.done() {
+			if saved.State != jobConfirmed || saved.Batch != "" || saved.TokenID == "" {
+				t.Errorf("job not minted on its own: %+v", saved)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", saved.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBatchOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = contract.Hex()
+
+	wallets := []string{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "0x71C7656EC7ab88b098defB751B7401B5f6d8976F"}
+	jobs := []*mintJob{}
+	for i, code := range []string{"U6fxRAqxMo", "wKcZ2ceDLs", "HnF3s8pQzX"} {
+		store.Set(code, &ClaimPrize{UUID: code})
+		job := newMintJob(code, wallets[i%2])
+		job.TokenURI = "Qm" + code
+		if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.queue.Enqueue(job); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	// one safeMintBatch mints every token to its wallet
+	m.processBatch(context.Background(), contract, jobs)
+	caller, err := nftlink.NewNFTLinkCaller(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		saved, _, err := m.queue.Get(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.State != jobConfirmed || saved.Batch == "" {
+			t.Fatalf("job not minted in the batch: %+v", saved)
+		}
+		id, _ := new(big.Int).SetString(saved.TokenID, 10)
+		owner, err := caller.OwnerOf(nil, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uri, err := caller.TokenURI(nil, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != common.HexToAddress(job.Wallet) || !strings.HasSuffix(uri, job.TokenURI) {
+			t.Errorf("token %v of %s is %s owned by %s, want %s owned by %s", id, job.Code, uri, owner.Hex(), job.TokenURI, job.Wallet)
+		}
+	}
+}
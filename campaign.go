@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/philippgille/gokv"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	errCampaignNotFound   = errors.New("campaign not found")
+	errCampaignNotStarted = errors.New("campaign has not started")
+	errCampaignEnded      = errors.New("campaign has ended")
+)
+
+// campaign is a product lot: a batch of bottles whose codes mint the same
+// kind of token to the same contract.
+type campaign struct {
+	ID             string    `json:"id" yaml:"id"`
+	Name           string    `json:"name" yaml:"name"`
+	Lot            string    `json:"lot" yaml:"lot"`
+	Bottles        uint64    `json:"bottles" yaml:"bottles"`
+	ProductionDate time.Time `json:"production_date" yaml:"production_date"`
+	Image          string    `json:"image" yaml:"image"`
+	// path of the metadata template, empty for metadata/lot.yaml
+	MetadataTemplate string `json:"metadata_template,omitempty" yaml:"metadata_template"`
+	// chain profile to mint on, empty for the default one
+	Chain string `json:"chain,omitempty" yaml:"chain"`
+	// empty for the contract of the chain profile
+	ContractAddress string `json:"contract_address,omitempty" yaml:"contract_address"`
+	// the contract predates pause and maxSupply, claims aren't checked
+	// against them
+	LegacyContract bool      `json:"legacy_contract,omitempty" yaml:"legacy_contract"`
+	StartsAt       time.Time `json:"starts_at,omitempty" yaml:"starts_at"`
+	EndsAt         time.Time `json:"ends_at,omitempty" yaml:"ends_at"` // zero for no end
+	// gwei of gas the lot may spend, 0 for no cap
+	SpendCap int64 `json:"spend_cap,omitempty" yaml:"spend_cap"`
+	// how codes get their token: empty to mint it, "voucher" to hand out a
+	// signed voucher the wallet redeems itself, "merkle" for the holder to
+	// claim it on the contract with the proof of the code
+	Mode string `json:"mode,omitempty" yaml:"mode"`
+	// paid on secondary sales of the tokens, nil for none
+	Royalty *royalty `json:"royalty,omitempty" yaml:"royalty"`
+	// mint tokens that stay with the wallet they are minted to, for proofs
+	// of purchase
+	Soulbound bool `json:"soulbound,omitempty" yaml:"soulbound"`
+	// empty to mint an NFTLink token per code, "erc1155" to mint a unit of a
+	// single edition per code on the NFTLinkEditions contract_address
+	Standard string `json:"standard,omitempty" yaml:"standard"`
+}
+
+// campaignsKey holds the IDs of every campaign saved in the store.
+const campaignsKey = "campaigns"
+
+func campaignKey(id string) string {
+	return "campaign/" + id
+}
+
+// loadCampaign reads a campaign from a YAML file.
+func loadCampaign(path string) (*campaign, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &campaign{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("parsing campaign %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Open reports whether codes of the campaign can be claimed at the given time.
+func (c *campaign) Open(now time.Time) error {
+	if !c.StartsAt.IsZero() && now.Before(c.StartsAt) {
+		return errCampaignNotStarted
+	}
+	if !c.EndsAt.IsZero() && !now.Before(c.EndsAt) {
+		return errCampaignEnded
+	}
+	return nil
+}
+
+func (c *campaign) validate() error {
+	if c.ID == "" {
+		return errors.New("campaign has no id")
+	}
+	if c.ContractAddress != "" && !common.IsHexAddress(c.ContractAddress) {
+		return fmt.Errorf("campaign %s has an invalid contract address %q", c.ID, c.ContractAddress)
+	}
+	if !c.EndsAt.IsZero() && !c.EndsAt.After(c.StartsAt) {
+		return fmt.Errorf("campaign %s ends before it starts", c.ID)
+	}
+	if c.Mode != "" && c.Mode != modeVoucher && c.Mode != modeMerkle {
+		return fmt.Errorf("campaign %s has an unknown mode %q", c.ID, c.Mode)
+	}
+	// vouchers and claims mint through redeem and claim, which can't lock
+	if c.Soulbound && c.Mode != "" {
+		return fmt.Errorf("campaign %s can't mint soulbound tokens in mode %q", c.ID, c.Mode)
+	}
+	if c.Standard != "" && c.Standard != standardERC1155 {
+		return fmt.Errorf("campaign %s has an unknown standard %q", c.ID, c.Standard)
+	}
+	if c.Standard == standardERC1155 {
+		switch {
+		case c.ContractAddress == "":
+			return fmt.Errorf("campaign %s mints editions but has no contract address", c.ID)
+		case c.Mode != "" || c.Soulbound || c.Royalty != nil:
+			return fmt.Errorf("campaign %s mints editions, which have no mode, soulbound or royalty", c.ID)
+		}
+	}
+	if c.Royalty != nil {
+		if err := c.Royalty.validate(); err != nil {
+			return fmt.Errorf("campaign %s: %v", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// campaigns keeps the campaigns in the store, along with what every one of
+// them needs to mint: its parsed metadata template and its serial counter.
+type campaigns struct {
+	store gokv.Store
+	index *storeIndex
+
+	mu        sync.Mutex
+	templates map[string]*metadataTemplate
+	serials   map[string]*serials
+}
+
+func newCampaigns(store gokv.Store) *campaigns {
+	return &campaigns{
+		store:     store,
+		index:     newStoreIndex(store, campaignsKey),
+		templates: map[string]*metadataTemplate{},
+		serials:   map[string]*serials{},
+	}
+}
+
+// Save checks the campaign, including its metadata template, and stores it.
+func (s *campaigns) Save(c *campaign) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.templates, c.ID)
+	s.mu.Unlock()
+	if _, err := s.Template(c); err != nil {
+		return err
+	}
+
+	if err := s.store.Set(campaignKey(c.ID), c); err != nil {
+		return err
+	}
+	return s.index.Add(c.ID)
+}
+
+func (s *campaigns) Get(id string) (*campaign, error) {
+	c := &campaign{}
+	found, err := s.store.Get(campaignKey(id), c)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", errCampaignNotFound, id)
+	}
+	return c, nil
+}
+
+// List returns the IDs of every campaign.
+func (s *campaigns) List() ([]string, error) {
+	return s.index.List()
+}
+
+// SaveCodes records the redeem codes created for the campaign.
+func (s *campaigns) SaveCodes(id string, codes []string) error {
+	return s.store.Set(campaignKey(id)+"/codes", codes)
+}
+
+// Codes returns the redeem codes created for the campaign, empty for
+// campaigns created before codes were recorded.
+func (s *campaigns) Codes(id string) ([]string, error) {
+	codes := []string{}
+	if _, err := s.store.Get(campaignKey(id)+"/codes", &codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Template returns the parsed metadata template of the campaign.
+func (s *campaigns) Template(c *campaign) (*metadataTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.templates[c.ID]; ok {
+		return t, nil
+	}
+	var t *metadataTemplate
+	var err error
+	switch {
+	case c.MetadataTemplate == "" && c.Standard == standardERC1155:
+		t, err = builtinMetadataTemplate("edition.yaml")
+	case c.MetadataTemplate == "":
+		t, err = builtinMetadataTemplate("lot.yaml")
+	default:
+		t, err = loadMetadataTemplate(c.MetadataTemplate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("campaign %s: %v", c.ID, err)
+	}
+	s.templates[c.ID] = t
+	return t, nil
+}
+
+// Serials returns the counter numbering the tokens of the campaign.
+func (s *campaigns) Serials(c *campaign) *serials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sr, ok := s.serials[c.ID]; ok {
+		return sr
+	}
+	sr := newSerials(s.store, campaignKey(c.ID))
+	s.serials[c.ID] = sr
+	return sr
+}
+
+// VoucherNonces returns the counter numbering the vouchers of a contract,
+// shared by all the campaigns minting to it.
+func (s *campaigns) VoucherNonces(chain string, contract common.Address) *serials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := "voucher/" + chain + "/" + contract.Hex()
+	if sr, ok := s.serials[key]; ok {
+		return sr
+	}
+	sr := newSerials(s.store, key)
+	s.serials[key] = sr
+	return sr
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// recordingIPFS keeps everything uploaded to it.
+type recordingIPFS struct {
+	mu      sync.Mutex
+	uploads []string
+}
+
+func (i *recordingIPFS) Add(input io.Reader) (IPFSUploadResponse, error) {
+	b, err := ioutil.ReadAll(input)
+	if err != nil {
+		return IPFSUploadResponse{}, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.uploads = append(i.uploads, string(b))
+	return IPFSUploadResponse{Hash: "QmMetadata"}, nil
+}
+
+func TestCampaignOpen(t *testing.T) {
+	now := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		starts   time.Time
+		ends     time.Time
+		expected error
+	}{
+		{"No dates", time.Time{}, time.Time{}, nil},
+		{"Running", now.Add(-time.Hour), now.Add(time.Hour), nil},
+		{"Not started", now.Add(time.Hour), time.Time{}, errCampaignNotStarted},
+		{"Ended", time.Time{}, now, errCampaignEnded},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &campaign{StartsAt: tc.starts, EndsAt: tc.ends}
+			if err := c.Open(now); err != tc.expected {
+				t.Errorf("Open() = %v, expected %v", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSaveCampaign(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	campaigns := newCampaigns(store)
+
+	var tests = []struct {
+		name     string
+		campaign campaign
+		valid    bool
+	}{
+		{"Valid", campaign{ID: "202112R", ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"}, true},
+		{"No ID", campaign{ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"}, false},
+		{"Bad contract", campaign{ID: "202112R", ContractAddress: "0xAb58"}, false},
+		{"Ends before it starts", campaign{ID: "202112R", ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+			StartsAt: time.Now(), EndsAt: time.Now().Add(-time.Hour)}, false},
+		{"Missing template", campaign{ID: "202112R", ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+			MetadataTemplate: "does/not/exist.yaml"}, false},
+		{"Soulbound", campaign{ID: "202112R", Soulbound: true}, true},
+		{"Soulbound vouchers", campaign{ID: "202112R", Mode: modeVoucher, Soulbound: true}, false},
+		{"Edition", campaign{ID: "202112R", Standard: standardERC1155, ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"}, true},
+		{"Edition on the chain contract", campaign{ID: "202112R", Standard: standardERC1155}, false},
+		{"Soulbound edition", campaign{ID: "202112R", Standard: standardERC1155, ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+			Soulbound: true}, false},
+		{"Unknown standard", campaign{ID: "202112R", Standard: "erc20"}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.campaign
+			err := campaigns.Save(&c)
+			if tc.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected the campaign to be rejected")
+			}
+		})
+	}
+
+	ids, err := campaigns.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "202112R" {
+		t.Errorf("campaigns = %v, expected [202112R]", ids)
+	}
+}
+
+func TestCampaignMint(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	ipfs := &recordingIPFS{}
+	m.ipfs = ipfs
+
+	// the lot mints to a contract of its own
+	address := deployNFTLink(t, m.client.(*SimulatedBackend), m.signer.(*keySigner).key)
+	lot := &campaign{
+		ID:              "202203R",
+		Name:            "Ma'hai",
+		Lot:             "202203R",
+		Bottles:         600,
+		ProductionDate:  time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		Image:           "ipfs://QmLot",
+		ContractAddress: address.Hex(),
+	}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: lot.ID})
+
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned %v: %s", rr.Code, rr.Body.String())
+	}
+	job := &mintJob{}
+	if err := json.Unmarshal(rr.Body.Bytes(), job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Campaign != lot.ID {
+		t.Errorf("job campaign = %q, expected %q", job.Campaign, lot.ID)
+	}
+
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	claim, _, err := m.claims.Get("U6fxRAqxMo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claim.Claimed || *claim.Number != 1 {
+		t.Errorf("claim = %+v, expected bottle 1 claimed", claim)
+	}
+
+	// minted on the lot's contract, not the default one
+	for contract, expected := range map[common.Address]int64{address: 1, common.HexToAddress(m.contractAddress): 0} {
+		nftcontract, err := nftlink.NewNFTLink(contract, m.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := nftcontract.Count(&bind.CallOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count.Int64() != expected {
+			t.Errorf("%s minted %v tokens, expected %d", contract.Hex(), count, expected)
+		}
+	}
+
+	expected := `{"name":"Ma'hai #1","description":"Ma'hai #1, lote 202203R","image":"ipfs://QmLot","attributes":[` +
+		`{"trait_type":"Lote","value":"202203R"},` +
+		`{"trait_type":"Partida","value":"600 botellas"},` +
+		`{"trait_type":"Fecha de produccion","display_type":"date","value":"1646092800"}]}`
+	if len(ipfs.uploads) != 1 || ipfs.uploads[0] != expected {
+		t.Errorf("uploaded %v, expected %s", ipfs.uploads, expected)
+	}
+}
+
+func TestCampaignWindow(t *testing.T) {
+	var tests = []struct {
+		name     string
+		starts   time.Time
+		ends     time.Time
+		expected int
+	}{
+		{"Not started", time.Now().Add(time.Hour), time.Time{}, http.StatusForbidden},
+		{"Ended", time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Hour), http.StatusForbidden},
+		{"Running", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), http.StatusAccepted},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+
+			lot := &campaign{ID: "202203R", ContractAddress: m.contractAddress, StartsAt: tc.starts, EndsAt: tc.ends}
+			if err := m.campaigns.Save(lot); err != nil {
+				t.Fatal(err)
+			}
+			store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: lot.ID})
+
+			r := mux.NewRouter()
+			r.Handle("/mint/{id}/{wallet}", m)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+			if rr.Code != tc.expected {
+				t.Errorf("handler returned %v: %s, expected %v", rr.Code, rr.Body.String(), tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// chainProfile is everything needed to mint on one network. The top level
+// settings of the config make up the default profile, named profiles under
+// "chains" only need what differs from it:
+//
+//	chains:
+//	  polygon:
+//	    rpc_url: https://polygon-rpc.com
+//	    chain_id: 137
+//	    contract_address: 0x...
+//	    fee_mode: dynamic
+type chainProfile struct {
+	RPCURL          string `mapstructure:"rpc_url"`
+	ChainID         int64  `mapstructure:"chain_id"` // checked against the node, 0 trusts it
+	ContractAddress string `mapstructure:"contract_address"`
+	LegacyContract  bool   `mapstructure:"legacy_contract"` // the contract predates pause and maxSupply
+	// MinimalForwarder trusted by the contract for gasless voucher redeems
+	ForwarderAddress string `mapstructure:"forwarder_address"`
+	// the signer, see chainProfile.signer
+	PrivateKey             string `mapstructure:"private_key"`
+	Keystore               string `mapstructure:"keystore"`
+	KeystorePassphrase     string `mapstructure:"keystore_passphrase"`
+	KeystorePassphraseFile string `mapstructure:"keystore_passphrase_file"`
+	ExternalSigner         string `mapstructure:"external_signer"`
+	SignerAddress          string `mapstructure:"signer_address"`
+	PKCS11Module           string `mapstructure:"pkcs11_module"`
+	PKCS11Slot             uint   `mapstructure:"pkcs11_slot"`
+	PKCS11Label            string `mapstructure:"pkcs11_label"`
+	PKCS11Pin              string `mapstructure:"pkcs11_pin"`
+	PKCS11PinFile          string `mapstructure:"pkcs11_pin_file"`
+	// hot wallets granted MINTER_ROLE, mints are spread over them
+	MinterKeys      []string `mapstructure:"minter_keys"`
+	MinterKeystores []string `mapstructure:"minter_keystores"`
+
+	FeeMode              string `mapstructure:"fee_mode"`
+	GasPrice             int64  `mapstructure:"gas_price"`
+	MaxFeePerGas         int64  `mapstructure:"max_fee_per_gas"`
+	MaxPriorityFeePerGas int64  `mapstructure:"max_priority_fee_per_gas"`
+	Confirmations        uint64 `mapstructure:"confirmations"`
+	MinBalance           int64  `mapstructure:"min_balance"`     // gwei, below it new mints are refused
+	DailySpendCap        int64  `mapstructure:"daily_spend_cap"` // gwei of gas per key and UTC day
+}
+
+// withDefaults fills in the fields p leaves unset from def.
+func (p chainProfile) withDefaults(def chainProfile) chainProfile {
+	if p.RPCURL == "" {
+		p.RPCURL = def.RPCURL
+	}
+	if p.ContractAddress == "" {
+		p.ContractAddress = def.ContractAddress
+		p.LegacyContract = def.LegacyContract
+	}
+	if p.ForwarderAddress == "" {
+		p.ForwarderAddress = def.ForwarderAddress
+	}
+	if p.PrivateKey == "" && p.Keystore == "" && p.ExternalSigner == "" && p.PKCS11Module == "" {
+		p.PrivateKey = def.PrivateKey
+		p.Keystore = def.Keystore
+		p.KeystorePassphrase = def.KeystorePassphrase
+		p.KeystorePassphraseFile = def.KeystorePassphraseFile
+		p.ExternalSigner = def.ExternalSigner
+		p.SignerAddress = def.SignerAddress
+		p.PKCS11Module = def.PKCS11Module
+		p.PKCS11Slot = def.PKCS11Slot
+		p.PKCS11Label = def.PKCS11Label
+		p.PKCS11Pin = def.PKCS11Pin
+		p.PKCS11PinFile = def.PKCS11PinFile
+	}
+	if len(p.MinterKeys) == 0 && len(p.MinterKeystores) == 0 {
+		p.MinterKeys = def.MinterKeys
+		p.MinterKeystores = def.MinterKeystores
+	}
+	if p.FeeMode == "" {
+		p.FeeMode = def.FeeMode
+		// fee settings only make sense for the mode they were written for
+		if p.GasPrice == 0 && p.MaxFeePerGas == 0 && p.MaxPriorityFeePerGas == 0 {
+			p.GasPrice = def.GasPrice
+			p.MaxFeePerGas = def.MaxFeePerGas
+			p.MaxPriorityFeePerGas = def.MaxPriorityFeePerGas
+		}
+	}
+	if p.Confirmations == 0 {
+		p.Confirmations = def.Confirmations
+	}
+	if p.MinBalance == 0 {
+		p.MinBalance = def.MinBalance
+	}
+	if p.DailySpendCap == 0 {
+		p.DailySpendCap = def.DailySpendCap
+	}
+	return p
+}
+
+// feePolicy returns the fee policy of the profile.
+func (p chainProfile) feePolicy(bumpPercent int64) (*feePolicy, error) {
+	mode := feeMode(p.FeeMode)
+	if mode != feeDynamic && mode != feeLegacy {
+		return nil, fmt.Errorf("unknown fee_mode %q, want %q or %q", mode, feeDynamic, feeLegacy)
+	}
+	return &feePolicy{
+		mode:     mode,
+		gasPrice: gwei(p.GasPrice),
+		maxFee:   gwei(p.MaxFeePerGas),
+		maxTip:   gwei(p.MaxPriorityFeePerGas),
+
+		bumpPercent: bumpPercent,
+	}, nil
+}
+
+// dial connects to the node of the profile and makes sure it serves the
+// expected chain, so a wrong URL can't send mints to another network.
+func (p chainProfile) dial(ctx context.Context) (*ethclient.Client, *big.Int, error) {
+	client, err := ethclient.DialContext(ctx, p.RPCURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	chainID, err := client.NetworkID(ctx)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	if p.ChainID != 0 && chainID.Cmp(big.NewInt(p.ChainID)) != 0 {
+		client.Close()
+		return nil, nil, fmt.Errorf("%s serves chain %v, expected %d", p.RPCURL, chainID, p.ChainID)
+	}
+	return client, chainID, nil
+}
+
+// onChain returns a minter for another chain. It shares the store, queue,
+// IPFS client and campaigns of m and brings its own client, signer, minter
+// pool, nonces, receipt tracking and fees.
+func (m *minter) onChain(name string, p chainProfile, client ethBackend, chainID *big.Int, bumpPercent int64) (*minter, error) {
+	signer, err := p.signer()
+	if err != nil {
+		return nil, fmt.Errorf("chain %s: %v", name, err)
+	}
+	minters, err := p.minterSigners()
+	if err != nil {
+		return nil, fmt.Errorf("chain %s: %v", name, err)
+	}
+	fees, err := p.feePolicy(bumpPercent)
+	if err != nil {
+		return nil, fmt.Errorf("chain %s: %v", name, err)
+	}
+
+	c := *m
+	c.chain = name
+	c.chainID = chainID.Uint64()
+	c.chains = nil
+	c.client = client
+	c.signer = signer
+	c.nonces = newNonceManager(client, signer.Address())
+	c.pool = newMinterPool(client, minters)
+	c.tracker = newTxTracker(client, p.Confirmations, m.tracker.interval, m.tracker.stuckAfter)
+	c.contractAddress = p.ContractAddress
+	c.legacyContract = p.LegacyContract
+	c.forwarder = p.ForwarderAddress
+	c.serials = newSerials(m.store, p.ContractAddress)
+	c.fees = fees
+	if m.batcher != nil {
+		c.batcher = newBatcher(m.batcher.size, m.batcher.wait, c.processBatch)
+	}
+	if m.supply != nil {
+		c.supply = newSupplyGuard(client)
+	}
+	if m.guard != nil {
+		c.guard = newSpendGuard(name, client, accountsOf(append([]Signer{signer}, minters...)), m.store, m.guard.alerts, gwei(p.MinBalance), gwei(p.DailySpendCap))
+	}
+	return &c, nil
+}
+
+// on returns the minter for the named chain, "" being the default one.
+func (m *minter) on(chain string) (*minter, error) {
+	if chain == m.chain {
+		return m, nil
+	}
+	if c, ok := m.chains[chain]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown chain %q", chain)
+}
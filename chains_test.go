@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestChainProfileDefaults(t *testing.T) {
+	defaults := chainProfile{
+		RPCURL:          "https://mainnet.infura.io/v3/project",
+		ContractAddress: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+		PrivateKey:      "key",
+		MinterKeys:      []string{"hot1", "hot2"},
+		FeeMode:         string(feeDynamic),
+		MaxFeePerGas:    200,
+		Confirmations:   3,
+	}
+
+	var tests = []struct {
+		name     string
+		profile  chainProfile
+		expected chainProfile
+	}{
+		{
+			name:     "Empty",
+			profile:  chainProfile{},
+			expected: defaults,
+		},
+		{
+			name:    "Own network",
+			profile: chainProfile{RPCURL: "https://polygon-rpc.com", ChainID: 137, ContractAddress: "0x0000000000000000000000000000000000000001"},
+			expected: chainProfile{
+				RPCURL:          "https://polygon-rpc.com",
+				ChainID:         137,
+				ContractAddress: "0x0000000000000000000000000000000000000001",
+				PrivateKey:      "key",
+				MinterKeys:      []string{"hot1", "hot2"},
+				FeeMode:         string(feeDynamic),
+				MaxFeePerGas:    200,
+				Confirmations:   3,
+			},
+		},
+		{
+			name:    "Own fees",
+			profile: chainProfile{FeeMode: string(feeLegacy), GasPrice: 30, Confirmations: 64},
+			expected: chainProfile{
+				RPCURL:          defaults.RPCURL,
+				ContractAddress: defaults.ContractAddress,
+				PrivateKey:      "key",
+				MinterKeys:      []string{"hot1", "hot2"},
+				FeeMode:         string(feeLegacy),
+				GasPrice:        30,
+				Confirmations:   64,
+			},
+		},
+		{
+			name:    "Own ceilings",
+			profile: chainProfile{MaxPriorityFeePerGas: 2},
+			expected: chainProfile{
+				RPCURL:               defaults.RPCURL,
+				ContractAddress:      defaults.ContractAddress,
+				PrivateKey:           "key",
+				MinterKeys:           []string{"hot1", "hot2"},
+				FeeMode:              string(feeDynamic),
+				MaxPriorityFeePerGas: 2,
+				Confirmations:        3,
+			},
+		},
+		{
+			name:    "Own minters",
+			profile: chainProfile{MinterKeystores: []string{"/keys/hot.json"}},
+			expected: chainProfile{
+				RPCURL:          defaults.RPCURL,
+				ContractAddress: defaults.ContractAddress,
+				PrivateKey:      "key",
+				MinterKeystores: []string{"/keys/hot.json"},
+				FeeMode:         string(feeDynamic),
+				MaxFeePerGas:    200,
+				Confirmations:   3,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.profile.withDefaults(defaults); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("withDefaults() = %+v, expected %+v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMultiChainMint(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	// a second network with its own contract and signer
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := NewSimulatedBackend()
+	address := deployNFTLink(t, l2, key)
+	chainID, err := l2.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := chainProfile{
+		ContractAddress: address.Hex(),
+		PrivateKey:      fmt.Sprintf("%x", crypto.FromECDSA(key)),
+		FeeMode:         string(feeDynamic),
+		Confirmations:   1,
+	}
+	m.chains = map[string]*minter{}
+	m.chains["l2"], err = m.onChain("l2", profile, l2, chainID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.campaigns.Save(&campaign{ID: "202203R", Chain: "l2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.campaigns.Save(&campaign{ID: "202204R", Chain: "sidechain"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: "202203R"})
+	store.Set("Nq3Lp0ZsWd", &ClaimPrize{UUID: "Nq3Lp0ZsWd", Campaign: "202204R"})
+
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+
+	// campaigns on a chain the server doesn't know can't be claimed
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/Nq3Lp0ZsWd/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("unknown chain returned %v: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned %v: %s", rr.Code, rr.Body.String())
+	}
+	job := &mintJob{}
+	if err := json.Unmarshal(rr.Body.Bytes(), job); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	claim, _, err := m.claims.Get("U6fxRAqxMo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claim.Claimed {
+		t.Fatalf("code not claimed: %+v", claim)
+	}
+	if claim.Chain != "l2" || claim.ChainID != chainID.Uint64() || claim.ContractAddress != address.Hex() {
+		t.Errorf("claim minted on chain %q (%d) contract %s, expected l2 (%v) %s",
+			claim.Chain, claim.ChainID, claim.ContractAddress, chainID, address.Hex())
+	}
+
+	for _, tc := range []struct {
+		client   ethBackend
+		contract common.Address
+		expected int64
+	}{
+		{l2, address, 1},
+		{m.client, common.HexToAddress(m.contractAddress), 0},
+	} {
+		nftcontract, err := nftlink.NewNFTLink(tc.contract, tc.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := nftcontract.Count(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count.Int64() != tc.expected {
+			t.Errorf("%s minted %v tokens, expected %d", tc.contract.Hex(), count, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/philippgille/gokv"
+)
+
+type claimStatus string
+
+const (
+	claimAvailable claimStatus = ""
+	claimReserving claimStatus = "reserving"
+	claimSubmitted claimStatus = "submitted"
+	claimFinal     claimStatus = "claimed"
+	claimFailed    claimStatus = "failed"  // the mint reverted and support has to look at it
+	claimVoucher   claimStatus = "voucher" // a voucher was handed out, the wallet mints the token
+)
+
+var (
+	errCodeNotFound   = errors.New("redeem code not found")
+	errAlreadyClaimed = errors.New("already claimed")
+	errCodeReserved   = errors.New("redeem code is being claimed")
+	errClaimFailed    = errors.New("redeem code could not be minted")
+)
+
+// claims guards the read-modify-write cycles on ClaimPrize records. Every
+// change to a code is an atomic update of the store, so only one request can
+// ever reserve a code, whichever instance serves it.
+type claims struct {
+	store gokv.Store
+	open  *storeIndex // codes somewhere between reserved and settled
+}
+
+// openClaimsKey holds the codes that are reserved but not settled yet, so the
+// recovery sweeper can find them.
+const openClaimsKey = "claims/open"
+
+func newClaims(store gokv.Store) *claims {
+	return &claims{store: store, open: newStoreIndex(store, openClaimsKey)}
+}
+
+// settled reports whether no mint is in progress for a claim in this status.
+func (s claimStatus) settled() bool {
+	return s == claimAvailable || s == claimFinal || s == claimFailed || s == claimVoucher
+}
+
+// reservable returns why the claim can't be reserved, if it can't.
+func (claim *ClaimPrize) reservable() error {
+	if claim.Claimed || claim.Status == claimFinal {
+		return errAlreadyClaimed
+	}
+	if claim.Status == claimFailed {
+		return errClaimFailed
+	}
+	// an expired voucher can't be redeemed anymore, the code may get a new one
+	expired := claim.Status == claimVoucher && time.Now().After(claim.VoucherExpiry)
+	if claim.Status != claimAvailable && !expired {
+		return errCodeReserved
+	}
+	return nil
+}
+
+// Reserve moves an available code to the reserving state for the given job
+// and wallet. Exactly one caller can reserve a code: everybody else gets
+// errCodeReserved or errAlreadyClaimed along with the current record.
+func (c *claims) Reserve(code string, wallet string, jobID string) (*ClaimPrize, error) {
+	claim, found, err := c.Get(code)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errCodeNotFound
+	}
+	if err := claim.reservable(); err != nil {
+		return claim, err
+	}
+
+	// listed first, so the sweeper finds the code even if this process dies
+	// right after reserving it
+	if err := c.open.Add(code); err != nil {
+		return nil, err
+	}
+	var refused error
+	claim = &ClaimPrize{}
+	err = storeUpdate(c.store, code, claim, func(found bool) error {
+		if !found {
+			return errCodeNotFound
+		}
+		// somebody may have reserved it since it was read
+		if refused = claim.reservable(); refused != nil {
+			return refused
+		}
+		claim.Status = claimReserving
+		claim.Wallet = wallet
+		claim.JobID = jobID
+		claim.ReservedAt = time.Now().UTC()
+		return nil
+	})
+	if refused != nil {
+		return claim, refused
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// Update applies fn to the stored claim atomically. The change is only saved
+// when fn returns nil. fn may run more than once, on the latest record.
+func (c *claims) Update(code string, fn func(*ClaimPrize) error) error {
+	claim := &ClaimPrize{}
+	err := storeUpdate(c.store, code, claim, func(found bool) error {
+		if !found {
+			return errCodeNotFound
+		}
+		return fn(claim)
+	})
+	if err != nil {
+		return err
+	}
+	if claim.Status.settled() {
+		return c.open.Remove(code)
+	}
+	return nil
+}
+
+// Open returns the codes with a mint in progress.
+func (c *claims) Open() ([]string, error) {
+	return c.open.List()
+}
+
+func (c *claims) Get(code string) (*ClaimPrize, bool, error) {
+	claim := &ClaimPrize{}
+	found, err := c.store.Get(code, claim)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return claim, true, nil
+}
+
+// Release makes a code claimable again, as long as it is still held by the
+// given job and nothing was sent for it. A submitted code is only settled by
+// the receipt of its transaction.
+func (c *claims) Release(code string, jobID string) error {
+	err := c.Update(code, func(claim *ClaimPrize) error {
+		if claim.JobID != jobID || claim.Status != claimReserving {
+			return errCodeReserved
+		}
+		claim.Status = claimAvailable
+		claim.JobID = ""
+		return nil
+	})
+	if err == errCodeReserved {
+		// somebody else owns the code now, leave it alone
+		return nil
+	}
+	return err
+}
+
+// serials hands out the numbers shown in the token metadata ("Ma'hai #N").
+// The counter lives in the store and is seeded once, so numbers never depend
+// on reading the contract while other mints are in flight.
+type serials struct {
+	store gokv.Store
+	key   string
+}
+
+func newSerials(store gokv.Store, key string) *serials {
+	return &serials{store: store, key: "serial/" + key}
+}
+
+// Next returns the next number. seed is called for the first number only, to
+// carry on from whatever was minted before the counter existed.
+func (s *serials) Next(seed func() (uint64, error)) (uint64, error) {
+	var counter, next uint64
+	err := storeUpdate(s.store, s.key, &counter, func(found bool) error {
+		if !found {
+			var err error
+			if counter, err = seed(); err != nil {
+				return err
+			}
+		}
+		next = counter
+		counter++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
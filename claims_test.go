@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestReserve(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	c := newClaims(store)
+
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := []string{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jobID := fmt.Sprintf("job-%d", i)
+			_, err := c.Reserve("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", jobID)
+			if err == nil {
+				mu.Lock()
+				winners = append(winners, jobID)
+				mu.Unlock()
+			} else if err != errCodeReserved {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(winners) != 1 {
+		t.Fatalf("%d callers reserved the code, want exactly one: %v", len(winners), winners)
+	}
+
+	claim := &ClaimPrize{}
+	store.Get("U6fxRAqxMo", claim)
+	if claim.Status != claimReserving || claim.JobID != winners[0] {
+		t.Errorf("claim is %s for job %s, want %s for job %s", claim.Status, claim.JobID, claimReserving, winners[0])
+	}
+
+	// releasing with the wrong job must not free the code
+	if err := c.Release("U6fxRAqxMo", "somebody-else"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Reserve("U6fxRAqxMo", "0x", "late"); err != errCodeReserved {
+		t.Errorf("code reserved again after a foreign release: %v", err)
+	}
+
+	if err := c.Release("U6fxRAqxMo", winners[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Reserve("U6fxRAqxMo", "0x", "late"); err != nil {
+		t.Errorf("code not claimable after release: %v", err)
+	}
+
+	if _, err := c.Reserve("not_found", "0x", "late"); err != errCodeNotFound {
+		t.Errorf("got %v for a missing code, want %v", err, errCodeNotFound)
+	}
+}
+
+func TestConcurrentMint(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+
+	m := newTestMinter(t, store)
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+
+	wallets := []string{
+		"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+		"0xde0B295669a9FD93d5F28D9Ec85E40f4cb697BAe",
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codes := map[int]int{}
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(wallet string) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/"+wallet, nil))
+			mu.Lock()
+			codes[rr.Code]++
+			mu.Unlock()
+		}(wallets[i%len(wallets)])
+	}
+	wg.Wait()
+
+	if codes[http.StatusAccepted]+codes[http.StatusConflict] != 40 {
+		t.Fatalf("unexpected responses: %v", codes)
+	}
+
+	open, err := m.queue.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 1 {
+		t.Fatalf("%d jobs queued for one code, want 1", len(open))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.queue.Start(ctx, 4, m.processJob); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, _, err := m.queue.Get(open[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State.done() {
+			if job.State != jobConfirmed {
+				t.Fatalf("job ended %s: %s", job.State, job.Error)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", job.ID, job.State)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(m.contractAddress), m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := nftcontract.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Int64() != 1 {
+		t.Errorf("minted %v tokens for one code, want 1", count)
+	}
+}
@@ -0,0 +1,6 @@
+// SPDX-License-Identifier: GPLv3
+pragma solidity ^0.8.2;
+
+// MinimalForwarder relays the EIP-2771 meta-transactions of wallets without
+// ETH, NFTLink trusts it to tell who signed them.
+import "@openzeppelin/contracts/metatx/MinimalForwarder.sol";
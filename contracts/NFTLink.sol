@@ -4,33 +4,400 @@ pragma solidity ^0.8.2;
 import "hardhat/console.sol";
 import "@openzeppelin/contracts/token/ERC721/ERC721.sol";
 import "@openzeppelin/contracts/token/ERC721/extensions/ERC721URIStorage.sol";
+import "@openzeppelin/contracts/access/AccessControl.sol";
 import "@openzeppelin/contracts/access/Ownable.sol";
+import "@openzeppelin/contracts/security/Pausable.sol";
+import "@openzeppelin/contracts/interfaces/IERC2981.sol";
 import "@openzeppelin/contracts/utils/Counters.sol";
+import "@openzeppelin/contracts/utils/cryptography/ECDSA.sol";
+import "@openzeppelin/contracts/utils/cryptography/draft-EIP712.sol";
+import "@openzeppelin/contracts/utils/cryptography/MerkleProof.sol";
 
-contract NFTLink is ERC721, ERC721URIStorage, Ownable {
+// IERC5192 signals tokens that can't be transferred, see EIP-5192.
+interface IERC5192 {
+    event Locked(uint256 tokenId);
+    event Unlocked(uint256 tokenId);
+
+    function locked(uint256 tokenId) external view returns (bool);
+}
+
+contract NFTLink is ERC721, ERC721URIStorage, Pausable, AccessControl, Ownable, EIP712, IERC2981, IERC5192 {
     using Counters for Counters.Counter;
 
+    // accounts allowed to mint, so several hot wallets can mint in parallel;
+    // the deployer administers the role
+    bytes32 public constant MINTER_ROLE = keccak256("MINTER_ROLE");
+
     Counters.Counter private _tokenIdCounter;
 
-    constructor() ERC721("NFTLink", "NFTLINK") {
+    // tokens that can ever be minted, 0 for no limit
+    uint256 private _maxSupply;
+
+    // NFTVoucher lets recipient mint a token with uri themselves, paying for
+    // the gas, until expiry (a unix timestamp). Every nonce is redeemed once.
+    struct NFTVoucher {
+        address recipient;
+        string uri;
+        uint256 nonce;
+        uint256 expiry;
+    }
+
+    bytes32 private constant _VOUCHER_TYPEHASH =
+        keccak256("NFTVoucher(address recipient,string uri,uint256 nonce,uint256 expiry)");
+
+    mapping(address => bool) private _voucherSigners;
+    mapping(uint256 => bool) private _redeemedVouchers;
+
+    // EIP-2771 forwarder whose calls carry the real sender, so wallets
+    // without ETH can redeem through a relayer
+    address private _trustedForwarder;
+
+    // roots of the Merkle trees committing to the redeem codes of a lot, and
+    // the codes claimed against them, by hash
+    mapping(bytes32 => bool) private _claimRoots;
+    mapping(bytes32 => bool) private _claimedCodes;
+
+    // ERC-2981 royalties, in basis points of the sale price. Tokens without
+    // a royalty of their own pay the default one.
+    struct RoyaltyInfo {
+        address receiver;
+        uint96 royaltyFraction;
+    }
+
+    RoyaltyInfo private _defaultRoyalty;
+    mapping(uint256 => RoyaltyInfo) private _tokenRoyalties;
+
+    // soulbound tokens stay with the wallet they were minted to, they can
+    // only be burned
+    mapping(uint256 => bool) private _locked;
+
+    event VoucherSignerSet(address indexed signer, bool authorized);
+    event TrustedForwarderSet(address indexed forwarder);
+    event ClaimRootSet(bytes32 indexed root, bool active);
+    event CodeClaimed(bytes32 indexed codeHash, address indexed to, uint256 tokenId);
+    event MaxSupplySet(uint256 maxSupply);
+    event DefaultRoyaltySet(address indexed receiver, uint96 feeNumerator);
+    event TokenRoyaltySet(uint256 indexed tokenId, address indexed receiver, uint96 feeNumerator);
+
+    constructor() ERC721("NFTLink", "NFTLINK") EIP712("NFTLink", "1") {
         console.log("NFTLink constructor");
+        _grantRole(DEFAULT_ADMIN_ROLE, _msgSender());
+        _grantRole(MINTER_ROLE, _msgSender());
     }
 
     function _baseURI() internal pure override returns (string memory) {
         return "ipfs://";
     }
 
-    function safeMint(address to, string memory uri) public onlyOwner {
+    // pause stops every way of minting, until unpause.
+    function pause() public onlyOwner {
+        _pause();
+    }
+
+    function unpause() public onlyOwner {
+        _unpause();
+    }
+
+    function setMaxSupply(uint256 maxSupply_) public onlyOwner {
+        require(maxSupply_ == 0 || maxSupply_ >= _tokenIdCounter.current(), "NFTLink: max supply below minted tokens");
+        _maxSupply = maxSupply_;
+        emit MaxSupplySet(maxSupply_);
+    }
+
+    function maxSupply() public view returns (uint256) {
+        return _maxSupply;
+    }
+
+    function safeMint(address to, string memory uri) public onlyRole(MINTER_ROLE) {
+        _mintURI(to, uri);
+    }
+
+    // safeMint mints a soulbound token if soulbound is set.
+    function safeMint(address to, string memory uri, bool soulbound) public onlyRole(MINTER_ROLE) {
+        uint256 tokenId = _mintURI(to, uri);
+        if (soulbound) {
+            _lock(tokenId);
+        }
+    }
+
+    // safeMintBatch mints one token per recipient in a single transaction.
+    // Token IDs are assigned in order, so the Transfer events follow the
+    // order of the arrays.
+    function safeMintBatch(address[] memory to, string[] memory uris) public onlyRole(MINTER_ROLE) {
+        require(to.length == uris.length, "NFTLink: to and uris length mismatch");
+        for (uint256 i = 0; i < to.length; i++) {
+            _mintURI(to[i], uris[i]);
+        }
+    }
+
+    // safeMintBatch mints soulbound tokens if soulbound is set.
+    function safeMintBatch(address[] memory to, string[] memory uris, bool soulbound) public onlyRole(MINTER_ROLE) {
+        require(to.length == uris.length, "NFTLink: to and uris length mismatch");
+        for (uint256 i = 0; i < to.length; i++) {
+            uint256 tokenId = _mintURI(to[i], uris[i]);
+            if (soulbound) {
+                _lock(tokenId);
+            }
+        }
+    }
+
+    // safeMintWithRoyalty mints a token paying feeNumerator basis points of
+    // its sales to receiver, soulbound if soulbound is set, for lots sharing
+    // the contract with royalties of their own.
+    function safeMintWithRoyalty(
+        address to,
+        string memory uri,
+        bool soulbound,
+        address receiver,
+        uint96 feeNumerator
+    ) public onlyRole(MINTER_ROLE) {
+        uint256 tokenId = _mintURI(to, uri);
+        if (soulbound) {
+            _lock(tokenId);
+        }
+        _setTokenRoyalty(tokenId, receiver, feeNumerator);
+    }
+
+    // safeMintBatchWithRoyalty is safeMintBatch for tokens with a royalty of
+    // their own, see safeMintWithRoyalty.
+    function safeMintBatchWithRoyalty(
+        address[] memory to,
+        string[] memory uris,
+        bool soulbound,
+        address receiver,
+        uint96 feeNumerator
+    ) public onlyRole(MINTER_ROLE) {
+        require(to.length == uris.length, "NFTLink: to and uris length mismatch");
+        for (uint256 i = 0; i < to.length; i++) {
+            uint256 tokenId = _mintURI(to[i], uris[i]);
+            if (soulbound) {
+                _lock(tokenId);
+            }
+            _setTokenRoyalty(tokenId, receiver, feeNumerator);
+        }
+    }
+
+    // burn destroys a token of the caller, or one they are approved for, to
+    // redeem its physical reward
+    function burn(uint256 tokenId) public {
+        require(_isApprovedOrOwner(_msgSender(), tokenId), "NFTLink: caller is not owner nor approved");
+        _burn(tokenId);
+    }
+
+    // redeem mints the token of a voucher signed by the owner or an
+    // authorized voucher signer to its recipient, who must be the caller.
+    function redeem(NFTVoucher calldata voucher, bytes calldata signature) public returns (uint256) {
+        require(voucher.recipient == _msgSender(), "NFTLink: voucher is for another recipient");
+        require(block.timestamp <= voucher.expiry, "NFTLink: voucher expired");
+        require(!_redeemedVouchers[voucher.nonce], "NFTLink: voucher already redeemed");
+
+        bytes32 digest = _hashTypedDataV4(
+            keccak256(
+                abi.encode(
+                    _VOUCHER_TYPEHASH,
+                    voucher.recipient,
+                    keccak256(bytes(voucher.uri)),
+                    voucher.nonce,
+                    voucher.expiry
+                )
+            )
+        );
+        address signer = ECDSA.recover(digest, signature);
+        require(signer == owner() || _voucherSigners[signer], "NFTLink: invalid voucher signature");
+
+        _redeemedVouchers[voucher.nonce] = true;
+        return _mintURI(voucher.recipient, voucher.uri);
+    }
+
+    function setVoucherSigner(address signer, bool authorized) public onlyOwner {
+        _voucherSigners[signer] = authorized;
+        emit VoucherSignerSet(signer, authorized);
+    }
+
+    function isVoucherSigner(address signer) public view returns (bool) {
+        return signer == owner() || _voucherSigners[signer];
+    }
+
+    function voucherRedeemed(uint256 nonce) public view returns (bool) {
+        return _redeemedVouchers[nonce];
+    }
+
+    function setTrustedForwarder(address forwarder) public onlyOwner {
+        _trustedForwarder = forwarder;
+        emit TrustedForwarderSet(forwarder);
+    }
+
+    function isTrustedForwarder(address forwarder) public view returns (bool) {
+        return forwarder != address(0) && forwarder == _trustedForwarder;
+    }
+
+    function setClaimRoot(bytes32 root, bool active) public onlyOwner {
+        _claimRoots[root] = active;
+        emit ClaimRootSet(root, active);
+    }
+
+    function isClaimRoot(bytes32 root) public view returns (bool) {
+        return _claimRoots[root];
+    }
+
+    // claim mints the token of a redeem code to the caller, given the proof
+    // that the code and its token uri are a leaf of an active claim root.
+    // Every code is claimed once, whatever root it is proven against. The
+    // code is public once the transaction is sent, so wallets should send it
+    // privately to keep it from being front-run.
+    function claim(
+        string calldata code,
+        string calldata uri,
+        bytes32[] calldata proof
+    ) public returns (uint256) {
+        bytes32 codeHash = keccak256(bytes(code));
+        require(!_claimedCodes[codeHash], "NFTLink: code already claimed");
+        require(_claimRoots[MerkleProof.processProof(proof, claimLeaf(codeHash, uri))], "NFTLink: invalid claim proof");
+
+        _claimedCodes[codeHash] = true;
+        uint256 tokenId = _mintURI(_msgSender(), uri);
+        emit CodeClaimed(codeHash, _msgSender(), tokenId);
+        return tokenId;
+    }
+
+    // claimLeaf is the leaf of the code with the given hash. Leaves are
+    // longer than 64 bytes before hashing, so no inner node passes for one.
+    function claimLeaf(bytes32 codeHash, string calldata uri) public pure returns (bytes32) {
+        return keccak256(abi.encode(codeHash, uri));
+    }
+
+    function codeClaimed(bytes32 codeHash) public view returns (bool) {
+        return _claimedCodes[codeHash];
+    }
+
+    function royaltyInfo(uint256 tokenId, uint256 salePrice)
+        public
+        view
+        override
+        returns (address receiver, uint256 royaltyAmount)
+    {
+        RoyaltyInfo memory royalty = _tokenRoyalties[tokenId];
+        if (royalty.receiver == address(0)) {
+            royalty = _defaultRoyalty;
+        }
+        return (royalty.receiver, (salePrice * royalty.royaltyFraction) / _feeDenominator());
+    }
+
+    function setDefaultRoyalty(address receiver, uint96 feeNumerator) public onlyOwner {
+        require(feeNumerator <= _feeDenominator(), "NFTLink: royalty fee will exceed salePrice");
+        require(receiver != address(0), "NFTLink: invalid royalty receiver");
+        _defaultRoyalty = RoyaltyInfo(receiver, feeNumerator);
+        emit DefaultRoyaltySet(receiver, feeNumerator);
+    }
+
+    function deleteDefaultRoyalty() public onlyOwner {
+        delete _defaultRoyalty;
+        emit DefaultRoyaltySet(address(0), 0);
+    }
+
+    function setTokenRoyalty(
+        uint256 tokenId,
+        address receiver,
+        uint96 feeNumerator
+    ) public onlyOwner {
+        require(_exists(tokenId), "NFTLink: royalty for nonexistent token");
+        _setTokenRoyalty(tokenId, receiver, feeNumerator);
+    }
+
+    function resetTokenRoyalty(uint256 tokenId) public onlyOwner {
+        delete _tokenRoyalties[tokenId];
+        emit TokenRoyaltySet(tokenId, address(0), 0);
+    }
+
+    // the owner administers the roles, handing over the contract hands over
+    // the roles with it
+    function _transferOwnership(address newOwner) internal override {
+        address oldOwner = owner();
+        super._transferOwnership(newOwner);
+        if (oldOwner != address(0)) {
+            _revokeRole(DEFAULT_ADMIN_ROLE, oldOwner);
+        }
+        if (newOwner != address(0)) {
+            _grantRole(DEFAULT_ADMIN_ROLE, newOwner);
+        }
+    }
+
+    function _setTokenRoyalty(
+        uint256 tokenId,
+        address receiver,
+        uint96 feeNumerator
+    ) internal {
+        require(feeNumerator <= _feeDenominator(), "NFTLink: royalty fee will exceed salePrice");
+        require(receiver != address(0), "NFTLink: invalid royalty receiver");
+        _tokenRoyalties[tokenId] = RoyaltyInfo(receiver, feeNumerator);
+        emit TokenRoyaltySet(tokenId, receiver, feeNumerator);
+    }
+
+    function _feeDenominator() internal pure returns (uint96) {
+        return 10000;
+    }
+
+    function _msgSender() internal view override returns (address sender) {
+        if (isTrustedForwarder(msg.sender)) {
+            // the forwarder appends the address of the signer to the calldata
+            assembly {
+                sender := shr(96, calldataload(sub(calldatasize(), 20)))
+            }
+        } else {
+            return super._msgSender();
+        }
+    }
+
+    function _msgData() internal view override returns (bytes calldata) {
+        if (isTrustedForwarder(msg.sender)) {
+            return msg.data[:msg.data.length - 20];
+        } else {
+            return super._msgData();
+        }
+    }
+
+    function _mintURI(address to, string memory uri) internal whenNotPaused returns (uint256) {
         uint256 tokenId = _tokenIdCounter.current();
+        require(_maxSupply == 0 || tokenId < _maxSupply, "NFTLink: max supply reached");
         _tokenIdCounter.increment();
         _safeMint(to, tokenId);
         _setTokenURI(tokenId, uri);
+        return tokenId;
+    }
+
+    function _lock(uint256 tokenId) internal {
+        _locked[tokenId] = true;
+        emit Locked(tokenId);
+    }
+
+    // soulbound tokens are only ever minted and burned
+    function _beforeTokenTransfer(
+        address from,
+        address to,
+        uint256 tokenId
+    ) internal override {
+        require(from == address(0) || to == address(0) || !_locked[tokenId], "NFTLink: token is soulbound");
+        super._beforeTokenTransfer(from, to, tokenId);
     }
 
     // The following functions are overrides required by Solidity.
 
     function _burn(uint256 tokenId) internal override(ERC721, ERC721URIStorage) {
         super._burn(tokenId);
+        delete _tokenRoyalties[tokenId];
+        delete _locked[tokenId];
+    }
+
+    function supportsInterface(bytes4 interfaceId)
+        public
+        view
+        override(ERC721, AccessControl, IERC165)
+        returns (bool)
+    {
+        return
+            interfaceId == type(IERC2981).interfaceId ||
+            interfaceId == type(IERC5192).interfaceId ||
+            super.supportsInterface(interfaceId);
     }
 
     function tokenURI(uint256 tokenId)
@@ -42,6 +409,11 @@ contract NFTLink is ERC721, ERC721URIStorage, Ownable {
         return super.tokenURI(tokenId);
     }
 
+    function locked(uint256 tokenId) public view override returns (bool) {
+        require(_exists(tokenId), "NFTLink: locked query for nonexistent token");
+        return _locked[tokenId];
+    }
+
     function count() public view returns (uint256) {
         return _tokenIdCounter.current();
     }
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: GPLv3
+pragma solidity ^0.8.2;
+
+import "@openzeppelin/contracts/token/ERC1155/ERC1155.sol";
+import "@openzeppelin/contracts/access/AccessControl.sol";
+import "@openzeppelin/contracts/access/Ownable.sol";
+
+// NFTLinkEditions mints the bottles of a lot as units of a single ERC-1155
+// token, the edition of the lot, instead of one ERC-721 token per bottle.
+contract NFTLinkEditions is ERC1155, AccessControl, Ownable {
+    // accounts allowed to mint; the deployer administers the role
+    bytes32 public constant MINTER_ROLE = keccak256("MINTER_ROLE");
+
+    // Edition is the token of a lot: its metadata, shared by every unit, and
+    // the units that can ever be minted, 0 for no limit.
+    struct Edition {
+        string uri;
+        uint256 maxSupply;
+        uint256 minted;
+    }
+
+    // edition IDs start at 1, 0 is never an edition
+    uint256 private _editionCount;
+    mapping(uint256 => Edition) private _editions;
+
+    // redeem codes minted so far, by hash, so a code never mints twice
+    mapping(bytes32 => bool) private _mintedCodes;
+
+    event EditionCreated(uint256 indexed id, string uri, uint256 maxSupply);
+    event EditionMinted(uint256 indexed id, address indexed to, bytes32 indexed codeHash);
+
+    constructor() ERC1155("") {
+        _grantRole(DEFAULT_ADMIN_ROLE, _msgSender());
+        _grantRole(MINTER_ROLE, _msgSender());
+    }
+
+    function createEdition(string memory uri_, uint256 maxSupply) public onlyOwner returns (uint256) {
+        _editionCount++;
+        uint256 id = _editionCount;
+        _editions[id] = Edition(uri_, maxSupply, 0);
+        emit EditionCreated(id, uri_, maxSupply);
+        return id;
+    }
+
+    // mint mints one unit of the edition to the holder of the redeem code
+    // whose hash is codeHash.
+    function mint(
+        address to,
+        uint256 id,
+        bytes32 codeHash
+    ) public onlyRole(MINTER_ROLE) {
+        _mintUnit(to, id, codeHash);
+    }
+
+    // mintBatch mints one unit of the edition per recipient.
+    function mintBatch(
+        address[] memory to,
+        uint256 id,
+        bytes32[] memory codeHashes
+    ) public onlyRole(MINTER_ROLE) {
+        require(to.length == codeHashes.length, "NFTLinkEditions: to and codeHashes length mismatch");
+        for (uint256 i = 0; i < to.length; i++) {
+            _mintUnit(to[i], id, codeHashes[i]);
+        }
+    }
+
+    function _mintUnit(
+        address to,
+        uint256 id,
+        bytes32 codeHash
+    ) internal {
+        Edition storage edition = _editions[id];
+        require(id != 0 && id <= _editionCount, "NFTLinkEditions: unknown edition");
+        require(edition.maxSupply == 0 || edition.minted < edition.maxSupply, "NFTLinkEditions: edition sold out");
+        require(!_mintedCodes[codeHash], "NFTLinkEditions: code already minted");
+        _mintedCodes[codeHash] = true;
+        edition.minted++;
+        _mint(to, id, 1, "");
+        emit EditionMinted(id, to, codeHash);
+    }
+
+    function uri(uint256 id) public view override returns (string memory) {
+        require(id != 0 && id <= _editionCount, "NFTLinkEditions: unknown edition");
+        return string(abi.encodePacked("ipfs://", _editions[id].uri));
+    }
+
+    function editionCount() public view returns (uint256) {
+        return _editionCount;
+    }
+
+    function minted(uint256 id) public view returns (uint256) {
+        return _editions[id].minted;
+    }
+
+    function maxSupply(uint256 id) public view returns (uint256) {
+        return _editions[id].maxSupply;
+    }
+
+    function codeMinted(bytes32 codeHash) public view returns (bool) {
+        return _mintedCodes[codeHash];
+    }
+
+    // the owner administers the roles, handing over the contract hands over
+    // the roles with it
+    function _transferOwnership(address newOwner) internal override {
+        address oldOwner = owner();
+        super._transferOwnership(newOwner);
+        if (oldOwner != address(0)) {
+            _revokeRole(DEFAULT_ADMIN_ROLE, oldOwner);
+        }
+        if (newOwner != address(0)) {
+            _grantRole(DEFAULT_ADMIN_ROLE, newOwner);
+        }
+    }
+
+    function supportsInterface(bytes4 interfaceId) public view override(ERC1155, AccessControl) returns (bool) {
+        return super.supportsInterface(interfaceId);
+    }
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// standardERC1155 campaigns mint every code as one unit of the edition of
+// their lot on an NFTLinkEditions contract, instead of an NFTLink token of
+// its own.
+const standardERC1155 = "erc1155"
+
+// edition is the ERC-1155 token of a campaign. Its metadata is uploaded once
+// and shared by every unit.
+type edition struct {
+	URI    string `json:"uri"`               // metadata CID
+	TxHash string `json:"tx_hash,omitempty"` // of createEdition, kept to find the ID again after a crash
+	RawTx  string `json:"raw_tx,omitempty"`  // signed createEdition, to replace it if it gets stuck
+	// createEdition transactions TxHash replaced, oldest first
+	Replaced []string `json:"replaced,omitempty"`
+	ID       string   `json:"id,omitempty"` // on the contract, once created
+}
+
+func (e *edition) txHashes() []common.Hash {
+	hashes := []common.Hash{}
+	for _, h := range append(e.Replaced, e.TxHash) {
+		hashes = append(hashes, common.HexToHash(h))
+	}
+	return hashes
+}
+
+func editionKey(campaign string) string {
+	return campaignKey(campaign) + "/edition"
+}
+
+// editionLocks keep the workers of a campaign from creating its edition
+// twice, or replacing the same stuck transaction twice.
+var editionLocks sync.Map // campaign ID -> *sync.Mutex
+
+func editionLock(campaign string) *sync.Mutex {
+	l, _ := editionLocks.LoadOrStore(campaign, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// edition returns the edition of the campaign, uploading its metadata and
+// creating it on the contract the first time, with a maximum supply of the
+// bottles of the lot. The workers of the campaign wait for createEdition
+// together, the first one to find it stuck replaces it.
+func (m *minter) edition(ctx context.Context, c *campaign) (*edition, error) {
+	e, err := m.createEdition(ctx, c)
+	if err != nil || e.ID != "" {
+		return e, err
+	}
+
+	failed := 0
+	for {
+		receipt, err := m.tracker.Wait(ctx, e.txHashes())
+		if err == errTxStuck {
+			sent := e.TxHash
+			if e, err = m.bumpEdition(ctx, c, e); err != nil {
+				log.Printf("replacing stuck transaction %s creating the edition of campaign %s: %v", sent, c.ID, err)
+				if failed++; failed >= maxReplaceFailures {
+					return nil, fmt.Errorf("transaction %s creating the edition of campaign %s is stuck and can't be replaced: %v", sent, c.ID, err)
+				}
+			}
+			if e.ID != "" {
+				return e, nil
+			}
+			if e.TxHash == "" {
+				return nil, fmt.Errorf("creating the edition of campaign %s failed, it is created again on the next mint", c.ID)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return m.editionCreated(c, e, receipt)
+	}
+}
+
+// createEdition returns the edition of the campaign as stored, after sending
+// createEdition for it if nothing was sent yet.
+func (m *minter) createEdition(ctx context.Context, c *campaign) (*edition, error) {
+	mu := editionLock(c.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e := &edition{}
+	if _, err := m.store.Get(editionKey(c.ID), e); err != nil {
+		return nil, err
+	}
+	if e.ID != "" || e.TxHash != "" {
+		return e, nil
+	}
+
+	if e.URI == "" {
+		cid, err := m.upload(c, metadataData{Campaign: *c})
+		if err != nil {
+			return nil, err
+		}
+		e.URI = cid.Hash
+		if err := m.store.Set(editionKey(c.ID), e); err != nil {
+			return nil, err
+		}
+	}
+
+	contract := common.HexToAddress(c.ContractAddress)
+	_, err := m.transact(ctx, nftlink.NFTLinkEditionsMetaData, contract, func(tx *types.Transaction) error {
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.TxHash = tx.Hash().Hex()
+		e.RawTx = hexutil.Encode(raw)
+		return m.store.Set(editionKey(c.ID), e)
+	}, "createEdition", e.URI, new(big.Int).SetUint64(c.Bottles))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// bumpEdition replaces the stuck createEdition of e with one paying more,
+// unless another worker already did, and returns the edition as stored.
+func (m *minter) bumpEdition(ctx context.Context, c *campaign, e *edition) (*edition, error) {
+	mu := editionLock(c.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	stored := &edition{}
+	if _, err := m.store.Get(editionKey(c.ID), stored); err != nil {
+		return e, err
+	}
+	if stored.ID != "" || stored.TxHash != e.TxHash {
+		return stored, nil
+	}
+
+	tx, err := m.replace(ctx, stored.RawTx)
+	if err != nil {
+		if isNonceError(err) {
+			// the stuck transaction was mined in the meantime
+			return stored, nil
+		}
+		return stored, err
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return stored, err
+	}
+	stored.Replaced = append(stored.Replaced, stored.TxHash)
+	stored.TxHash = tx.Hash().Hex()
+	stored.RawTx = hexutil.Encode(raw)
+	if err := m.store.Set(editionKey(c.ID), stored); err != nil {
+		return e, err
+	}
+	return stored, nil
+}
+
+// editionCreated saves the ID of the edition created in the receipt. If the
+// transaction failed, the edition is created again on the next mint.
+func (m *minter) editionCreated(c *campaign, e *edition, receipt *types.Receipt) (*edition, error) {
+	mu := editionLock(c.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	stored := &edition{}
+	if _, err := m.store.Get(editionKey(c.ID), stored); err != nil {
+		return nil, err
+	}
+	if stored.ID != "" {
+		return stored, nil
+	}
+
+	id, err := m.createdEdition(common.HexToAddress(c.ContractAddress), receipt)
+	if err != nil {
+		// unless another worker already sent it again
+		if stored.TxHash == e.TxHash {
+			stored.TxHash, stored.RawTx, stored.Replaced = "", "", nil
+			if err := m.store.Set(editionKey(c.ID), stored); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("creating the edition of campaign %s: %v", c.ID, err)
+	}
+	stored.ID = id.String()
+	if err := m.store.Set(editionKey(c.ID), stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// createdEdition returns the ID of the edition created in the receipt.
+func (m *minter) createdEdition(contract common.Address, receipt *types.Receipt) (*big.Int, error) {
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, fmt.Errorf("transaction %s reverted", receipt.TxHash.Hex())
+	}
+	filterer, err := nftlink.NewNFTLinkEditionsFilterer(contract, m.client)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range receipt.Logs {
+		if l.Address != contract {
+			continue
+		}
+		if created, err := filterer.ParseEditionCreated(*l); err == nil {
+			return created.Id, nil
+		}
+	}
+	return nil, fmt.Errorf("no EditionCreated event in transaction %s", receipt.TxHash.Hex())
+}
+
+// codeHash is how contracts refer to a redeem code.
+func codeHash(code string) [32]byte {
+	return crypto.Keccak256Hash([]byte(code))
+}
+
+// mintedEdition returns the edition of the unit minted for the code in the
+// receipt, read from its EditionMinted event.
+func (m *minter) mintedEdition(contract common.Address, receipt *types.Receipt, code string) (*big.Int, error) {
+	filterer, err := nftlink.NewNFTLinkEditionsFilterer(contract, m.client)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range receipt.Logs {
+		if l.Address != contract {
+			continue
+		}
+		minted, err := filterer.ParseEditionMinted(*l)
+		if err != nil {
+			// some other event
+			continue
+		}
+		if minted.CodeHash == codeHash(code) {
+			return minted.Id, nil
+		}
+	}
+	return nil, fmt.Errorf("no EditionMinted event for code %s in transaction %s", code, receipt.TxHash.Hex())
+}
+
+// findEditionMint looks for the unit minted for the code from block start on
+// and returns the transaction that minted it.
+func (m *minter) findEditionMint(ctx context.Context, contract common.Address, code string, start uint64) (common.Hash, bool, error) {
+	filterer, err := nftlink.NewNFTLinkEditionsFilterer(contract, m.client)
+	if err != nil {
+		return common.Hash{}, false, err
+	}
+	it, err := filterer.FilterEditionMinted(&bind.FilterOpts{Start: start, Context: ctx}, nil, nil, [][32]byte{codeHash(code)})
+	if err != nil {
+		return common.Hash{}, false, err
+	}
+	defer it.Close()
+
+	if it.Next() {
+		return it.Event.Raw.TxHash, true, nil
+	}
+	return common.Hash{}, false, it.Error()
+}
+
+// editionCall returns the call minting one unit of the edition of the
+// campaign per job.
+func (m *minter) editionCall(ctx context.Context, c *campaign, jobs []*mintJob) (string, []interface{}, error) {
+	e, err := m.edition(ctx, c)
+	if err != nil {
+		return "", nil, err
+	}
+	id, ok := new(big.Int).SetString(e.ID, 10)
+	if !ok {
+		return "", nil, fmt.Errorf("campaign %s has an invalid edition %q", c.ID, e.ID)
+	}
+	if len(jobs) == 1 {
+		return "mint", []interface{}{common.HexToAddress(jobs[0].Wallet), id, codeHash(jobs[0].Code)}, nil
+	}
+	to := []common.Address{}
+	hashes := [][32]byte{}
+	for _, job := range jobs {
+		to = append(to, common.HexToAddress(job.Wallet))
+		hashes = append(hashes, codeHash(job.Code))
+	}
+	return "mintBatch", []interface{}{to, id, hashes}, nil
+}
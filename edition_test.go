@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestEditionMints(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	ipfs := &recordingIPFS{}
+	m.ipfs = ipfs
+	backend := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 250000}}}
+	m.client = backend
+	m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 0)
+
+	parsed, err := nftlink.NFTLinkEditionsMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	data, err := parsed.Events["EditionCreated"].Inputs.NonIndexed().Pack("QmMetadata", big.NewInt(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5), Logs: []*types.Log{{
+		Address: contract,
+		Topics:  []common.Hash{parsed.Events["EditionCreated"].ID, common.BigToHash(big.NewInt(3))},
+		Data:    data,
+	}}}
+
+	lot := &campaign{
+		ID:              "202203R",
+		Name:            "Ma'hai",
+		Lot:             "202203R",
+		Bottles:         600,
+		Standard:        standardERC1155,
+		ContractAddress: contract.Hex(),
+	}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := []string{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "0x71C7656EC7ab88b098defB751B7401B5f6d8976F"}
+	jobs := []*mintJob{}
+	for i, code := range []string{"U6fxRAqxMo", "wKcZ2ceDLs", "HnF3s8pQzX"} {
+		store.Set(code, &ClaimPrize{UUID: code, Campaign: lot.ID})
+		job := newMintJob(code, wallets[i%2])
+		job.Campaign = lot.ID
+		if _, err := m.claims.Reserve(code, job.Wallet, job.ID); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	// the edition is created by the first mint only
+	if err := m.mintJobs(context.Background(), contract, jobs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.mintJobs(context.Background(), contract, jobs[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipfs.uploads) != 1 || !strings.Contains(ipfs.uploads[0], "600") {
+		t.Errorf("uploaded %q, want the metadata of the edition once", ipfs.uploads)
+	}
+
+	want := []string{"createEdition", "mintBatch", "mint"}
+	if len(backend.sent) != len(want) {
+		t.Fatalf("sent %d transactions, want %d", len(backend.sent), len(want))
+	}
+	for i, tx := range backend.sent {
+		method, err := parsed.MethodById(tx.Data()[:4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method.Name != want[i] || *tx.To() != contract {
+			t.Fatalf("sent %s to %s, want %s to %s", method.Name, tx.To().Hex(), want[i], contract.Hex())
+		}
+		args, err := method.Inputs.Unpack(tx.Data()[4:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch method.Name {
+		case "createEdition":
+			if args[0].(string) != "QmMetadata" || args[1].(*big.Int).Int64() != 600 {
+				t.Errorf("created edition %v, want QmMetadata of 600 bottles", args)
+			}
+		case "mintBatch":
+			to, id, hashes := args[0].([]common.Address), args[1].(*big.Int), args[2].([][32]byte)
+			for j, job := range jobs[:2] {
+				if to[j] != common.HexToAddress(job.Wallet) || id.Int64() != 3 || hashes[j] != codeHash(job.Code) {
+					t.Errorf("unit %d of edition %v for %x minted to %s, want edition 3 for %s to %s", j, id, hashes[j], to[j].Hex(), job.Code, job.Wallet)
+				}
+			}
+		case "mint":
+			if args[0].(common.Address) != common.HexToAddress(jobs[2].Wallet) || args[1].(*big.Int).Int64() != 3 || args[2].([32]byte) != codeHash(jobs[2].Code) {
+				t.Errorf("minted %v, want a unit of edition 3 for %s", args, jobs[2].Code)
+			}
+		}
+	}
+
+	e := &edition{}
+	if found, err := store.Get(editionKey(lot.ID), e); err != nil || !found {
+		t.Fatalf("edition not saved: %v", err)
+	}
+	if e.ID != "3" || e.URI != "QmMetadata" || e.TxHash != backend.sent[0].Hash().Hex() {
+		t.Errorf("saved edition %+v", e)
+	}
+}
+
+// stuckBackend never mines the transactions in stuck.
+type stuckBackend struct {
+	*forwarderBackend
+	stuck map[common.Hash]bool
+}
+
+func (s *stuckBackend) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	if s.stuck[hash] {
+		return nil, ethereum.NotFound
+	}
+	return s.forwarderBackend.TransactionReceipt(ctx, hash)
+}
+
+func TestEditionStuck(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.ipfs = &recordingIPFS{}
+	forwarder := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 250000}}}
+	backend := &stuckBackend{forwarderBackend: forwarder, stuck: map[common.Hash]bool{}}
+	m.client = backend
+	m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 50*time.Millisecond)
+
+	parsed, err := nftlink.NFTLinkEditionsMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	data, err := parsed.Events["EditionCreated"].Inputs.NonIndexed().Pack("QmMetadata", big.NewInt(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarder.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5), Logs: []*types.Log{{
+		Address: contract,
+		Topics:  []common.Hash{parsed.Events["EditionCreated"].ID, common.BigToHash(big.NewInt(3))},
+		Data:    data,
+	}}}
+	lot := &campaign{ID: "202203R", Bottles: 600, Standard: standardERC1155, ContractAddress: contract.Hex()}
+
+	// the first createEdition is never mined, every worker waits for it
+	e, err := m.createEdition(context.Background(), lot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.stuck[common.HexToHash(e.TxHash)] = true
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = m.edition(context.Background(), lot)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("worker %d: %v", i, err)
+		}
+	}
+
+	// replaced once, with the same nonce
+	if len(forwarder.sent) != 2 || forwarder.sent[1].Nonce() != forwarder.sent[0].Nonce() {
+		t.Fatalf("sent %d transactions, want createEdition and a single replacement", len(forwarder.sent))
+	}
+	saved := &edition{}
+	if _, err := store.Get(editionKey(lot.ID), saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID != "3" || saved.TxHash != forwarder.sent[1].Hash().Hex() || len(saved.Replaced) != 1 || saved.Replaced[0] != e.TxHash {
+		t.Errorf("saved edition %+v", saved)
+	}
+}
+
+func TestMintedEdition(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+
+	parsed, err := nftlink.NFTLinkEditionsMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	minted := func(address common.Address, id int64, code string) types.Log {
+		hash := codeHash(code)
+		return types.Log{
+			Address: address,
+			Topics: []common.Hash{
+				parsed.Events["EditionMinted"].ID,
+				common.BigToHash(big.NewInt(id)),
+				common.BytesToHash(common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B").Bytes()),
+				common.BytesToHash(hash[:]),
+			},
+			TxHash:      common.BytesToHash([]byte(code)),
+			BlockNumber: 1,
+		}
+	}
+	logs := []types.Log{
+		minted(common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F"), 2, "U6fxRAqxMo"),
+		minted(contract, 3, "wKcZ2ceDLs"),
+		minted(contract, 4, "U6fxRAqxMo"),
+	}
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful}
+	for i := range logs {
+		receipt.Logs = append(receipt.Logs, &logs[i])
+	}
+
+	id, err := m.mintedEdition(contract, receipt, "U6fxRAqxMo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Int64() != 4 {
+		t.Errorf("code minted a unit of edition %v, want 4", id)
+	}
+	if _, err := m.mintedEdition(contract, receipt, "HnF3s8pQzX"); err == nil {
+		t.Errorf("found a unit for a code not in the receipt")
+	}
+
+	// a code already minted is found on the contract again
+	m.client = &burnBackend{ethBackend: m.client, logs: logs}
+	tx, found, err := m.findEditionMint(context.Background(), contract, "wKcZ2ceDLs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || tx != logs[1].TxHash {
+		t.Errorf("findEditionMint() = %s, %v, want %s", tx.Hex(), found, logs[1].TxHash.Hex())
+	}
+	if _, found, err := m.findEditionMint(context.Background(), contract, "HnF3s8pQzX", 0); err != nil || found {
+		t.Errorf("found a mint for a code never minted: %v", err)
+	}
+}
+
+func TestEditionsOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.ipfs = &recordingIPFS{}
+	contract := deployBinding(t, m, nftlink.NFTLinkEditionsMetaData)
+
+	lot := &campaign{
+		ID:              "202203R",
+		Name:            "Ma'hai",
+		Lot:             "202203R",
+		Bottles:         600,
+		Standard:        standardERC1155,
+		ContractAddress: contract.Hex(),
+	}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := []string{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "0x71C7656EC7ab88b098defB751B7401B5f6d8976F"}
+	jobs := []*mintJob{}
+	for i, code := range []string{"U6fxRAqxMo", "wKcZ2ceDLs", "HnF3s8pQzX"} {
+		store.Set(code, &ClaimPrize{UUID: code, Campaign: lot.ID})
+		job := newMintJob(code, wallets[i%2])
+		job.Campaign = lot.ID
+		if _, err := m.claims.Reserve(code, job.Wallet, job.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.queue.Enqueue(job); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	// the first two with mintBatch, the last one with mint
+	m.processBatch(context.Background(), contract, jobs[:2])
+	m.processBatch(context.Background(), contract, jobs[2:])
+
+	e := &edition{}
+	if found, err := store.Get(editionKey(lot.ID), e); err != nil || !found {
+		t.Fatalf("edition not saved: %v", err)
+	}
+	id, _ := new(big.Int).SetString(e.ID, 10)
+	caller, err := nftlink.NewNFTLinkEditionsCaller(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		saved, _, err := m.queue.Get(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.State != jobConfirmed {
+			t.Errorf("job for %s is %s: %s", job.Code, saved.State, saved.Error)
+		}
+	}
+	for i, want := range []int64{2, 1} {
+		balance, err := caller.BalanceOf(nil, common.HexToAddress(wallets[i]), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Int64() != want {
+			t.Errorf("%s holds %v units of edition %v, want %d", wallets[i], balance, id, want)
+		}
+	}
+	minted, err := caller.Minted(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minted.Int64() != 3 {
+		t.Errorf("edition %v minted %v units, want 3", id, minted)
+	}
+
+	// a code mints once, even sent again
+	if _, err := m.transact(context.Background(), nftlink.NFTLinkEditionsMetaData, contract, nil, "mint", common.HexToAddress(wallets[0]), id, codeHash(jobs[0].Code)); err == nil {
+		t.Errorf("minted a unit for a code already minted")
+	}
+}
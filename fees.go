@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type feeMode string
+
+const (
+	feeDynamic feeMode = "dynamic" // EIP-1559 type-2 transactions
+	feeLegacy  feeMode = "legacy"  // fixed gas price, for chains without London
+)
+
+var errNoBaseFee = errors.New("chain has no base fee, use the legacy fee mode")
+
+// feePolicy decides what a mint transaction pays for gas.
+type feePolicy struct {
+	mode        feeMode
+	gasPrice    *big.Int // legacy mode, nil asks the node
+	maxFee      *big.Int // ceiling for the fee cap in dynamic mode, nil for none
+	maxTip      *big.Int // ceiling for the tip in dynamic mode, nil for none
+	bumpPercent int64    // fee increase for replacing a stuck transaction
+}
+
+// minBumpPercent is the smallest fee increase geth accepts for a replacement.
+const minBumpPercent = 10
+
+// gwei converts a config value in gwei to wei, zero meaning unset.
+func gwei(v int64) *big.Int {
+	if v == 0 {
+		return nil
+	}
+	return new(big.Int).Mul(big.NewInt(v), big.NewInt(1000000000))
+}
+
+// apply sets the fee fields of opts for a transaction sent now.
+func (f *feePolicy) apply(ctx context.Context, client ethBackend, opts *bind.TransactOpts) error {
+	if f.mode == feeLegacy {
+		gasPrice := f.gasPrice
+		if gasPrice == nil {
+			var err error
+			gasPrice, err = client.SuggestGasPrice(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		opts.GasPrice = gasPrice
+		return nil
+	}
+
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if head.BaseFee == nil {
+		return errNoBaseFee
+	}
+	if f.maxFee != nil && head.BaseFee.Cmp(f.maxFee) > 0 {
+		return fmt.Errorf("base fee %v is above the max fee per gas %v", head.BaseFee, f.maxFee)
+	}
+
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return err
+	}
+	if f.maxTip != nil && tip.Cmp(f.maxTip) > 0 {
+		tip = new(big.Int).Set(f.maxTip)
+	}
+
+	// leave room for the base fee to double before the transaction is mined
+	feeCap := new(big.Int).Add(tip, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+	if f.maxFee != nil && feeCap.Cmp(f.maxFee) > 0 {
+		feeCap = new(big.Int).Set(f.maxFee)
+	}
+	if tip.Cmp(feeCap) > 0 {
+		tip = new(big.Int).Set(feeCap)
+	}
+
+	opts.GasTipCap = tip
+	opts.GasFeeCap = feeCap
+	return nil
+}
+
+// bump sets the fee fields of opts for a transaction replacing stuck: the
+// fees the policy would pay now, but never less than stuck's own raised by
+// bumpPercent, so nodes accept the replacement.
+func (f *feePolicy) bump(ctx context.Context, client ethBackend, stuck *types.Transaction, opts *bind.TransactOpts) error {
+	if err := f.apply(ctx, client, opts); err != nil {
+		return err
+	}
+
+	percent := f.bumpPercent
+	if percent < minBumpPercent {
+		percent = minBumpPercent
+	}
+	raise := func(current *big.Int, old *big.Int) *big.Int {
+		// round up, nodes compare against the exact percentage
+		bumped := new(big.Int).Mul(old, big.NewInt(100+percent))
+		bumped.Add(bumped, big.NewInt(99))
+		bumped.Div(bumped, big.NewInt(100))
+		if current.Cmp(bumped) > 0 {
+			return current
+		}
+		return bumped
+	}
+
+	if opts.GasPrice != nil {
+		opts.GasPrice = raise(opts.GasPrice, stuck.GasPrice())
+		return nil
+	}
+
+	opts.GasTipCap = raise(opts.GasTipCap, stuck.GasTipCap())
+	opts.GasFeeCap = raise(opts.GasFeeCap, stuck.GasFeeCap())
+	if opts.GasTipCap.Cmp(opts.GasFeeCap) > 0 {
+		opts.GasFeeCap = opts.GasTipCap
+	}
+	if f.maxFee != nil && opts.GasFeeCap.Cmp(f.maxFee) > 0 {
+		return fmt.Errorf("replacement fee cap %v is above the max fee per gas %v", opts.GasFeeCap, f.maxFee)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// tipSuggester is a backend whose node suggests a fixed priority fee.
+type tipSuggester struct {
+	ethBackend
+	tip *big.Int
+}
+
+func (s *tipSuggester) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return s.tip, nil
+}
+
+func TestMintFees(t *testing.T) {
+	var cases = []struct {
+		name   string
+		fees   *feePolicy
+		txType uint8
+	}{
+		{"Dynamic", &feePolicy{mode: feeDynamic}, types.DynamicFeeTxType},
+		{"Legacy", &feePolicy{mode: feeLegacy, gasPrice: gwei(2)}, types.LegacyTxType},
+		{"Legacy suggested price", &feePolicy{mode: feeLegacy}, types.LegacyTxType},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			m.fees = tc.fees
+
+			tx, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"), "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tx.Type() != tc.txType {
+				t.Errorf("sent a type %d transaction, want type %d", tx.Type(), tc.txType)
+			}
+			if tc.fees.gasPrice != nil && tx.GasPrice().Cmp(tc.fees.gasPrice) != 0 {
+				t.Errorf("sent with gas price %v, want %v", tx.GasPrice(), tc.fees.gasPrice)
+			}
+
+			receipt, err := bind.WaitMined(context.Background(), m.client, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				t.Errorf("mint reverted")
+			}
+		})
+	}
+}
+
+func TestFeeCeilings(t *testing.T) {
+	client := NewSimulatedBackend()
+	head, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseFee := head.BaseFee
+
+	// the node wants a 5 gwei tip, we never pay more than 2
+	backend := &tipSuggester{ethBackend: client, tip: gwei(5)}
+	opts := &bind.TransactOpts{}
+	f := &feePolicy{mode: feeDynamic, maxTip: gwei(2)}
+	if err := f.apply(context.Background(), backend, opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.GasTipCap.Cmp(gwei(2)) != 0 {
+		t.Errorf("tip is %v, want it capped at %v", opts.GasTipCap, gwei(2))
+	}
+	wantCap := new(big.Int).Add(gwei(2), new(big.Int).Mul(baseFee, big.NewInt(2)))
+	if opts.GasFeeCap.Cmp(wantCap) != 0 {
+		t.Errorf("fee cap is %v, want %v", opts.GasFeeCap, wantCap)
+	}
+
+	// the fee cap is clipped to the ceiling, and the tip with it
+	maxFee := new(big.Int).Add(baseFee, big.NewInt(10))
+	opts = &bind.TransactOpts{}
+	f = &feePolicy{mode: feeDynamic, maxFee: maxFee}
+	if err := f.apply(context.Background(), backend, opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.GasFeeCap.Cmp(maxFee) != 0 || opts.GasTipCap.Cmp(maxFee) != 0 {
+		t.Errorf("got fee cap %v and tip %v, want both %v", opts.GasFeeCap, opts.GasTipCap, maxFee)
+	}
+
+	// with the base fee above the ceiling the transaction would never be mined
+	f = &feePolicy{mode: feeDynamic, maxFee: new(big.Int).Sub(baseFee, big.NewInt(1))}
+	if err := f.apply(context.Background(), backend, &bind.TransactOpts{}); err == nil {
+		t.Errorf("base fee above the ceiling was accepted")
+	}
+}
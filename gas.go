@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum"
+)
+
+var errMintWouldRevert = errors.New("mint would revert")
+
+// gasEstimator sizes the gas limit of every mint from the node's estimate of
+// the exact call, instead of one limit for all of them.
+type gasEstimator struct {
+	multiplier float64 // safety margin over the estimate
+	cap        uint64  // never send more than this, 0 for no cap
+}
+
+// limit returns the gas limit for the call. A failing estimate almost always
+// means the call reverts, which is reported as errMintWouldRevert.
+func (g *gasEstimator) limit(ctx context.Context, client ethBackend, call ethereum.CallMsg) (uint64, error) {
+	estimate, err := client.EstimateGas(ctx, call)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errMintWouldRevert, err)
+	}
+
+	multiplier := g.multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	limit := uint64(float64(estimate) * multiplier)
+
+	if g.cap != 0 && limit > g.cap {
+		if estimate > g.cap {
+			return 0, fmt.Errorf("mint needs %d gas, above the gas limit cap of %d", estimate, g.cap)
+		}
+		limit = g.cap
+	}
+	return limit, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestMintGasEstimate(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+
+	short, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), wallet, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), wallet, "QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5/a/much/longer/token/uri/that/costs/more/to/store", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if long.Gas() <= short.Gas() {
+		t.Errorf("gas limit %d for a long URI is not above %d for an empty one", long.Gas(), short.Gas())
+	}
+	if short.Gas() >= 3000000 {
+		t.Errorf("gas limit %d is not estimated", short.Gas())
+	}
+
+	// a cap below what the call needs refuses to send it
+	m.gas = &gasEstimator{multiplier: 1.2, cap: 21000}
+	if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), wallet, "", nil); err == nil {
+		t.Errorf("mint sent with a gas limit cap below the estimate")
+	}
+}
+
+func TestMintWouldRevert(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	// safeMint is onlyOwner, the estimate fails for any other key
+	client := m.client.(*SimulatedBackend)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	client.FundAddress(context.Background(), from)
+	m.signer = newKeySigner(key)
+	m.nonces = newNonceManager(client, from)
+
+	_, err = m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"), "", nil)
+	if !errors.Is(err, errMintWouldRevert) {
+		t.Errorf("got error %v, want %v", err, errMintWouldRevert)
+	}
+
+	nonce, err := client.PendingNonceAt(context.Background(), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 0 {
+		t.Errorf("a transaction was sent for a mint that would revert")
+	}
+}
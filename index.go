@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/philippgille/gokv"
+)
+
+// storeIndex is a list of IDs saved under a single key of the store. gokv
+// can't list keys, so records that have to be found again after a restart
+// are tracked in one of these.
+type storeIndex struct {
+	store gokv.Store
+	key   string
+}
+
+func newStoreIndex(store gokv.Store, key string) *storeIndex {
+	return &storeIndex{store: store, key: key}
+}
+
+func (i *storeIndex) List() ([]string, error) {
+	ids := []string{}
+	if _, err := i.store.Get(i.key, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (i *storeIndex) Add(id string) error {
+	return i.update(id, true)
+}
+
+func (i *storeIndex) Remove(id string) error {
+	return i.update(id, false)
+}
+
+// update adds or removes the ID atomically, so instances sharing the store
+// don't drop each other's changes.
+func (i *storeIndex) update(id string, add bool) error {
+	ids := []string{}
+	return storeUpdate(i.store, i.key, &ids, func(found bool) error {
+		kept := []string{}
+		for _, v := range ids {
+			if v != id {
+				kept = append(kept, v)
+			}
+		}
+		if add {
+			kept = append(kept, id)
+		}
+		ids = kept
+		return nil
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"github.com/philippgille/gokv"
+)
+
+type jobState string
+
+const (
+	jobPending   jobState = "pending"
+	jobUploading jobState = "uploading"
+	jobSubmitted jobState = "submitted"
+	jobConfirmed jobState = "confirmed"
+	jobFailed    jobState = "failed"
+	jobVoucher   jobState = "voucher" // signed a voucher instead of minting
+)
+
+// done reports whether a job in this state will never be picked up again.
+func (s jobState) done() bool {
+	return s == jobConfirmed || s == jobFailed || s == jobVoucher
+}
+
+// openJobsKey holds the IDs of every job that is not done yet, so they can be
+// requeued when the server restarts.
+const openJobsKey = "jobs/open"
+
+type mintJob struct {
+	ID         string         `json:"id"`
+	Code       string         `json:"code"`
+	Wallet     string         `json:"wallet"`
+	Campaign   string         `json:"campaign,omitempty"`
+	State      jobState       `json:"state"`
+	TokenURI   string         `json:"token_uri,omitempty"`   // metadata CID, once uploaded
+	TxHash     string         `json:"tx_hash,omitempty"`     // the latest transaction sent for the job
+	RawTx      string         `json:"raw_tx,omitempty"`      // signed TxHash, kept to build replacements
+	Replaced   []string       `json:"replaced,omitempty"`    // earlier transactions replaced with higher fees
+	Batch      string         `json:"batch,omitempty"`       // the batch minting the job with others, if any
+	BatchIndex int            `json:"batch_index,omitempty"` // position of the job, and its token, in the batch
+	TokenID    string         `json:"token_id,omitempty"`
+	StartBlock uint64         `json:"start_block,omitempty"` // head before anything was sent, recovery looks for a mint from here
+	Voucher    *signedVoucher `json:"voucher,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+// txHashes returns every transaction sent for the job, any of which may be
+// the one that gets mined.
+func (j *mintJob) txHashes() []common.Hash {
+	hashes := []common.Hash{}
+	for _, h := range append(j.Replaced, j.TxHash) {
+		hashes = append(hashes, common.HexToHash(h))
+	}
+	return hashes
+}
+
+func jobKey(id string) string {
+	return "job/" + id
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func newMintJob(code string, wallet string) *mintJob {
+	now := time.Now().UTC()
+	return &mintJob{
+		ID:        newJobID(),
+		Code:      code,
+		Wallet:    wallet,
+		State:     jobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// jobQueue persists mint jobs in the store and hands them to a pool of
+// workers. Jobs survive a restart: everything in the open jobs index is
+// queued again by Start.
+type jobQueue struct {
+	store   gokv.Store
+	open    *storeIndex
+	jobs    chan string
+	running sync.Map // IDs of the jobs a worker is processing right now
+}
+
+func newJobQueue(store gokv.Store, size int) *jobQueue {
+	return &jobQueue{
+		store: store,
+		open:  newStoreIndex(store, openJobsKey),
+		jobs:  make(chan string, size),
+	}
+}
+
+// Enqueue saves the job and schedules it for processing.
+func (q *jobQueue) Enqueue(job *mintJob) error {
+	if err := q.store.Set(jobKey(job.ID), job); err != nil {
+		return err
+	}
+	if err := q.open.Add(job.ID); err != nil {
+		return err
+	}
+	q.schedule(job.ID)
+	return nil
+}
+
+// Requeue schedules a job that is already saved, e.g. one recovered after a
+// crash.
+func (q *jobQueue) Requeue(id string) error {
+	if err := q.open.Add(id); err != nil {
+		return err
+	}
+	q.schedule(id)
+	return nil
+}
+
+// schedule hands the job to the workers without waiting for one to be free.
+// When they are all behind the job stays open in the store, and the recovery
+// sweeper queues it again later.
+func (q *jobQueue) schedule(id string) {
+	select {
+	case q.jobs <- id:
+	default:
+		log.Printf("job queue full, job %s waits for the next sweep", id)
+	}
+}
+
+// Busy reports whether a worker of this process is running the job.
+func (q *jobQueue) Busy(id string) bool {
+	_, busy := q.running.Load(id)
+	return busy
+}
+
+func (q *jobQueue) Get(id string) (*mintJob, bool, error) {
+	job := &mintJob{}
+	found, err := q.store.Get(jobKey(id), job)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return job, true, nil
+}
+
+// Update saves the job, dropping it from the open jobs index once it is done.
+func (q *jobQueue) Update(job *mintJob) error {
+	job.UpdatedAt = time.Now().UTC()
+	if err := q.store.Set(jobKey(job.ID), job); err != nil {
+		return err
+	}
+	if job.State.done() {
+		return q.open.Remove(job.ID)
+	}
+	return nil
+}
+
+// Open returns the IDs of all jobs that are not done yet.
+func (q *jobQueue) Open() ([]string, error) {
+	return q.open.List()
+}
+
+// Start requeues the jobs left open by a previous run and launches the given
+// number of workers. Workers stop when ctx is cancelled.
+func (q *jobQueue) Start(ctx context.Context, workers int, process func(context.Context, *mintJob) error) error {
+	ids, err := q.Open()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < workers; i++ {
+		go q.work(ctx, process)
+	}
+
+	go func() {
+		for _, id := range ids {
+			select {
+			case q.jobs <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *jobQueue) work(ctx context.Context, process func(context.Context, *mintJob) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-q.jobs:
+			// the same ID can be queued twice, e.g. by Enqueue and by Start
+			// requeueing the open jobs, but only one worker may run it
+			if _, busy := q.running.LoadOrStore(id, true); busy {
+				continue
+			}
+			q.run(ctx, id, process)
+			q.running.Delete(id)
+		}
+	}
+}
+
+func (q *jobQueue) run(ctx context.Context, id string, process func(context.Context, *mintJob) error) {
+	job, found, err := q.Get(id)
+	if err != nil {
+		log.Printf("loading job %s: %v", id, err)
+		return
+	}
+	if !found || job.State.done() {
+		return
+	}
+	if err := process(ctx, job); err != nil {
+		log.Printf("job %s for code %s failed: %v", job.ID, job.Code, err)
+	}
+}
+
+// jobStatus reports the state of a mint job so clients can poll it.
+type jobStatus struct {
+	queue *jobQueue
+}
+
+func (s *jobStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	job, found, err := s.queue.Get(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Job %s not found", id)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", b)
+}
@@ -0,0 +1,8 @@
+package nftlink
+
+// The bindings are generated from contracts/ with solc 0.8.4 and abigen
+// v1.10.15, once npm install brought in the OpenZeppelin and Hardhat sources
+// the contracts import. Regenerate them in the change that edits a contract.
+//go:generate sh -c "cd ../../.. && solc --optimize --combined-json abi,bin,hashes @openzeppelin/=node_modules/@openzeppelin/ hardhat/=node_modules/hardhat/ contracts/*.sol > lib/contracts/nftlink/combined.json"
+//go:generate abigen --combined-json combined.json --pkg nftlink --out nftlink.go
+//go:generate rm combined.json
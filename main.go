@@ -1,36 +1,59 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"fmt"
 	"io/fs"
 	"log"
-	"math/big"
 	"math/rand"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/gorilla/mux"
 
 	"github.com/spf13/viper"
 
 	_ "net/http/pprof"
-
-	"github.com/philippgille/gokv/datastore"
-	"github.com/philippgille/gokv/encoding"
 )
 
 type ClaimPrize struct {
-	UUID    string `json:"uuid"`
-	Claimed bool   `json:"claimed"`
-	Wallet  string `json:"wallet"` // saving the wallet just in case the request to the blockchain fails, this dies process dies and we need to retry
+	UUID     string `json:"uuid"`
+	Claimed  bool   `json:"claimed"`
+	Wallet   string `json:"wallet"` // saving the wallet just in case the request to the blockchain fails, this dies process dies and we need to retry
+	JobID    string `json:"job_id,omitempty"`
+	Campaign string `json:"campaign,omitempty"` // the lot the code belongs to, empty for the default contract
+	// where the token is minted, recorded with the transaction
+	Chain           string      `json:"chain,omitempty"` // chain profile, empty for the default one
+	ChainID         uint64      `json:"chain_id,omitempty"`
+	ContractAddress string      `json:"contract_address,omitempty"`
+	Status          claimStatus `json:"status,omitempty"`
+	Number          *uint64     `json:"number,omitempty"` // the number in the token metadata, kept across retries
+
+	ReservedAt time.Time `json:"reserved_at,omitempty"`
+
+	// filled in as the mint transaction makes its way to the chain
+	TxHash        string `json:"tx_hash,omitempty"`
+	BlockNumber   uint64 `json:"block_number,omitempty"`
+	GasUsed       uint64 `json:"gas_used,omitempty"`
+	ReceiptStatus string `json:"receipt_status,omitempty"`
+	// every transaction sent to replace a stuck one, oldest first
+	ReplacementTxs []string `json:"replacement_txs,omitempty"`
+	TokenID        string   `json:"token_id,omitempty"` // from the Transfer event in the receipt
+
+	// the latest voucher handed out for the code, in voucher campaigns
+	VoucherNonce  string    `json:"voucher_nonce,omitempty"`
+	VoucherExpiry time.Time `json:"voucher_expiry,omitempty"`
+	// the token uri committed to in the claim root, in merkle campaigns
+	ClaimURI string `json:"claim_uri,omitempty"`
 }
 
 // content holds our static web server content.
+//
 //go:embed web/build
 var content embed.FS
 
@@ -46,6 +69,14 @@ func RandomString(n int) string {
 }
 
 var initFlag = flag.Bool("init", false, "initialize the database")
+var campaignFlag = flag.String("campaign", "", "with -init, a campaign file to save, creating one code per bottle of it")
+var royaltyFlag = flag.String("royalty", "", "set the royalty of the given campaign to -royalty-receiver and -royalty-bps, or remove it without a receiver, and exit")
+var royaltyReceiverFlag = flag.String("royalty-receiver", "", "with -royalty, the address royalties are paid to")
+var royaltyBpsFlag = flag.Uint("royalty-bps", 0, "with -royalty, the royalty in basis points of the sale price")
+var grantMinterFlag = flag.String("grant-minter", "", "grant MINTER_ROLE to the given address on every contract of -chain and exit")
+var revokeMinterFlag = flag.String("revoke-minter", "", "revoke MINTER_ROLE from the given address on every contract of -chain and exit")
+var chainFlag = flag.String("chain", "", "with -grant-minter or -revoke-minter, the chain profile, the default one if empty")
+var claimRootFlag = flag.String("claim-root", "", "publish the Merkle root of the codes of the given merkle campaign and exit")
 
 func main() {
 	viper.SetConfigName("config")         // name of config file (without extension)
@@ -59,39 +90,106 @@ func main() {
 	}
 	viper.SetEnvPrefix("nftlink") // will be uppercased automatically
 	viper.BindEnv("contract_address")
+	viper.BindEnv("legacy_contract")
+	viper.BindEnv("forwarder_address")
 	viper.BindEnv("private_key")
+	viper.BindEnv("keystore")
+	viper.BindEnv("keystore_passphrase")
+	viper.BindEnv("keystore_passphrase_file")
+	viper.BindEnv("external_signer")
+	viper.BindEnv("signer_address")
+	viper.BindEnv("pkcs11_module")
+	viper.BindEnv("pkcs11_slot")
+	viper.BindEnv("pkcs11_label")
+	viper.BindEnv("pkcs11_pin")
+	viper.BindEnv("pkcs11_pin_file")
+	viper.BindEnv("minter_keys")
+	viper.BindEnv("minter_keystores")
 	viper.BindEnv("gas_limit")
+	viper.BindEnv("gas_multiplier")
 	viper.BindEnv("gas_price")
+	viper.BindEnv("fee_mode")
+	viper.BindEnv("max_fee_per_gas")
+	viper.BindEnv("max_priority_fee_per_gas")
 	viper.BindEnv("infura_project_id")
 	viper.BindEnv("infura_project_secret")
 	viper.BindEnv("ethereum_client")
+	viper.BindEnv("chain_id")
+	viper.BindEnv("mint_workers")
+	viper.BindEnv("confirmations")
+	viper.BindEnv("receipt_poll_interval")
+	viper.BindEnv("release_on_revert")
+	viper.BindEnv("stuck_timeout")
+	viper.BindEnv("fee_bump_percent")
+	viper.BindEnv("recovery_interval")
+	viper.BindEnv("metadata_template")
+	viper.BindEnv("min_balance")
+	viper.BindEnv("daily_spend_cap")
+	viper.BindEnv("balance_poll_interval")
+	viper.BindEnv("alert_webhook")
+	viper.BindEnv("batch_size")
+	viper.BindEnv("batch_wait")
+	viper.BindEnv("voucher_ttl")
+	viper.BindEnv("admin_token")
+	viper.BindEnv("supply_poll_interval")
+	viper.BindEnv("burn_poll_interval")
+	viper.SetDefault("gas_multiplier", 1.2)
+	viper.SetDefault("fee_mode", string(feeDynamic))
+	viper.SetDefault("mint_workers", 4)
+	viper.SetDefault("confirmations", 3)
+	viper.SetDefault("receipt_poll_interval", "5s")
+	viper.SetDefault("release_on_revert", true)
+	viper.SetDefault("stuck_timeout", "3m")
+	viper.SetDefault("fee_bump_percent", 15)
+	viper.SetDefault("recovery_interval", "5m")
+	viper.SetDefault("balance_poll_interval", "1m")
+	viper.SetDefault("batch_size", 1)
+	viper.SetDefault("batch_wait", "10s")
+	viper.SetDefault("voucher_ttl", "72h")
+	viper.SetDefault("supply_poll_interval", "1m")
+	viper.SetDefault("burn_poll_interval", "1m")
 
 	flag.Parse()
 
 	// Initialize the database or store.
 	// this database wwill have the list of (reedemed) codes
-	//options := file.DefaultOptions // change as necesary
-	options := datastore.Options{
-		ProjectID:       "qrcodenft",
-		CredentialsFile: "",
-		Codec:           encoding.JSON,
-	}
-	store, err := datastore.NewClient(options)
+	store, err := newDatastoreStore("qrcodenft")
 	if err != nil {
 		panic(err)
 	}
 	defer store.Close()
 
+	campaigns := newCampaigns(store)
+
 	// Populate the database with some random data if init flag is set
 	if initFlag != nil && *initFlag {
+		codes, campaignID := 1000, ""
+		if *campaignFlag != "" {
+			c, err := loadCampaign(*campaignFlag)
+			if err != nil {
+				panic(err)
+			}
+			if err := campaigns.Save(c); err != nil {
+				panic(err)
+			}
+			codes, campaignID = int(c.Bottles), c.ID
+		}
+
 		// Initialize the store
-		for i := 0; i < 1000; i++ {
+		keys := []string{}
+		for i := 0; i < codes; i++ {
 			key := RandomString(10)
-			val := ClaimPrize{UUID: key, Claimed: false}
+			val := ClaimPrize{UUID: key, Claimed: false, Campaign: campaignID}
 			err := store.Set(key, val)
 			if err != nil {
 				panic(err)
 			}
+			keys = append(keys, key)
+		}
+		if campaignID != "" {
+			if err := campaigns.SaveCodes(campaignID, keys); err != nil {
+				panic(err)
+			}
 		}
 	}
 	// Setup the IPFS client
@@ -100,23 +198,233 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// The metadata of every token, checked now rather than on the first claim.
+	metadata, err := loadMetadataTemplate(viper.GetString("metadata_template"))
+	if err != nil {
+		panic(err)
+	}
 	r := mux.NewRouter()
 
-	client, err := ethclient.Dial(viper.GetString("ethereum_client"))
+	// The top level settings are the default chain, campaigns may mint on
+	// the other ones listed under "chains".
+	defaults := chainProfile{
+		RPCURL:                 viper.GetString("ethereum_client"),
+		ChainID:                viper.GetInt64("chain_id"),
+		ContractAddress:        viper.GetString("contract_address"),
+		LegacyContract:         viper.GetBool("legacy_contract"),
+		ForwarderAddress:       viper.GetString("forwarder_address"),
+		PrivateKey:             viper.GetString("private_key"),
+		Keystore:               viper.GetString("keystore"),
+		KeystorePassphrase:     viper.GetString("keystore_passphrase"),
+		KeystorePassphraseFile: viper.GetString("keystore_passphrase_file"),
+		ExternalSigner:         viper.GetString("external_signer"),
+		SignerAddress:          viper.GetString("signer_address"),
+		PKCS11Module:           viper.GetString("pkcs11_module"),
+		PKCS11Slot:             viper.GetUint("pkcs11_slot"),
+		PKCS11Label:            viper.GetString("pkcs11_label"),
+		PKCS11Pin:              viper.GetString("pkcs11_pin"),
+		PKCS11PinFile:          viper.GetString("pkcs11_pin_file"),
+		MinterKeys:             viper.GetStringSlice("minter_keys"),
+		MinterKeystores:        viper.GetStringSlice("minter_keystores"),
+		FeeMode:                viper.GetString("fee_mode"),
+		GasPrice:               viper.GetInt64("gas_price"),
+		MaxFeePerGas:           viper.GetInt64("max_fee_per_gas"),
+		MaxPriorityFeePerGas:   viper.GetInt64("max_priority_fee_per_gas"),
+		Confirmations:          uint64(viper.GetInt("confirmations")),
+		MinBalance:             viper.GetInt64("min_balance"),
+		DailySpendCap:          viper.GetInt64("daily_spend_cap"),
+	}
+	client, chainID, err := defaults.dial(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	queue := newJobQueue(store, 1024)
+
+	signer, err := defaults.signer()
+	if err != nil {
+		panic(err)
+	}
+	minters, err := defaults.minterSigners()
+	if err != nil {
+		panic(err)
+	}
+
+	fees, err := defaults.feePolicy(viper.GetInt64("fee_bump_percent"))
 	if err != nil {
 		panic(err)
 	}
 
 	m := &minter{
+		chainID:         chainID.Uint64(),
+		chains:          map[string]*minter{},
 		store:           store,
+		claims:          newClaims(store),
+		serials:         newSerials(store, defaults.ContractAddress),
+		queue:           queue,
 		ipfs:            ipfs,
+		metadata:        metadata,
+		campaigns:       campaigns,
 		client:          client,
-		privateKey:      viper.GetString("private_key"),
-		contractAddress: viper.GetString("contract_address"),
-		gasLimit:        uint64(viper.GetInt32("gas_limit")),
-		gasPrice:        big.NewInt(viper.GetInt64("gas_price") * 1000000000),
+		signer:          signer,
+		nonces:          newNonceManager(client, signer.Address()),
+		pool:            newMinterPool(client, minters),
+		tracker:         newTxTracker(client, defaults.Confirmations, viper.GetDuration("receipt_poll_interval"), viper.GetDuration("stuck_timeout")),
+		releaseOnRevert: viper.GetBool("release_on_revert"),
+		contractAddress: defaults.ContractAddress,
+		legacyContract:  defaults.LegacyContract,
+		forwarder:       defaults.ForwarderAddress,
+		gas: &gasEstimator{
+			multiplier: viper.GetFloat64("gas_multiplier"),
+			cap:        uint64(viper.GetInt32("gas_limit")),
+		},
+		voucherTTL:  viper.GetDuration("voucher_ttl"),
+		redemptions: newRedemptions(store),
+		fees:        fees,
+		supply:      newSupplyGuard(client),
+		guard:       newSpendGuard("", client, accountsOf(append([]Signer{signer}, minters...)), store, newAlerter(viper.GetString("alert_webhook")), gwei(defaults.MinBalance), gwei(defaults.DailySpendCap)),
+	}
+
+	// Group mints into batches of up to batch_size, sent after batch_wait at
+	// the latest.
+	m.batcher = newBatcher(viper.GetInt("batch_size"), viper.GetDuration("batch_wait"), m.processBatch)
+
+	profiles := map[string]chainProfile{}
+	if err := viper.UnmarshalKey("chains", &profiles); err != nil {
+		panic(err)
+	}
+	for name, profile := range profiles {
+		profile = profile.withDefaults(defaults)
+		client, chainID, err := profile.dial(context.Background())
+		if err != nil {
+			panic(fmt.Errorf("chain %s: %v", name, err))
+		}
+		m.chains[name], err = m.onChain(name, profile, client, chainID, viper.GetInt64("fee_bump_percent"))
+		if err != nil {
+			panic(err)
+		}
 	}
+
+	// Every campaign must render its metadata and mint on a known chain.
+	ids, err := campaigns.List()
+	if err != nil {
+		panic(err)
+	}
+	for _, id := range ids {
+		c, err := campaigns.Get(id)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := campaigns.Template(c); err != nil {
+			panic(err)
+		}
+		chain, err := m.on(c.Chain)
+		if err != nil {
+			panic(fmt.Errorf("campaign %s: %v", id, err))
+		}
+		if c, err = chain.campaign(id); err != nil {
+			panic(err)
+		}
+		if checksSupply(c) {
+			chain.supply.Watch(common.HexToAddress(c.ContractAddress))
+		}
+		if c.Soulbound {
+			ok, err := chain.mintsSoulbound(context.Background(), common.HexToAddress(c.ContractAddress))
+			if err != nil {
+				log.Printf("campaign %s: checking contract %s mints soulbound tokens: %v", id, c.ContractAddress, err)
+			} else if !ok {
+				log.Printf("campaign %s is soulbound but contract %s can't lock tokens, its mints will revert", id, c.ContractAddress)
+			}
+		}
+	}
+	if *grantMinterFlag != "" || *revokeMinterFlag != "" {
+		account, grant := *grantMinterFlag, true
+		if account == "" {
+			account, grant = *revokeMinterFlag, false
+		}
+		if !common.IsHexAddress(account) {
+			panic(fmt.Errorf("invalid minter address %q", account))
+		}
+		chain, err := m.on(*chainFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := chain.setMinters(context.Background(), common.HexToAddress(account), grant); err != nil {
+			panic(err)
+		}
+		log.Printf("set MINTER_ROLE of %s to %v", account, grant)
+		return
+	}
+
+	// Mints from pool keys without the role would all revert.
+	m.checkMinters(context.Background())
+	for _, chain := range m.chains {
+		chain.checkMinters(context.Background())
+	}
+
+	if *claimRootFlag != "" {
+		root, err := m.publishClaimRoot(context.Background(), *claimRootFlag)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("published claim root %s of campaign %s", root.Hex(), *claimRootFlag)
+		return
+	}
+
+	if *royaltyFlag != "" {
+		var r *royalty
+		if *royaltyReceiverFlag != "" {
+			if *royaltyBpsFlag > 10000 {
+				panic(fmt.Errorf("royalty of %d basis points is above the sale price", *royaltyBpsFlag))
+			}
+			r = &royalty{Receiver: *royaltyReceiverFlag, BasisPoints: uint16(*royaltyBpsFlag)}
+			if err := r.validate(); err != nil {
+				panic(err)
+			}
+		}
+		if err := m.setRoyalty(context.Background(), *royaltyFlag, r); err != nil {
+			panic(err)
+		}
+		log.Printf("set the royalty of campaign %s", *royaltyFlag)
+		return
+	}
+
 	r.Handle("/mint/{id}/{wallet}", m)
+	r.Handle("/job/{id}", &jobStatus{queue: queue})
+	r.Handle("/relay/{id}", &relayer{minter: m})
+	r.Handle("/proof/{id}", &prover{minter: m})
+	r.Handle("/redemptions/{id}", &redeemer{minter: m})
+	// campaign administration, only with a token to guard it
+	if token := viper.GetString("admin_token"); token != "" {
+		admin := &admin{minter: m, token: token}
+		r.HandleFunc("/admin/campaigns/{id}/royalty", admin.royaltyHandler)
+		r.HandleFunc("/admin/redemptions", admin.redemptionsHandler)
+	}
+
+	// Drain the mint queue in the background, picking up jobs left by a previous run.
+	err = queue.Start(context.Background(), viper.GetInt("mint_workers"), m.processJob)
+	if err != nil {
+		panic(err)
+	}
+	// and look for claims that were left half-finished, now and then periodically
+	go m.sweep(context.Background(), viper.GetDuration("recovery_interval"))
+	// keep an eye on the balance of every hot wallet
+	go m.guard.Run(context.Background(), viper.GetDuration("balance_poll_interval"))
+	// and on whether the contracts are paused or sold out
+	if !m.legacyContract {
+		m.supply.Watch(common.HexToAddress(m.contractAddress))
+	}
+	go m.supply.Run(context.Background(), viper.GetDuration("supply_poll_interval"))
+	// and on tokens burned to redeem their reward
+	go m.watchBurns(context.Background(), viper.GetDuration("burn_poll_interval"))
+	for _, chain := range m.chains {
+		go chain.guard.Run(context.Background(), viper.GetDuration("balance_poll_interval"))
+		if !chain.legacyContract {
+			chain.supply.Watch(common.HexToAddress(chain.contractAddress))
+		}
+		go chain.supply.Run(context.Background(), viper.GetDuration("supply_poll_interval"))
+		go chain.watchBurns(context.Background(), viper.GetDuration("burn_poll_interval"))
+	}
 
 	checker := &checker{store: store}
 	r.Handle("/check/{id}", checker)
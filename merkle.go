@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// modeMerkle campaigns commit to their codes on the contract with a Merkle
+// root, holders claim their token there without going through the server.
+const modeMerkle = "merkle"
+
+var claimLeafArgs = abi.Arguments{{Type: mustType("bytes32")}, {Type: mustType("string")}}
+
+func mustType(t string) abi.Type {
+	typ, err := abi.NewType(t, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return typ
+}
+
+// claimLeaf is the leaf of a code and the token uri it claims, as claimLeaf
+// of the contract computes it.
+func claimLeaf(code string, uri string) common.Hash {
+	b, err := claimLeafArgs.Pack(crypto.Keccak256Hash([]byte(code)), uri)
+	if err != nil {
+		// bytes32 and string always pack
+		panic(err)
+	}
+	return crypto.Keccak256Hash(b)
+}
+
+// merkleTree is a Merkle tree hashing sorted pairs, the kind MerkleProof of
+// OpenZeppelin verifies. The last node of an odd layer moves up unhashed.
+type merkleTree struct {
+	layers [][]common.Hash // leaves first
+}
+
+// newMerkleTree builds the tree of the leaves, which it sorts so the same
+// leaves always give the same root.
+func newMerkleTree(leaves []common.Hash) *merkleTree {
+	layer := append([]common.Hash{}, leaves...)
+	sort.Slice(layer, func(i, j int) bool { return bytes.Compare(layer[i][:], layer[j][:]) < 0 })
+
+	t := &merkleTree{layers: [][]common.Hash{layer}}
+	for len(layer) > 1 {
+		next := []common.Hash{}
+		for i := 0; i < len(layer); i += 2 {
+			if i+1 == len(layer) {
+				next = append(next, layer[i])
+				continue
+			}
+			next = append(next, hashPair(layer[i], layer[i+1]))
+		}
+		t.layers = append(t.layers, next)
+		layer = next
+	}
+	return t
+}
+
+func hashPair(a, b common.Hash) common.Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a[:], b[:])
+}
+
+// Root is the root of the tree, zero for no leaves.
+func (t *merkleTree) Root() common.Hash {
+	top := t.layers[len(t.layers)-1]
+	if len(top) == 0 {
+		return common.Hash{}
+	}
+	return top[0]
+}
+
+// Proof returns the siblings of the leaf from the bottom up, or false if the
+// leaf isn't in the tree.
+func (t *merkleTree) Proof(leaf common.Hash) ([]common.Hash, bool) {
+	leaves := t.layers[0]
+	i := sort.Search(len(leaves), func(i int) bool { return bytes.Compare(leaves[i][:], leaf[:]) >= 0 })
+	if i == len(leaves) || leaves[i] != leaf {
+		return nil, false
+	}
+
+	proof := []common.Hash{}
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		if sibling := i ^ 1; sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		}
+		i /= 2
+	}
+	return proof, true
+}
+
+// claimRoot is a Merkle root published for the codes of a campaign.
+type claimRoot struct {
+	Campaign        string        `json:"campaign"`
+	Root            common.Hash   `json:"root"`
+	Leaves          []common.Hash `json:"leaves"`
+	ChainID         uint64        `json:"chain_id"`
+	ContractAddress string        `json:"contract_address"`
+	TxHash          string        `json:"tx_hash,omitempty"`
+}
+
+func claimRootKey(campaignID string) string {
+	return campaignKey(campaignID) + "/claimroot"
+}
+
+// publishClaimRoot commits to the codes of a merkle campaign: every code
+// gets its metadata uploaded and its number, the same a mint would give it,
+// and the root of their leaves is set on the contract.
+func (m *minter) publishClaimRoot(ctx context.Context, id string) (common.Hash, error) {
+	c, err := m.campaign(id)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if c.Chain != m.chain {
+		other, err := m.on(c.Chain)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return other.publishClaimRoot(ctx, id)
+	}
+	if c.Mode != modeMerkle {
+		return common.Hash{}, fmt.Errorf("campaign %s is not a %s campaign", id, modeMerkle)
+	}
+	contract := common.HexToAddress(c.ContractAddress)
+
+	codes, err := m.campaigns.Codes(id)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(codes) == 0 {
+		return common.Hash{}, fmt.Errorf("campaign %s has no recorded codes", id)
+	}
+
+	leaves := []common.Hash{}
+	for _, code := range codes {
+		claim, found, err := m.claims.Get(code)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if !found {
+			return common.Hash{}, fmt.Errorf("code %s of campaign %s not found", code, id)
+		}
+
+		// publishing again keeps the uris committed to before
+		uri := claim.ClaimURI
+		if uri == "" {
+			number, err := m.claimNumber(code, c)
+			if err != nil {
+				return common.Hash{}, err
+			}
+			cid, err := m.uploadMetadata(&mintJob{Code: code, CreatedAt: time.Now().UTC()}, c, number)
+			if err != nil {
+				return common.Hash{}, err
+			}
+			uri = cid.Hash
+			err = m.claims.Update(code, func(claim *ClaimPrize) error {
+				claim.ClaimURI = uri
+				claim.Chain = m.chain
+				claim.ChainID = m.chainID
+				claim.ContractAddress = contract.Hex()
+				return nil
+			})
+			if err != nil {
+				return common.Hash{}, err
+			}
+		}
+		leaves = append(leaves, claimLeaf(code, uri))
+	}
+
+	tree := newMerkleTree(leaves)
+	root := &claimRoot{
+		Campaign:        id,
+		Root:            tree.Root(),
+		Leaves:          tree.layers[0],
+		ChainID:         m.chainID,
+		ContractAddress: contract.Hex(),
+	}
+
+	tx, err := m.transact(ctx, nftlink.NFTLinkMetaData, contract, nil, "setClaimRoot", root.Root, true)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	root.TxHash = tx.Hash().Hex()
+	// proofs are served as soon as the root is on its way
+	if err := m.store.Set(claimRootKey(id), root); err != nil {
+		return common.Hash{}, err
+	}
+
+	receipt, err := m.tracker.Wait(ctx, []common.Hash{tx.Hash()})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return common.Hash{}, fmt.Errorf("transaction %s setting the claim root reverted", tx.Hash().Hex())
+	}
+	return root.Root, nil
+}
+
+// claimProof is what a holder needs to call claim on the contract.
+type claimProof struct {
+	Code            string        `json:"code"`
+	URI             string        `json:"uri"`
+	Proof           []common.Hash `json:"proof"`
+	Root            common.Hash   `json:"root"`
+	ChainID         uint64        `json:"chain_id"`
+	ContractAddress string        `json:"contract_address"`
+	Claimed         bool          `json:"claimed"` // already claimed on the contract
+}
+
+var errNoClaimRoot = errors.New("no claim root published")
+
+// prover serves the proofs of the codes of merkle campaigns.
+type prover struct {
+	minter *minter
+}
+
+func (p *prover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["id"]
+
+	claim, found, err := p.minter.claims.Get(code)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Redeem code %s not found", code)
+		return
+	}
+
+	proof, err := p.minter.claimProof(r.Context(), code, claim)
+	if err == errNoClaimRoot {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Redeem code %s is not committed to on the contract", code)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, proof)
+}
+
+// claimProof returns the proof of the code against the root published for
+// its campaign.
+func (m *minter) claimProof(ctx context.Context, code string, claim *ClaimPrize) (*claimProof, error) {
+	if claim.ClaimURI == "" {
+		return nil, errNoClaimRoot
+	}
+	root := &claimRoot{}
+	found, err := m.store.Get(claimRootKey(claim.Campaign), root)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errNoClaimRoot
+	}
+
+	tree := newMerkleTree(root.Leaves)
+	proof, ok := tree.Proof(claimLeaf(code, claim.ClaimURI))
+	if !ok {
+		// the code was added after the root was published
+		return nil, errNoClaimRoot
+	}
+
+	c, err := m.campaign(claim.Campaign)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := m.on(c.Chain)
+	if err != nil {
+		return nil, err
+	}
+	nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(root.ContractAddress), chain.client)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := nftcontract.CodeClaimed(&bind.CallOpts{Context: ctx}, crypto.Keccak256Hash([]byte(code)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &claimProof{
+		Code:            code,
+		URI:             claim.ClaimURI,
+		Proof:           proof,
+		Root:            root.Root,
+		ChainID:         root.ChainID,
+		ContractAddress: root.ContractAddress,
+		Claimed:         claimed,
+	}, nil
+}
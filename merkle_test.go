@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// processProof walks a proof up to its root the way MerkleProof does.
+func processProof(proof []common.Hash, leaf common.Hash) common.Hash {
+	computed := leaf
+	for _, sibling := range proof {
+		computed = hashPair(computed, sibling)
+	}
+	return computed
+}
+
+func TestMerkleTree(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		t.Run(fmt.Sprintf("%d leaves", n), func(t *testing.T) {
+			leaves := []common.Hash{}
+			for i := 0; i < n; i++ {
+				leaves = append(leaves, claimLeaf(fmt.Sprintf("code%d", i), "QmToken"))
+			}
+			tree := newMerkleTree(leaves)
+
+			for i, leaf := range leaves {
+				proof, ok := tree.Proof(leaf)
+				if !ok {
+					t.Fatalf("leaf %d not found", i)
+				}
+				if root := processProof(proof, leaf); root != tree.Root() {
+					t.Errorf("proof of leaf %d leads to %s, want %s", i, root.Hex(), tree.Root().Hex())
+				}
+			}
+			if _, ok := tree.Proof(claimLeaf("other", "QmToken")); ok {
+				t.Errorf("found a proof for a leaf outside the tree")
+			}
+
+			// the order the codes come in doesn't matter
+			reversed := []common.Hash{}
+			for i := len(leaves) - 1; i >= 0; i-- {
+				reversed = append(reversed, leaves[i])
+			}
+			if root := newMerkleTree(reversed).Root(); root != tree.Root() {
+				t.Errorf("reversed leaves give root %s, want %s", root.Hex(), tree.Root().Hex())
+			}
+		})
+	}
+}
+
+func TestClaimLeaf(t *testing.T) {
+	// abi.encode(bytes32, string): the hash, the offset of the string, its
+	// length and its bytes padded to a word
+	codeHash := crypto.Keccak256([]byte("U6fxRAqxMo"))
+	uri := []byte("QmToken")
+	encoded := append([]byte{}, codeHash...)
+	encoded = append(encoded, math.U256Bytes(big.NewInt(64))...)
+	encoded = append(encoded, math.U256Bytes(big.NewInt(int64(len(uri))))...)
+	encoded = append(encoded, common.RightPadBytes(uri, 32)...)
+
+	if got, want := claimLeaf("U6fxRAqxMo", "QmToken"), crypto.Keccak256Hash(encoded); got != want {
+		t.Errorf("leaf %s, want %s", got.Hex(), want.Hex())
+	}
+}
+
+func TestPublishClaimRoot(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	ipfs := &recordingIPFS{}
+	m.ipfs = ipfs
+	// codeClaimed answers false, as verify does
+	backend := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 50000}}}
+	backend.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5)}
+	m.client = backend
+	m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 0)
+
+	lot := &campaign{ID: "202203R", Lot: "202203R", Mode: modeMerkle}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+	codes := []string{"U6fxRAqxMo", "wKcZ2ceDLs", "Pq9kT3mXvA"}
+	for _, code := range codes {
+		store.Set(code, &ClaimPrize{UUID: code, Campaign: lot.ID})
+	}
+	if err := m.campaigns.SaveCodes(lot.ID, codes); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := m.publishClaimRoot(context.Background(), lot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 1 || len(ipfs.uploads) != len(codes) {
+		t.Fatalf("sent %d transactions and %d uploads, want 1 and %d", len(backend.sent), len(ipfs.uploads), len(codes))
+	}
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := backend.sent[0].Data()
+	method, err := parsed.MethodById(data[:4])
+	if err != nil || method.Name != "setClaimRoot" {
+		t.Fatalf("sent %v, want setClaimRoot", method)
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if common.Hash(args[0].([32]byte)) != root || !args[1].(bool) {
+		t.Errorf("set root %x active %v, want %s active", args[0], args[1], root.Hex())
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+	r.Handle("/proof/{id}", &prover{minter: m})
+	for _, code := range codes {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/proof/"+code, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("proof of %s returned %v: %s", code, rr.Code, rr.Body.String())
+		}
+		proof := &claimProof{}
+		if err := json.NewDecoder(rr.Body).Decode(proof); err != nil {
+			t.Fatal(err)
+		}
+		if proof.Root != root || proof.URI == "" || proof.Claimed {
+			t.Errorf("unexpected proof %+v", proof)
+		}
+		if got := processProof(proof.Proof, claimLeaf(code, proof.URI)); got != root {
+			t.Errorf("proof of %s leads to %s, want %s", code, got.Hex(), root.Hex())
+		}
+
+		// the server doesn't mint codes holders claim themselves
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/"+code+"/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("mint of %s returned %v: %s", code, rr.Code, rr.Body.String())
+		}
+	}
+
+	// codes keep the uri they were committed with
+	again, err := m.publishClaimRoot(context.Background(), lot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != root || len(ipfs.uploads) != len(codes) {
+		t.Errorf("publishing again gave root %s after %d uploads, want %s after %d", again.Hex(), len(ipfs.uploads), root.Hex(), len(codes))
+	}
+
+	store.Set("nS8dQ2wLzE", &ClaimPrize{UUID: "nS8dQ2wLzE", Campaign: lot.ID})
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/proof/nS8dQ2wLzE", nil))
+	if rr.Code != http.StatusConflict || !bytes.Contains(rr.Body.Bytes(), []byte("not committed")) {
+		t.Errorf("proof of an uncommitted code returned %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestClaimOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.ipfs = &recordingIPFS{}
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = contract.Hex()
+
+	lot := &campaign{ID: "202203R", Lot: "202203R", Mode: modeMerkle}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+	codes := []string{"U6fxRAqxMo", "wKcZ2ceDLs", "Pq9kT3mXvA"}
+	for _, code := range codes {
+		store.Set(code, &ClaimPrize{UUID: code, Campaign: lot.ID})
+	}
+	if err := m.campaigns.SaveCodes(lot.ID, codes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.publishClaimRoot(context.Background(), lot.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the holder claims with the proof the server hands out
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := crypto.PubkeyToAddress(key.PublicKey)
+	m.client.(*SimulatedBackend).FundAddress(context.Background(), holder)
+	chainID, err := m.client.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nft, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofOf := func(code string) *claimProof {
+		claim, _, err := m.claims.Get(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := m.claimProof(context.Background(), code, claim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	proof, other := proofOf(codes[0]), proofOf(codes[1])
+
+	var cases = []struct {
+		name   string
+		uri    string
+		proof  []common.Hash
+		revert string // empty if the claim mints
+	}{
+		{"Another uri", other.URI, proof.Proof, "NFTLink: invalid claim proof"},
+		{"Proof of another code", proof.URI, other.Proof, "NFTLink: invalid claim proof"},
+		{"Claimed", proof.URI, proof.Proof, ""},
+		{"Claimed twice", proof.URI, proof.Proof, "NFTLink: code already claimed"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			siblings := [][32]byte{}
+			for _, h := range tc.proof {
+				siblings = append(siblings, h)
+			}
+			before, err := nft.BalanceOf(nil, holder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = nft.Claim(auth, codes[0], tc.uri, siblings)
+			if tc.revert == "" && err != nil {
+				t.Fatalf("claim reverted: %v", err)
+			}
+			if tc.revert != "" && (err == nil || !strings.Contains(err.Error(), tc.revert)) {
+				t.Fatalf("claim returned %v, want a revert with %q", err, tc.revert)
+			}
+			after, err := nft.BalanceOf(nil, holder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := int64(0)
+			if tc.revert == "" {
+				want = 1
+			}
+			if minted := new(big.Int).Sub(after, before).Int64(); minted != want {
+				t.Errorf("claim minted %d tokens, want %d", minted, want)
+			}
+		})
+	}
+
+	if !proofOf(codes[0]).Claimed || proofOf(codes[1]).Claimed {
+		t.Errorf("proofs don't tell the claimed code from the others")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed metadata
+var builtinMetadata embed.FS // the templates shipped with the server
+
+type Attribute struct {
+	TraitType   string `json:"trait_type" yaml:"trait_type"`
+	DisplayType string `json:"display_type,omitempty" yaml:"display_type"`
+	Value       string `json:"value" yaml:"value"`
+}
+
+type Metadata struct {
+	Name        string      `json:"name" yaml:"name"`
+	Description string      `json:"description" yaml:"description"`
+	Image       string      `json:"image" yaml:"image"`
+	Attributes  []Attribute `json:"attributes" yaml:"attributes"`
+}
+
+// metadataData is what the placeholders of a metadata template can use.
+type metadataData struct {
+	Number    uint64
+	Code      string
+	Wallet    string
+	ClaimDate time.Time
+	Campaign  campaign // zero for codes outside of any campaign
+}
+
+// metadataTemplate renders the metadata of every token of a drop. It is a
+// Metadata document, in YAML or JSON, whose values are Go text/templates.
+type metadataTemplate struct {
+	doc   Metadata
+	texts map[string]*template.Template // every value of doc, parsed
+}
+
+// loadMetadataTemplate reads the template at path, or the built in Ma'hai one
+// if path is empty, and checks that it renders.
+func loadMetadataTemplate(path string) (*metadataTemplate, error) {
+	if path == "" {
+		return builtinMetadataTemplate("mahai.yaml")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadataTemplate(b)
+}
+
+// builtinMetadataTemplate returns one of the templates in metadata/.
+func builtinMetadataTemplate(name string) (*metadataTemplate, error) {
+	b, err := builtinMetadata.ReadFile("metadata/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadataTemplate(b)
+}
+
+// parseMetadataTemplate parses a template, YAML being a superset of JSON, and
+// renders it once with sample data so mistakes show up at startup instead of
+// on a customer's claim.
+func parseMetadataTemplate(b []byte) (*metadataTemplate, error) {
+	t := &metadataTemplate{texts: map[string]*template.Template{}}
+	if err := yaml.UnmarshalStrict(b, &t.doc); err != nil {
+		return nil, fmt.Errorf("parsing metadata template: %v", err)
+	}
+
+	if t.doc.Name == "" {
+		return nil, errors.New("metadata template has no name")
+	}
+	if t.doc.Image == "" {
+		return nil, errors.New("metadata template has no image")
+	}
+	for i, a := range t.doc.Attributes {
+		if a.TraitType == "" {
+			return nil, fmt.Errorf("attribute %d of the metadata template has no trait_type", i)
+		}
+	}
+
+	for _, text := range t.values() {
+		if _, ok := t.texts[text]; ok {
+			continue
+		}
+		tmpl, err := template.New("metadata").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing metadata template %q: %v", text, err)
+		}
+		t.texts[text] = tmpl
+	}
+
+	sample := metadataData{
+		Number:    1,
+		Code:      "U6fxRAqxMo",
+		Wallet:    "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+		ClaimDate: time.Now(),
+		Campaign: campaign{
+			ID:             "sample",
+			Name:           "Sample",
+			Lot:            "1",
+			Bottles:        1,
+			ProductionDate: time.Now(),
+			Image:          "ipfs://sample",
+		},
+	}
+	if _, err := t.Render(sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// values lists every templated value of the document.
+func (t *metadataTemplate) values() []string {
+	values := []string{t.doc.Name, t.doc.Description, t.doc.Image}
+	for _, a := range t.doc.Attributes {
+		values = append(values, a.TraitType, a.DisplayType, a.Value)
+	}
+	return values
+}
+
+// Render returns the metadata of one token.
+func (t *metadataTemplate) Render(data metadataData) (Metadata, error) {
+	var err error
+	render := func(text string) string {
+		if err != nil {
+			return ""
+		}
+		var b bytes.Buffer
+		if e := t.texts[text].Execute(&b, data); e != nil {
+			err = fmt.Errorf("rendering metadata template %q: %v", text, e)
+		}
+		return b.String()
+	}
+
+	metadata := Metadata{
+		Name:        render(t.doc.Name),
+		Description: render(t.doc.Description),
+		Image:       render(t.doc.Image),
+		Attributes:  []Attribute{},
+	}
+	for _, a := range t.doc.Attributes {
+		metadata.Attributes = append(metadata.Attributes, Attribute{
+			TraitType:   render(a.TraitType),
+			DisplayType: render(a.DisplayType),
+			Value:       render(a.Value),
+		})
+	}
+	return metadata, err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testMetadata(t *testing.T) *metadataTemplate {
+	t.Helper()
+	metadata, err := loadMetadataTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+func TestDefaultMetadata(t *testing.T) {
+	metadata, err := testMetadata(t).Render(metadataData{Number: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"name":"Ma'hai #7","description":"Ma'hai #7","image":"ipfs://QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5","attributes":[` +
+		`{"trait_type":"Producto","value":"London Dry Gin"},` +
+		`{"trait_type":"Lote","value":"202112R"},` +
+		`{"trait_type":"Partida","value":"840 botellas"},` +
+		`{"trait_type":"Fabricado en","value":"Coronel Vidal, Buenos Aires, Argentina"},` +
+		`{"trait_type":"Fecha de produccion","display_type":"date","value":"1638421200"}]}`
+	if string(b) != expected {
+		t.Errorf("metadata = %s, expected %s", b, expected)
+	}
+}
+
+func TestMetadataTemplate(t *testing.T) {
+	data := metadataData{
+		Number:    12,
+		Code:      "U6fxRAqxMo",
+		Wallet:    "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+		ClaimDate: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	var tests = []struct {
+		name     string
+		template string
+		expected string
+		err      bool
+	}{
+		{
+			name: "yaml",
+			template: `
+name: "Bottle #{{.Number}}"
+description: "Claimed with {{.Code}}"
+image: ipfs://QmImage
+attributes:
+  - trait_type: Owner
+    value: "{{.Wallet}}"
+  - trait_type: Claimed
+    display_type: date
+    value: "{{.ClaimDate.Unix}}"
+`,
+			expected: `{"name":"Bottle #12","description":"Claimed with U6fxRAqxMo","image":"ipfs://QmImage","attributes":[` +
+				`{"trait_type":"Owner","value":"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"},` +
+				`{"trait_type":"Claimed","display_type":"date","value":"1641092645"}]}`,
+		},
+		{
+			name:     "json",
+			template: `{"name": "Bottle #{{.Number}}", "image": "ipfs://QmImage/{{.Number}}.png", "attributes": []}`,
+			expected: `{"name":"Bottle #12","description":"","image":"ipfs://QmImage/12.png","attributes":[]}`,
+		},
+		{
+			name:     "no name",
+			template: `image: ipfs://QmImage`,
+			err:      true,
+		},
+		{
+			name:     "no image",
+			template: `name: Bottle`,
+			err:      true,
+		},
+		{
+			name:     "no trait type",
+			template: "name: Bottle\nimage: ipfs://QmImage\nattributes:\n  - value: gin\n",
+			err:      true,
+		},
+		{
+			name:     "unknown field",
+			template: "name: Bottle\nimage: ipfs://QmImage\nexternal: https://example.com\n",
+			err:      true,
+		},
+		{
+			name:     "bad placeholder",
+			template: "name: \"Bottle #{{.Number\"\nimage: ipfs://QmImage\n",
+			err:      true,
+		},
+		{
+			name:     "unknown placeholder",
+			template: "name: \"Bottle #{{.Serial}}\"\nimage: ipfs://QmImage\n",
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := parseMetadataTemplate([]byte(test.template))
+			if test.err {
+				if err == nil {
+					t.Fatal("expected the template to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			metadata, err := tmpl.Render(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.expected {
+				t.Errorf("metadata = %s, expected %s", b, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type nonceSource interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+// nonceManager hands out sequential nonces for a single signer so parallel
+// mints don't race for the same one. It starts from the chain's pending nonce
+// and only goes back to the chain when told to resync.
+type nonceManager struct {
+	client  nonceSource
+	account common.Address
+
+	mu     sync.Mutex
+	synced bool
+	next   uint64
+	free   []uint64 // nonces handed out but never used, to be filled first
+}
+
+func newNonceManager(client nonceSource, account common.Address) *nonceManager {
+	return &nonceManager{client: client, account: account}
+}
+
+// Next returns the nonce for the next transaction. Released nonces are reused
+// before new ones so the account's sequence never has gaps.
+func (n *nonceManager) Next(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	pending, err := n.client.PendingNonceAt(ctx, n.account)
+	if err != nil {
+		return 0, err
+	}
+
+	// somebody else used the key, or a resync was requested
+	if !n.synced || pending > n.next {
+		n.next = pending
+		n.synced = true
+	}
+
+	// drop the gaps the chain already filled
+	kept := n.free[:0]
+	for _, nonce := range n.free {
+		if nonce >= pending && nonce < n.next {
+			kept = append(kept, nonce)
+		}
+	}
+	n.free = kept
+
+	if len(n.free) > 0 {
+		nonce := n.free[0]
+		n.free = n.free[1:]
+		return nonce, nil
+	}
+
+	nonce := n.next
+	n.next++
+	return nonce, nil
+}
+
+// Release gives back a nonce whose transaction never made it to the network,
+// e.g. because sending failed or it was dropped from the mempool.
+func (n *nonceManager) Release(nonce uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.synced || nonce >= n.next {
+		return
+	}
+	for _, v := range n.free {
+		if v == nonce {
+			return
+		}
+	}
+	n.free = append(n.free, nonce)
+	sort.Slice(n.free, func(i, j int) bool { return n.free[i] < n.free[j] })
+}
+
+// Resync forgets the local sequence, the next call to Next reads it from the
+// chain again.
+func (n *nonceManager) Resync() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.synced = false
+	n.free = nil
+}
+
+// isNonceError reports whether the node rejected a transaction because its
+// nonce was already used by a mined one.
+func isNonceError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "nonce too low")
+}
+
+// isKnownTxError reports whether the node refused a transaction because it
+// already has it, i.e. an earlier send did reach it.
+func isKnownTxError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already known")
+}
+
+// isNonceTakenError reports whether a pending transaction of the account
+// holds the nonce and this one doesn't pay enough to replace it.
+func isNonceTakenError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "replacement transaction underpriced")
+}
+
+// rejectedTxErrors are what nodes answer for a transaction they won't take
+// whatever happens to the others, so it never reached the network.
+var rejectedTxErrors = []string{
+	"insufficient funds",
+	"intrinsic gas too low",
+	"fee cap less than block base fee",
+	"max fee per gas less than block base fee",
+	"max priority fee per gas higher than max fee per gas",
+	"exceeds block gas limit",
+	"transaction underpriced",
+	"exceeds the configured cap",
+	"oversized data",
+	"invalid sender",
+	"transaction type not supported",
+}
+
+// isRejectedTxError reports whether the node refused a transaction outright,
+// as opposed to an error that leaves it unknown whether the node has it.
+func isRejectedTxError(err error) bool {
+	if err == nil || isNonceTakenError(err) {
+		return false
+	}
+	for _, rejected := range rejectedTxErrors {
+		if strings.Contains(err.Error(), rejected) {
+			return true
+		}
+	}
+	return false
+}
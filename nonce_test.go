@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// staleNonces answers the first PendingNonceAt with a nonce the chain already
+// used, like a lagging RPC node would.
+type staleNonces struct {
+	nonceSource
+	mu    sync.Mutex
+	stale bool
+}
+
+func (s *staleNonces) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stale {
+		s.stale = false
+		return 0, nil
+	}
+	return s.nonceSource.PendingNonceAt(ctx, account)
+}
+
+func TestNonceManager(t *testing.T) {
+	client := NewSimulatedBackend()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := crypto.PubkeyToAddress(key.PublicKey)
+	n := newNonceManager(client, account)
+
+	for want := uint64(0); want < 3; want++ {
+		got, err := n.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got nonce %d want %d", got, want)
+		}
+	}
+
+	// a dropped transaction leaves a gap that is filled before moving on
+	n.Release(1)
+	n.Release(1)
+	if got, _ := n.Next(context.Background()); got != 1 {
+		t.Errorf("got nonce %d after releasing 1, want 1", got)
+	}
+	if got, _ := n.Next(context.Background()); got != 3 {
+		t.Errorf("got nonce %d want 3", got)
+	}
+
+	// nonces never handed out can't be released
+	n.Release(10)
+	if got, _ := n.Next(context.Background()); got != 4 {
+		t.Errorf("got nonce %d want 4", got)
+	}
+
+	// after a resync the sequence starts again from the chain
+	n.Resync()
+	if got, _ := n.Next(context.Background()); got != 0 {
+		t.Errorf("got nonce %d after resync, want 0", got)
+	}
+}
+
+func TestNonceManagerConcurrent(t *testing.T) {
+	n := newNonceManager(NewSimulatedBackend(), common.Address{})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := map[uint64]bool{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nonce, err := n.Next(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[nonce] {
+				t.Errorf("nonce %d handed out twice", nonce)
+			}
+			seen[nonce] = true
+		}()
+	}
+	wg.Wait()
+
+	for i := uint64(0); i < 100; i++ {
+		if !seen[i] {
+			t.Errorf("nonce %d was skipped", i)
+		}
+	}
+}
+
+func TestConcurrentMintNonces(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"), "", nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(m.contractAddress), m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := nftcontract.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Int64() != 10 {
+		t.Errorf("minted %v tokens, want 10", count)
+	}
+}
+
+func TestMintResyncsNonce(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	// the deployer already used nonce 0 for the contract, a stale read makes
+	// the first attempt fail with "nonce too low"
+	m.nonces = newNonceManager(&staleNonces{nonceSource: m.client, stale: true}, m.nonces.account)
+
+	if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"), "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rejectingBackend captures every transaction sent and answers with err.
+type rejectingBackend struct {
+	*capturingBackend
+	err error
+}
+
+func (r *rejectingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	r.capturingBackend.SendTransaction(ctx, tx)
+	return r.err
+}
+
+func TestMintSendErrors(t *testing.T) {
+	var cases = []struct {
+		name string
+		err  error
+		sent bool // whether the mint counts as sent
+	}{
+		{"Already known", errors.New("already known"), true},
+		{"Nonce taken by a pending transaction", errors.New("replacement transaction underpriced"), false},
+		{"Out of ETH", errors.New("insufficient funds for gas * price + value"), false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			backend := &rejectingBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 500000}}, err: tc.err}
+			m.client = backend
+
+			tx, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"), "QmToken", nil)
+			if tc.sent && (err != nil || tx == nil) {
+				t.Errorf("mint() = %v, %v, want it sent", tx, err)
+			}
+			if !tc.sent && err == nil {
+				t.Errorf("mint() succeeded, want %v", tc.err)
+			}
+			// never again under another nonce
+			if len(backend.sent) != 1 {
+				t.Errorf("sent %d transactions, want 1", len(backend.sent))
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/miekg/pkcs11"
+)
+
+// secp256k1Params is the DER encoded OID of secp256k1 (1.3.132.0.10), the
+// CKA_EC_PARAMS of Ethereum keys.
+var secp256k1Params = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x0a}
+
+// pkcs11Signer signs with a secp256k1 key that never leaves a PKCS#11 token,
+// e.g. an HSM. The token only returns r and s, the recovery id is found by
+// trying both values against the public key.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	address common.Address
+	pubkey  []byte // uncompressed, 0x04 || X || Y
+
+	mu      sync.Mutex // PKCS#11 sessions can't be used concurrently
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+}
+
+// openPKCS11Signer loads the PKCS#11 module, logs in to the token in slot and
+// finds the key pair with the given label.
+func openPKCS11Signer(module string, slot uint, label string, pin string) (*pkcs11Signer, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("loading PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	s := &pkcs11Signer{ctx: ctx}
+	if err := s.open(slot, label, pin); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pkcs11Signer) open(slot uint, label string, pin string) error {
+	var err error
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("opening a session on slot %d: %v", slot, err)
+	}
+	if err := s.ctx.Login(s.session, pkcs11.CKU_USER, pin); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return fmt.Errorf("logging in to slot %d: %v", slot, err)
+	}
+
+	s.key, err = s.find(pkcs11.CKO_PRIVATE_KEY, label)
+	if err != nil {
+		return err
+	}
+	pub, err := s.find(pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, pub, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(attrs[0].Value, secp256k1Params) {
+		return fmt.Errorf("key %s is not a secp256k1 key", label)
+	}
+	s.pubkey, err = ecPoint(attrs[1].Value)
+	if err != nil {
+		return fmt.Errorf("key %s: %v", label, err)
+	}
+	pubkey, err := crypto.UnmarshalPubkey(s.pubkey)
+	if err != nil {
+		return fmt.Errorf("key %s: %v", label, err)
+	}
+	s.address = crypto.PubkeyToAddress(*pubkey)
+	return nil
+}
+
+// find returns the only object of the class with the label.
+func (s *pkcs11Signer) find(class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 2)
+	if finalErr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("found %d keys labeled %s, expected 1", len(objects), label)
+	}
+	return objects[0], nil
+}
+
+// ecPoint returns the uncompressed point of a CKA_EC_POINT, which tokens
+// give either DER wrapped in an OCTET STRING, as the standard says, or raw.
+func ecPoint(value []byte) ([]byte, error) {
+	if len(value) == 65 && value[0] == 4 {
+		return value, nil
+	}
+	var point []byte
+	if _, err := asn1.Unmarshal(value, &point); err != nil {
+		return nil, err
+	}
+	if len(point) != 65 || point[0] != 4 {
+		return nil, errors.New("EC point is not an uncompressed secp256k1 point")
+	}
+	return point, nil
+}
+
+func (s *pkcs11Signer) Address() common.Address {
+	return s.address
+}
+
+func (s *pkcs11Signer) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	signer := types.LatestSignerForChainID(chainID)
+	hash := signer.Hash(tx)
+	sig, err := s.sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return tx.WithSignature(signer, sig)
+}
+
+func (s *pkcs11Signer) SignTypedData(data apitypes.TypedData) ([]byte, error) {
+	hash, err := typedDataHash(data)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	sig[64] += 27
+	return sig, nil
+}
+
+// sign returns the 65 byte [R || S || V] signature of hash.
+func (s *pkcs11Signer) sign(hash []byte) ([]byte, error) {
+	s.mu.Lock()
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.key)
+	var rs []byte
+	if err == nil {
+		rs, err = s.ctx.Sign(s.session, hash)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) != 64 {
+		return nil, fmt.Errorf("token returned a %d byte signature, expected 64", len(rs))
+	}
+
+	// Ethereum only accepts the lower of the two valid S values
+	n := crypto.S256().Params().N
+	sv := new(big.Int).SetBytes(rs[32:])
+	if sv.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		sv.Sub(n, sv)
+	}
+
+	sig := make([]byte, 65)
+	copy(sig, rs[:32])
+	sv.FillBytes(sig[32:64])
+	for v := byte(0); v < 2; v++ {
+		sig[64] = v
+		pubkey, err := crypto.Ecrecover(hash, sig)
+		if err == nil && bytes.Equal(pubkey, s.pubkey) {
+			return sig, nil
+		}
+	}
+	return nil, errors.New("signature of the token doesn't recover its public key")
+}
+
+// Close logs out and unloads the module.
+func (s *pkcs11Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != 0 {
+		s.ctx.Logout(s.session)
+		s.ctx.CloseSession(s.session)
+	}
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
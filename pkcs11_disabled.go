@@ -0,0 +1,10 @@
+//go:build !pkcs11
+
+package main
+
+import "errors"
+
+// openPKCS11Signer needs cgo and the pkcs11 build tag.
+func openPKCS11Signer(module string, slot uint, label string, pin string) (Signer, error) {
+	return nil, errors.New("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
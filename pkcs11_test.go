@@ -0,0 +1,199 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// softHSMModule finds SoftHSM, set SOFTHSM2_MODULE if it lives elsewhere.
+// The test fails rather than skips when SOFTHSM2_MODULE isn't there, as the
+// Docker build sets it to have the test run.
+func softHSMModule(t *testing.T) string {
+	if module := os.Getenv("SOFTHSM2_MODULE"); module != "" {
+		if _, err := os.Stat(module); err != nil {
+			t.Fatalf("SOFTHSM2_MODULE: %v", err)
+		}
+		return module
+	}
+	paths := []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	t.Skip("SoftHSM not found, set SOFTHSM2_MODULE")
+	return ""
+}
+
+// newSoftHSMToken initializes a SoftHSM token in a temporary directory and
+// imports key into it, labeled "minter". It returns the slot of the token.
+func newSoftHSMToken(t *testing.T, module string, key *ecdsa.PrivateKey, pin string) uint {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := pkcs11.New(module)
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitToken(slots[0], "so-pin", "nftlink"); err != nil {
+		t.Fatal(err)
+	}
+	// SoftHSM moves an initialized token to a new slot
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slot uint
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		if err == nil && info.Label == "nftlink" {
+			slot = s
+		}
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.Login(session, pkcs11.CKU_SO, "so-pin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(session, pin); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(session)
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(session)
+
+	point, err := asn1.Marshal(crypto.FromECDSAPub(&key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.CreateObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "minter"),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, secp256k1Params),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.CreateObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "minter"),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, secp256k1Params),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, crypto.FromECDSA(key)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return slot
+}
+
+func TestPKCS11Signer(t *testing.T) {
+	module := softHSMModule(t)
+
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	// the contract owner's key moves into the token
+	owner := m.signer.(*keySigner).key
+	slot := newSoftHSMToken(t, module, owner, "1234")
+
+	if _, err := openPKCS11Signer(module, slot, "minter", "4321"); err == nil {
+		t.Error("expected a wrong PIN to be rejected")
+	}
+	if _, err := openPKCS11Signer(module, slot, "other", "1234"); err == nil {
+		t.Error("expected a missing key to be rejected")
+	}
+
+	signer, err := (chainProfile{PKCS11Module: module, PKCS11Slot: slot, PKCS11Label: "minter", PKCS11Pin: "1234"}).signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signer.(*pkcs11Signer).Close()
+	if signer.Address() != crypto.PubkeyToAddress(owner.PublicKey) {
+		t.Fatalf("signer is %s, expected %s", signer.Address().Hex(), crypto.PubkeyToAddress(owner.PublicKey).Hex())
+	}
+
+	// both recovery ids and both S values come up over enough signatures
+	chainID := big.NewInt(1337)
+	for nonce := uint64(0); nonce < 16; nonce++ {
+		tx, err := signer.SignTx(types.NewTx(&types.DynamicFeeTx{ChainID: chainID, Nonce: nonce, Gas: 21000}), chainID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, err := types.Sender(types.LatestSignerForChainID(chainID), tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != signer.Address() {
+			t.Fatalf("transaction %d recovers to %s, expected %s", nonce, from.Hex(), signer.Address().Hex())
+		}
+	}
+
+	m.signer = signer
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), wallet, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	m.client.(*SimulatedBackend).Commit()
+
+	nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(m.contractAddress), m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := nftcontract.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Int64() != 1 {
+		t.Errorf("minted %v tokens, expected 1", count)
+	}
+}
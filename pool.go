@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// minterRole is the role NFTLink requires to call safeMint and safeMintBatch.
+var minterRole = crypto.Keccak256Hash([]byte("MINTER_ROLE"))
+
+// hotKey is an account sending transactions, with the nonces it hands out.
+type hotKey struct {
+	signer Signer
+	nonces *nonceManager
+}
+
+// minterPool spreads mints over hot wallets holding MINTER_ROLE. Every key
+// keeps its own nonce sequence, so mints aren't bound to the one of the owner.
+type minterPool struct {
+	keys []*hotKey
+	next uint32
+	// the accounts that can't mint on a contract, by contract
+	lacking map[common.Address]map[common.Address]bool
+}
+
+// newMinterPool returns a pool of the signers, nil if there are none.
+func newMinterPool(client nonceSource, signers []Signer) *minterPool {
+	if len(signers) == 0 {
+		return nil
+	}
+	p := &minterPool{}
+	for _, signer := range signers {
+		p.keys = append(p.keys, &hotKey{signer: signer, nonces: newNonceManager(client, signer.Address())})
+	}
+	return p
+}
+
+// Next returns the keys that can mint on contract in turn, skipping the ones
+// that aren't usable as long as another one is. It returns nil if no key can
+// mint on contract.
+func (p *minterPool) Next(contract common.Address, usable func(common.Address) bool) *hotKey {
+	var first *hotKey
+	for range p.keys {
+		n := atomic.AddUint32(&p.next, 1) - 1
+		key := p.keys[int(n%uint32(len(p.keys)))]
+		if p.lacking[contract][key.signer.Address()] {
+			continue
+		}
+		if usable(key.signer.Address()) {
+			return key
+		}
+		if first == nil {
+			first = key
+		}
+	}
+	return first
+}
+
+// Key returns the key of the account, nil if it isn't in the pool.
+func (p *minterPool) Key(account common.Address) *hotKey {
+	if p == nil {
+		return nil
+	}
+	for _, key := range p.keys {
+		if key.signer.Address() == account {
+			return key
+		}
+	}
+	return nil
+}
+
+// minterSigners returns the signers of the minter_keys and minter_keystores
+// of the profile, the keystores sharing the keystore passphrase.
+func (p chainProfile) minterSigners() ([]Signer, error) {
+	signers := []Signer{}
+	for i, hexKey := range p.MinterKeys {
+		signer, err := newHexKeySigner(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("minter_keys[%d]: %v", i, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(p.MinterKeystores) == 0 {
+		return signers, nil
+	}
+	passphrase, err := secret(p.KeystorePassphrase, p.KeystorePassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range p.MinterKeystores {
+		signer, err := loadKeystore(path, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// ownerKey returns the key owning the contracts, which sends everything but
+// mints.
+func (m *minter) ownerKey() *hotKey {
+	return &hotKey{signer: m.signer, nonces: m.nonces}
+}
+
+// mintKey returns the key to send the next mint to contract with: the next
+// one of the pool the spend guard doesn't pause, or the owner key when no
+// key of the pool can mint on contract.
+func (m *minter) mintKey(contract common.Address) *hotKey {
+	if m.pool == nil {
+		return m.ownerKey()
+	}
+	if key := m.pool.Next(contract, m.guard.Usable); key != nil {
+		return key
+	}
+	return m.ownerKey()
+}
+
+// mintAccounts returns the accounts mints to contract are sent from.
+func (m *minter) mintAccounts(contract common.Address) []common.Address {
+	if m.pool == nil {
+		return []common.Address{m.signer.Address()}
+	}
+	accounts := []common.Address{}
+	for _, key := range m.pool.keys {
+		if !m.pool.lacking[contract][key.signer.Address()] {
+			accounts = append(accounts, key.signer.Address())
+		}
+	}
+	if len(accounts) == 0 {
+		return []common.Address{m.signer.Address()}
+	}
+	return accounts
+}
+
+func (p *minterPool) signers() []Signer {
+	signers := []Signer{}
+	for _, key := range p.keys {
+		signers = append(signers, key.signer)
+	}
+	return signers
+}
+
+// accountsOf returns the addresses of the signers.
+func accountsOf(signers []Signer) []common.Address {
+	accounts := []common.Address{}
+	for _, signer := range signers {
+		accounts = append(accounts, signer.Address())
+	}
+	return accounts
+}
+
+// keyOf returns the key of the account that sent tx.
+func (m *minter) keyOf(tx *types.Transaction) (*hotKey, error) {
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return nil, err
+	}
+	if from == m.signer.Address() {
+		return m.ownerKey(), nil
+	}
+	if key := m.pool.Key(from); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("transaction %s was sent by %s, which is no longer configured", tx.Hash().Hex(), from.Hex())
+}
+
+// contracts returns the contract of the chain and the ones of the campaigns
+// minting on it.
+func (m *minter) contracts() ([]common.Address, error) {
+	contracts := []common.Address{common.HexToAddress(m.contractAddress)}
+	ids, err := m.campaigns.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		c, err := m.campaign(id)
+		if err != nil {
+			return nil, err
+		}
+		if c.Chain != m.chain || !m.ownContract(c) {
+			continue
+		}
+		contract := common.HexToAddress(c.ContractAddress)
+		seen := false
+		for _, other := range contracts {
+			seen = seen || other == contract
+		}
+		if !seen {
+			contracts = append(contracts, contract)
+		}
+	}
+	return contracts, nil
+}
+
+// setMinters grants, or revokes, MINTER_ROLE to account on every contract of
+// the chain and waits for the transactions to be mined.
+func (m *minter) setMinters(ctx context.Context, account common.Address, grant bool) error {
+	method := "revokeRole"
+	if grant {
+		method = "grantRole"
+	}
+	contracts, err := m.contracts()
+	if err != nil {
+		return err
+	}
+	sent := []*types.Transaction{}
+	for _, contract := range contracts {
+		tx, err := m.transact(ctx, nftlink.NFTLinkMetaData, contract, nil, method, minterRole, account)
+		if err != nil {
+			return err
+		}
+		sent = append(sent, tx)
+	}
+	for _, tx := range sent {
+		receipt, err := m.tracker.Wait(ctx, []common.Hash{tx.Hash()})
+		if err != nil {
+			return err
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return fmt.Errorf("transaction %s calling %s reverted", tx.Hash().Hex(), method)
+		}
+	}
+	return nil
+}
+
+// checkMinters keeps the keys of the pool from minting on the contracts of
+// the chain that don't let them, as their mints would all revert. A key whose
+// role can't be read is kept from minting there too. The owner mints on the
+// contracts no key of the pool can mint on.
+func (m *minter) checkMinters(ctx context.Context) {
+	if m.pool == nil {
+		return
+	}
+	contracts, err := m.contracts()
+	if err != nil {
+		log.Printf("checking the minters of chain %q: %v", m.chain, err)
+		return
+	}
+	m.pool.lacking = map[common.Address]map[common.Address]bool{}
+	for _, contract := range contracts {
+		lacking := map[common.Address]bool{}
+		m.pool.lacking[contract] = lacking
+		caller, callerErr := nftlink.NewNFTLinkCaller(contract, m.client)
+		for _, key := range m.pool.keys {
+			account := key.signer.Address()
+			ok, err := false, callerErr
+			if err == nil {
+				ok, err = caller.HasRole(&bind.CallOpts{Context: ctx}, minterRole, account)
+			}
+			switch {
+			case err != nil:
+				log.Printf("checking the role of minter %s on %s, it won't mint there: %v", account.Hex(), contract.Hex(), err)
+				lacking[account] = true
+			case !ok:
+				log.Printf("minter %s lacks MINTER_ROLE on %s and won't mint there, grant it with -grant-minter", account.Hex(), contract.Hex())
+				lacking[account] = true
+			}
+		}
+		if len(lacking) == len(m.pool.keys) {
+			log.Printf("no minter can mint on %s, minting there with the owner key", contract.Hex())
+		}
+	}
+}
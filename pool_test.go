@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func testMinterSigners(t *testing.T, n int) []Signer {
+	signers := []Signer{}
+	for i := 0; i < n; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, newKeySigner(key))
+	}
+	return signers
+}
+
+func TestMinterPool(t *testing.T) {
+	if p := newMinterPool(NewSimulatedBackend(), nil); p != nil {
+		t.Errorf("pool without keys = %v, want nil", p)
+	}
+
+	signers := testMinterSigners(t, 3)
+	p := newMinterPool(NewSimulatedBackend(), signers)
+	for i := 0; i < 7; i++ {
+		if got, want := p.Next(common.Address{}, func(common.Address) bool { return true }).signer.Address(), signers[i%3].Address(); got != want {
+			t.Errorf("key %d is %s, want %s", i, got.Hex(), want.Hex())
+		}
+	}
+
+	if key := p.Key(signers[1].Address()); key == nil || key.signer != signers[1] {
+		t.Errorf("Key() = %v, want the second key", key)
+	}
+	if key := p.Key(common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")); key != nil {
+		t.Errorf("found a key outside the pool")
+	}
+}
+
+func TestPoolMints(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	backend := &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 500000}}
+	m.client = backend
+	signers := testMinterSigners(t, 2)
+	m.pool = newMinterPool(backend, signers)
+
+	contract := common.HexToAddress(m.contractAddress)
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	for i := 0; i < 4; i++ {
+		if _, err := m.mint(context.Background(), contract, wallet, "QmToken", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every key mints in turn with a nonce sequence of its own
+	for i, tx := range backend.sent {
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := signers[i%2].Address(); from != want || tx.Nonce() != uint64(i/2) {
+			t.Errorf("mint %d sent by %s with nonce %d, want %s with nonce %d", i, from.Hex(), tx.Nonce(), want.Hex(), i/2)
+		}
+	}
+
+	// owner transactions stay with the owner key
+	if _, err := m.transactRoyalty(context.Background(), contract, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	last := backend.sent[len(backend.sent)-1]
+	if from, _ := types.Sender(types.LatestSignerForChainID(last.ChainId()), last); from != m.signer.Address() {
+		t.Errorf("owner transaction sent by %s, want %s", from.Hex(), m.signer.Address().Hex())
+	}
+
+	// a stuck mint is replaced by the key that sent it
+	raw, err := backend.sent[1].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := m.replace(context.Background(), hexutil.Encode(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(replacement.ChainId()), replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != signers[1].Address() || replacement.Nonce() != backend.sent[1].Nonce() {
+		t.Errorf("replacement sent by %s with nonce %d, want %s with nonce %d", from.Hex(), replacement.Nonce(), signers[1].Address().Hex(), backend.sent[1].Nonce())
+	}
+
+	// without its key nothing can replace it
+	m.pool = newMinterPool(backend, testMinterSigners(t, 1))
+	if _, err := m.replace(context.Background(), hexutil.Encode(raw)); err == nil {
+		t.Errorf("replaced a transaction of a key no longer configured")
+	}
+}
+
+func TestSetMinters(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	backend := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 50000}}}
+	backend.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5)}
+	m.client = backend
+	m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 0)
+
+	// one campaign has a contract of its own, the other two share the chain's
+	own := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	for _, c := range []*campaign{
+		{ID: "202203R", ContractAddress: own.Hex()},
+		{ID: "202204R"},
+		{ID: "202205R", ContractAddress: m.contractAddress},
+		{ID: "202206R", Chain: "polygon", ContractAddress: "0x71C7656EC7ab88b098defB751B7401B5f6d8976F"},
+	} {
+		if err := m.campaigns.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	account := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	var cases = []struct {
+		grant  bool
+		method string
+	}{
+		{true, "grantRole"},
+		{false, "revokeRole"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method, func(t *testing.T) {
+			backend.sent = nil
+			if err := m.setMinters(context.Background(), account, tc.grant); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[common.Address]bool{common.HexToAddress(m.contractAddress): true, own: true}
+			if len(backend.sent) != len(want) {
+				t.Fatalf("sent %d transactions, want %d", len(backend.sent), len(want))
+			}
+			for i, call := range sentCalls(t, backend.sent) {
+				if !want[*backend.sent[i].To()] {
+					t.Errorf("sent %s to %s", call.method, backend.sent[i].To().Hex())
+				}
+				if call.method != tc.method || common.Hash(call.args[0].([32]byte)) != minterRole || call.args[1].(common.Address) != account {
+					t.Errorf("sent %s%v, want %s of MINTER_ROLE to %s", call.method, call.args, tc.method, account.Hex())
+				}
+			}
+		})
+	}
+}
+
+// roleBackend answers hasRole with the accounts holding MINTER_ROLE on each
+// contract, and fails it for the contracts in failing.
+type roleBackend struct {
+	ethBackend
+	minters map[common.Address]map[common.Address]bool
+	failing map[common.Address]bool
+}
+
+func (r *roleBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	method, err := parsed.MethodById(call.Data[:4])
+	if err != nil || method.Name != "hasRole" {
+		return r.ethBackend.CallContract(ctx, call, blockNumber)
+	}
+	if r.failing[*call.To] {
+		return nil, errors.New("connection refused")
+	}
+	args, err := method.Inputs.Unpack(call.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return method.Outputs.Pack(common.Hash(args[0].([32]byte)) == minterRole && r.minters[*call.To][args[1].(common.Address)])
+}
+
+func TestCheckMinters(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	signers := testMinterSigners(t, 2)
+	contract := common.HexToAddress(m.contractAddress)
+	other := common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")
+	unreachable := common.HexToAddress("0x9fbda871d559710256a2502a2517b794b482db40")
+	for _, c := range []*campaign{{ID: "202203R", ContractAddress: other.Hex()}, {ID: "202204R", ContractAddress: unreachable.Hex()}} {
+		if err := m.campaigns.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the second key can only mint on the contract of the chain, the first
+	// one on the contract of the first campaign
+	m.client = &roleBackend{
+		ethBackend: m.client,
+		minters: map[common.Address]map[common.Address]bool{
+			contract: {signers[1].Address(): true},
+			other:    {signers[0].Address(): true, signers[1].Address(): false},
+		},
+		failing: map[common.Address]bool{unreachable: true},
+	}
+	m.pool = newMinterPool(m.client, signers)
+	m.checkMinters(context.Background())
+
+	var cases = []struct {
+		name     string
+		contract common.Address
+		want     Signer
+	}{
+		{"Contract of the chain", contract, signers[1]},
+		{"Contract of a campaign", other, signers[0]},
+		// a key isn't trusted with a role that couldn't be read
+		{"Unreachable contract", unreachable, m.signer},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				if key := m.mintKey(tc.contract); key.signer != tc.want {
+					t.Errorf("mint %d sent by %s, want %s", i, key.signer.Address().Hex(), tc.want.Address().Hex())
+				}
+			}
+			if accounts := m.mintAccounts(tc.contract); len(accounts) != 1 || accounts[0] != tc.want.Address() {
+				t.Errorf("mintAccounts() = %v, want %s", accounts, tc.want.Address().Hex())
+			}
+		})
+	}
+}
+
+func TestMinterRoleOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = contract.Hex()
+	signers := testMinterSigners(t, 1)
+	minter := signers[0].Address()
+	m.client.(*SimulatedBackend).FundAddress(context.Background(), minter)
+	m.pool = newMinterPool(m.client, signers)
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+
+	// a key without MINTER_ROLE can't mint, the check leaves it to the owner
+	if _, err := m.transactWith(context.Background(), m.pool.keys[0], nftlink.NFTLinkMetaData, contract, nil, "safeMint", wallet, "QmToken"); err == nil || !strings.Contains(err.Error(), "is missing role") {
+		t.Errorf("mint without the role returned %v, want a revert", err)
+	}
+	m.checkMinters(context.Background())
+	if key := m.mintKey(contract); key.signer != m.signer {
+		t.Errorf("mint sent by %s, want the owner", key.signer.Address().Hex())
+	}
+
+	// granted, it mints
+	if err := m.setMinters(context.Background(), minter, true); err != nil {
+		t.Fatal(err)
+	}
+	m.checkMinters(context.Background())
+	key := m.mintKey(contract)
+	if key.signer.Address() != minter {
+		t.Fatalf("mint sent by %s, want the minter %s", key.signer.Address().Hex(), minter.Hex())
+	}
+	tx, err := m.transactWith(context.Background(), key, nftlink.NFTLinkMetaData, contract, nil, "safeMint", wallet, "QmToken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()}); err != nil || receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("mint with the role failed: %v", err)
+	}
+
+	// handing over the contract hands over the admin role
+	newOwner := testMinterSigners(t, 1)[0].Address()
+	tx, err = m.transact(context.Background(), nftlink.NFTLinkMetaData, contract, nil, "transferOwnership", newOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()}); err != nil {
+		t.Fatal(err)
+	}
+	caller, err := nftlink.NewNFTLinkCaller(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminRole, err := caller.DEFAULTADMINROLE(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for account, want := range map[common.Address]bool{newOwner: true, m.signer.Address(): false} {
+		if admin, err := caller.HasRole(nil, adminRole, account); err != nil || admin != want {
+			t.Errorf("%s admin = %v, want %v: %v", account.Hex(), admin, want, err)
+		}
+	}
+	if err := m.setMinters(context.Background(), minter, false); err == nil {
+		t.Errorf("the former owner revoked a role")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// recoveryGrace is how long a reserved code may go without a saved job before
+// the sweeper assumes the request reserving it died.
+const recoveryGrace = time.Minute
+
+// sweep recovers half-finished claims right away and then every interval,
+// until ctx is cancelled.
+func (m *minter) sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.recoverClaims(ctx); err != nil {
+			log.Printf("recovering claims: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recoverClaims puts every claim stuck between reservation and settlement
+// back on track, e.g. after the process died in the middle of a mint.
+func (m *minter) recoverClaims(ctx context.Context) error {
+	codes, err := m.claims.Open()
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if err := m.recoverClaim(ctx, code); err != nil {
+			log.Printf("recovering claim %s: %v", code, err)
+		}
+	}
+	return nil
+}
+
+func (m *minter) recoverClaim(ctx context.Context, code string) error {
+	claim, found, err := m.claims.Get(code)
+	if err != nil {
+		return err
+	}
+	if !found || claim.Status.settled() {
+		return m.claims.open.Remove(code)
+	}
+	if m.queue.Busy(claim.JobID) {
+		return nil
+	}
+
+	job, found, err := m.queue.Get(claim.JobID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// the request died between reserving the code and queueing its job
+		if time.Since(claim.ReservedAt) < recoveryGrace {
+			return nil
+		}
+		job = newMintJob(code, claim.Wallet)
+		job.ID = claim.JobID
+		job.Campaign = claim.Campaign
+		if err := m.queue.Update(job); err != nil {
+			return err
+		}
+		return m.queue.Requeue(job.ID)
+	}
+
+	switch job.State {
+	case jobFailed:
+		// the job gave up but died before freeing the code
+		return m.claims.Release(code, job.ID)
+	case jobConfirmed:
+		return nil
+	}
+	// the job checks the chain for an earlier mint before sending anything
+	return m.queue.Requeue(job.ID)
+}
+
+// findMint looks for a token of the contract minted to wallet with the given metadata CID and
+// returns the transaction that minted it. Only blocks from start on are scanned.
+func (m *minter) findMint(ctx context.Context, contract common.Address, wallet common.Address, uri string, start uint64) (common.Hash, bool, error) {
+	nftcontract, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		return common.Hash{}, false, err
+	}
+
+	it, err := nftcontract.FilterTransfer(&bind.FilterOpts{Start: start, Context: ctx}, []common.Address{{}}, []common.Address{wallet}, nil)
+	if err != nil {
+		return common.Hash{}, false, err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		tokenURI, err := nftcontract.TokenURI(&bind.CallOpts{Context: ctx}, it.Event.TokenId)
+		if err != nil {
+			return common.Hash{}, false, err
+		}
+		if tokenURI == "ipfs://"+uri {
+			return it.Event.Raw.TxHash, true, nil
+		}
+	}
+	return common.Hash{}, false, it.Error()
+}
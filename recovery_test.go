@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestRecoverClaims(t *testing.T) {
+	wallet := "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+
+	var cases = []struct {
+		name string
+		// crash leaves the code U6fxRAqxMo half-finished, the way a process
+		// dying at some point of the pipeline would
+		crash      func(t *testing.T, m *minter, job *mintJob)
+		wantStatus claimStatus
+		wantMinted int64
+	}{
+		{"Died before queueing the job", func(t *testing.T, m *minter, job *mintJob) {
+			m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+				claim.ReservedAt = time.Now().Add(-2 * recoveryGrace)
+				return nil
+			})
+		}, claimFinal, 1},
+		{"Died while uploading", func(t *testing.T, m *minter, job *mintJob) {
+			job.State = jobUploading
+			job.TokenURI = "QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5"
+			m.queue.Update(job)
+			m.queue.open.Add(job.ID)
+		}, claimFinal, 1},
+		{"Died after sending", func(t *testing.T, m *minter, job *mintJob) {
+			m.queue.Update(job)
+			m.queue.open.Add(job.ID)
+			_, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress(wallet), "QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5", func(tx *types.Transaction) error {
+				raw, err := tx.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				return m.submitted(job, common.HexToAddress(m.contractAddress), tx.Hash(), raw)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, claimFinal, 1},
+		{"Died after minting without saving the transaction", func(t *testing.T, m *minter, job *mintJob) {
+			job.State = jobUploading
+			job.TokenURI = "QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5"
+			m.queue.Update(job)
+			m.queue.open.Add(job.ID)
+			if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress(wallet), job.TokenURI, nil); err != nil {
+				t.Fatal(err)
+			}
+		}, claimFinal, 1},
+		{"Died before freeing a failed code", func(t *testing.T, m *minter, job *mintJob) {
+			job.State = jobFailed
+			m.queue.Update(job)
+		}, claimAvailable, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+
+			store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+			job := newMintJob("U6fxRAqxMo", wallet)
+			if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+				t.Fatal(err)
+			}
+			tc.crash(t, m, job)
+
+			// a new process starts on the same store and chain
+			restarted := newTestMinter(t, store)
+			restarted.client = m.client
+			restarted.contractAddress = m.contractAddress
+			restarted.signer = m.signer
+			restarted.nonces = newNonceManager(m.client, m.nonces.account)
+			restarted.serials = m.serials
+			restarted.tracker = newTxTracker(m.client, 1, 10*time.Millisecond, 0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := restarted.queue.Start(ctx, 2, restarted.processJob); err != nil {
+				t.Fatal(err)
+			}
+			go restarted.sweep(ctx, time.Hour)
+
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				open, err := restarted.claims.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(open) == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("claims still open: %v", open)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			claim, _, err := restarted.claims.Get("U6fxRAqxMo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claim.Status != tc.wantStatus {
+				t.Errorf("claim is %q, want %q", claim.Status, tc.wantStatus)
+			}
+
+			nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(m.contractAddress), m.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := nftcontract.Count(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count.Int64() != tc.wantMinted {
+				t.Errorf("minted %v tokens, want %d", count, tc.wantMinted)
+			}
+		})
+	}
+}
+
+// filterRecorder keeps the block ranges asked for logs.
+type filterRecorder struct {
+	ethBackend
+	from []*big.Int
+}
+
+func (f *filterRecorder) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	f.from = append(f.from, q.FromBlock)
+	return f.ethBackend.FilterLogs(ctx, q)
+}
+
+func TestFindMintFromStartBlock(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	backend := &filterRecorder{ethBackend: m.client}
+	m.client = backend
+
+	// a job records the head before it sends anything
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+	job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if job.StartBlock == 0 {
+		t.Errorf("job has no start block")
+	}
+
+	// and recovery only scans from there
+	if _, _, err := m.findMint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress(job.Wallet), job.TokenURI, job.StartBlock); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.from) != 1 || backend.from[0].Uint64() != job.StartBlock {
+		t.Errorf("scanned from %v, want block %d", backend.from, job.StartBlock)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv"
+)
+
+var (
+	errRedemptionNotFound = errors.New("no burn of the token seen")
+	errAlreadyRedeemed    = errors.New("token already redeemed")
+	errNotBurner          = errors.New("signature is not from the wallet that burned the token")
+)
+
+type redemptionStatus string
+
+const (
+	redemptionPending   redemptionStatus = "pending"   // burned, waiting for the holder's form
+	redemptionSubmitted redemptionStatus = "submitted" // the form was filled, the reward is on its way
+)
+
+// redemption is the physical reward owed for a burned token. There is one
+// per token: a token can only be burned, and redeemed, once.
+type redemption struct {
+	ID       string           `json:"id"`
+	ChainID  uint64           `json:"chain_id"`
+	Contract string           `json:"contract"`
+	TokenID  string           `json:"token_id"`
+	Holder   string           `json:"holder"` // the wallet that burned the token
+	BurnTx   string           `json:"burn_tx"`
+	Block    uint64           `json:"block"`
+	Code     string           `json:"code,omitempty"` // the redeem code that minted the token, if known
+	Campaign string           `json:"campaign,omitempty"`
+	Status   redemptionStatus `json:"status"`
+	// what the holder signs to fill the form, proving the burn was theirs
+	Message     string          `json:"message"`
+	Form        *redemptionForm `json:"form,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	SubmittedAt time.Time       `json:"submitted_at,omitempty"`
+}
+
+// redemptionForm is where the holder wants the reward.
+type redemptionForm struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Delivery string `json:"delivery"`          // "shipping" or "pickup"
+	Address  string `json:"address,omitempty"` // to ship to
+	Notes    string `json:"notes,omitempty"`
+}
+
+func (f *redemptionForm) validate() error {
+	if strings.TrimSpace(f.Name) == "" {
+		return errors.New("name is required")
+	}
+	if _, err := mail.ParseAddress(f.Email); err != nil {
+		return fmt.Errorf("invalid email %q", f.Email)
+	}
+	switch f.Delivery {
+	case "shipping":
+		if strings.TrimSpace(f.Address) == "" {
+			return errors.New("address is required for shipping")
+		}
+	case "pickup":
+	default:
+		return fmt.Errorf("delivery must be shipping or pickup, not %q", f.Delivery)
+	}
+	return nil
+}
+
+func redemptionID(chainID uint64, contract common.Address, tokenID *big.Int) string {
+	return fmt.Sprintf("%d-%s-%s", chainID, contract.Hex(), tokenID)
+}
+
+func redemptionKey(id string) string {
+	return "redemption/" + id
+}
+
+// tokenKey holds the redeem code that minted a token.
+func tokenKey(chainID uint64, contract common.Address, tokenID string) string {
+	return fmt.Sprintf("token/%d/%s/%s", chainID, contract.Hex(), tokenID)
+}
+
+// burnCursorKey holds the first block not yet scanned for burns of the
+// contract.
+func burnCursorKey(chainID uint64, contract common.Address) string {
+	return fmt.Sprintf("burns/%d/%s", chainID, contract.Hex())
+}
+
+// redemptionsKey holds the IDs of every redemption.
+const redemptionsKey = "redemptions"
+
+// redemptions keeps the redemptions in the store. Both creating one and
+// submitting its form are atomic updates of the store, so only one form is
+// accepted per token whichever instance serves it.
+type redemptions struct {
+	store gokv.Store
+	index *storeIndex
+}
+
+func newRedemptions(store gokv.Store) *redemptions {
+	return &redemptions{store: store, index: newStoreIndex(store, redemptionsKey)}
+}
+
+func (s *redemptions) Get(id string) (*redemption, error) {
+	r := &redemption{}
+	found, err := s.store.Get(redemptionKey(id), r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", errRedemptionNotFound, id)
+	}
+	return r, nil
+}
+
+// Create saves a redemption for a burn seen for the first time. It reports
+// whether it did, seeing a burn again doesn't change its redemption.
+func (s *redemptions) Create(r *redemption) (bool, error) {
+	stored := &redemption{}
+	err := storeUpdate(s.store, redemptionKey(r.ID), stored, func(found bool) error {
+		if found {
+			return errRedemptionExists
+		}
+		*stored = *r
+		return nil
+	})
+	if err == errRedemptionExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.index.Add(r.ID)
+}
+
+// errRedemptionExists stops Create from writing over a redemption.
+var errRedemptionExists = errors.New("redemption exists")
+
+// Submit records the form of a pending redemption, signed by the wallet
+// that burned the token.
+func (s *redemptions) Submit(id string, form *redemptionForm, signature []byte) (*redemption, error) {
+	r, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := messageSigner(r.Message, signature)
+	if err != nil || signer != common.HexToAddress(r.Holder) {
+		return nil, errNotBurner
+	}
+
+	err = storeUpdate(s.store, redemptionKey(id), r, func(found bool) error {
+		if !found {
+			return fmt.Errorf("%w: %s", errRedemptionNotFound, id)
+		}
+		if r.Status != redemptionPending {
+			return errAlreadyRedeemed
+		}
+		r.Form = form
+		r.Status = redemptionSubmitted
+		r.SubmittedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// List returns every redemption, the ones in status only if it isn't empty.
+func (s *redemptions) List(status redemptionStatus) ([]*redemption, error) {
+	ids, err := s.index.List()
+	if err != nil {
+		return nil, err
+	}
+	list := []*redemption{}
+	for _, id := range ids {
+		r, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if status == "" || r.Status == status {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+// messageSigner recovers the wallet that signed message with personal_sign.
+func messageSigner(message string, signature []byte) (common.Address, error) {
+	if len(signature) != 65 {
+		return common.Address{}, errors.New("invalid signature length")
+	}
+	sig := append([]byte{}, signature...)
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	pubkey, err := crypto.SigToPub(accounts.TextHash([]byte(message)), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pubkey), nil
+}
+
+// watchBurns scans the contracts of the chain for burns right away and then
+// every interval, until ctx is cancelled.
+func (m *minter) watchBurns(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.scanBurns(ctx); err != nil {
+			log.Printf("scanning burns on chain %q: %v", m.chain, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// burnScanBlocks is the most blocks a single query for burns covers.
+const burnScanBlocks = 2000
+
+// scanBurns creates the redemptions of the tokens burned on the contracts of
+// the chain since the last scan, up to the last block with the required
+// confirmations, so a reorg can't take a burn back.
+func (m *minter) scanBurns(ctx context.Context) error {
+	head, err := m.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if head.Number.Uint64()+1 < m.tracker.confirmations {
+		return nil
+	}
+	safe := head.Number.Uint64() + 1 - m.tracker.confirmations
+
+	contracts, err := m.contracts()
+	if err != nil {
+		return err
+	}
+	for _, contract := range contracts {
+		var next uint64
+		found, err := m.store.Get(burnCursorKey(m.chainID, contract), &next)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// a contract is watched from the first scan that sees it, the
+			// blocks before it are never looked through
+			next = safe
+		}
+		// nodes cap the blocks of a log query, go through them in pages
+		for next <= safe {
+			to := next + burnScanBlocks - 1
+			if to > safe {
+				to = safe
+			}
+			if err := m.scanContractBurns(ctx, contract, next, to); err != nil {
+				return fmt.Errorf("contract %s: %v", contract.Hex(), err)
+			}
+			if err := m.store.Set(burnCursorKey(m.chainID, contract), to+1); err != nil {
+				return err
+			}
+			next = to + 1
+		}
+	}
+	return nil
+}
+
+func (m *minter) scanContractBurns(ctx context.Context, contract common.Address, from uint64, to uint64) error {
+	nftcontract, err := nftlink.NewNFTLinkFilterer(contract, m.client)
+	if err != nil {
+		return err
+	}
+	it, err := nftcontract.FilterTransfer(&bind.FilterOpts{Start: from, End: &to, Context: ctx}, nil, []common.Address{{}}, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		if err := m.burned(it.Event); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// burned creates the redemption of a burned token, with the redeem code and
+// campaign it was minted for if the token was minted by this server.
+func (m *minter) burned(event *nftlink.NFTLinkTransfer) error {
+	contract := event.Raw.Address
+	id := redemptionID(m.chainID, contract, event.TokenId)
+	r := &redemption{
+		ID:        id,
+		ChainID:   m.chainID,
+		Contract:  contract.Hex(),
+		TokenID:   event.TokenId.String(),
+		Holder:    event.From.Hex(),
+		BurnTx:    event.Raw.TxHash.Hex(),
+		Block:     event.Raw.BlockNumber,
+		Status:    redemptionPending,
+		Message:   fmt.Sprintf("Redeem token %s of %s on chain %d", event.TokenId, contract.Hex(), m.chainID),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var code string
+	found, err := m.store.Get(tokenKey(m.chainID, contract, r.TokenID), &code)
+	if err != nil {
+		return err
+	}
+	if found {
+		claim, ok, err := m.claims.Get(code)
+		if err != nil {
+			return err
+		}
+		r.Code = code
+		if ok {
+			r.Campaign = claim.Campaign
+		}
+	}
+
+	created, err := m.redemptions.Create(r)
+	if created {
+		log.Printf("token %s of %s burned by %s, redemption %s", r.TokenID, r.Contract, r.Holder, id)
+	}
+	return err
+}
+
+// redeemer serves the redemption of a burned token: GET tells whether the
+// burn was seen and what to sign, POST takes the form of the holder.
+type redeemer struct {
+	minter *minter
+}
+
+// redemptionRequest is the form of a redemption, signed by the holder.
+type redemptionRequest struct {
+	redemptionForm
+	Signature hexutil.Bytes `json:"signature"`
+}
+
+func (h *redeemer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		found, err := h.minter.redemptions.Get(id)
+		if errors.Is(err, errRedemptionNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "No burn of this token seen yet")
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		// the form is for the fulfillment team only
+		found.Form = nil
+		writeJSON(w, http.StatusOK, found)
+	case http.MethodPost:
+		req := &redemptionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid redemption form: %v", err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		redeemed, err := h.minter.redemptions.Submit(id, &req.redemptionForm, req.Signature)
+		switch {
+		case errors.Is(err, errRedemptionNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "No burn of this token seen yet")
+		case err == errNotBurner:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Sign the redemption with the wallet that burned the token")
+		case err == errAlreadyRedeemed:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Token already redeemed")
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%v", err)
+		default:
+			redeemed.Form = nil
+			writeJSON(w, http.StatusOK, redeemed)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Use GET or POST")
+	}
+}
+
+// redemptionsHandler lists the redemptions with their forms, only the ones
+// in the status given as the status parameter if set.
+func (a *admin) redemptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Invalid admin token")
+		return
+	}
+	list, err := a.minter.redemptions.List(redemptionStatus(r.URL.Query().Get("status")))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// burnBackend serves the logs it holds that match the filter, ignoring
+// block ranges.
+type burnBackend struct {
+	ethBackend
+	logs    []types.Log
+	head    *big.Int    // reported instead of the real head when set
+	scanned [][2]uint64 // block ranges queried, in order
+}
+
+func (b *burnBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if b.head != nil && number == nil {
+		return &types.Header{Number: b.head}, nil
+	}
+	return b.ethBackend.HeaderByNumber(ctx, number)
+}
+
+func (b *burnBackend) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	if q.FromBlock != nil && q.ToBlock != nil {
+		b.scanned = append(b.scanned, [2]uint64{q.FromBlock.Uint64(), q.ToBlock.Uint64()})
+	}
+	matching := []types.Log{}
+	for _, l := range b.logs {
+		if len(q.Addresses) > 0 && l.Address != q.Addresses[0] {
+			continue
+		}
+		match := true
+		for i, topics := range q.Topics {
+			if len(topics) == 0 {
+				continue
+			}
+			found := false
+			for _, topic := range topics {
+				found = found || l.Topics[i] == topic
+			}
+			match = match && found
+		}
+		if match {
+			matching = append(matching, l)
+		}
+	}
+	return matching, nil
+}
+
+func transferLog(contract common.Address, from common.Address, to common.Address, tokenID int64) types.Log {
+	return types.Log{
+		Address: contract,
+		Topics: []common.Hash{
+			crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)")),
+			common.BytesToHash(from.Bytes()),
+			common.BytesToHash(to.Bytes()),
+			common.BigToHash(big.NewInt(tokenID)),
+		},
+		TxHash:      crypto.Keccak256Hash(big.NewInt(tokenID).Bytes()),
+		BlockNumber: 1,
+	}
+}
+
+func signRedemption(t *testing.T, key *ecdsa.PrivateKey, message string) hexutil.Bytes {
+	sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[64] += 27
+	return sig
+}
+
+func TestBurnRedemption(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.chainID = 1337
+	m.redemptions = newRedemptions(store)
+	contract := common.HexToAddress(m.contractAddress)
+
+	holderKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := crypto.PubkeyToAddress(holderKey.PublicKey)
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// token 7 was minted for a code of a campaign, token 9 elsewhere
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: "202203R", TokenID: "7"})
+	store.Set(tokenKey(m.chainID, contract, "7"), "U6fxRAqxMo")
+	m.client = &burnBackend{ethBackend: m.client, logs: []types.Log{
+		transferLog(contract, common.Address{}, holder, 7),
+		transferLog(contract, holder, common.Address{}, 7),
+		transferLog(contract, common.Address{}, holder, 9),
+		transferLog(contract, holder, common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F"), 9),
+	}}
+
+	// scanning again doesn't open the redemption twice
+	for i := 0; i < 2; i++ {
+		store.Delete(burnCursorKey(m.chainID, contract))
+		if err := m.scanBurns(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := m.redemptions.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("%d redemptions, want 1 for the burned token", len(list))
+	}
+	id := redemptionID(m.chainID, contract, big.NewInt(7))
+	redeemed := list[0]
+	if redeemed.ID != id || redeemed.Holder != holder.Hex() || redeemed.Code != "U6fxRAqxMo" || redeemed.Campaign != "202203R" || redeemed.Status != redemptionPending {
+		t.Errorf("unexpected redemption %+v", redeemed)
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/redemptions/{id}", &redeemer{minter: m})
+	a := &admin{minter: m, token: "s3cret"}
+	r.HandleFunc("/admin/redemptions", a.redemptionsHandler)
+
+	form := redemptionForm{Name: "Ada Lovelace", Email: "ada@example.com", Delivery: "shipping", Address: "12 St James's Square, London"}
+	request := func(f redemptionForm, sig hexutil.Bytes) string {
+		b, err := json.Marshal(&redemptionRequest{redemptionForm: f, Signature: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	noAddress := form
+	noAddress.Address = ""
+
+	var cases = []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"Not burned", "GET", "/redemptions/" + redemptionID(m.chainID, contract, big.NewInt(9)), "", http.StatusNotFound},
+		{"Pending", "GET", "/redemptions/" + id, "", http.StatusOK},
+		{"Missing address", "POST", "/redemptions/" + id, request(noAddress, signRedemption(t, holderKey, redeemed.Message)), http.StatusBadRequest},
+		{"Signed by another wallet", "POST", "/redemptions/" + id, request(form, signRedemption(t, otherKey, redeemed.Message)), http.StatusForbidden},
+		{"Signed another message", "POST", "/redemptions/" + id, request(form, signRedemption(t, holderKey, "Redeem token 9")), http.StatusForbidden},
+		{"Redeem", "POST", "/redemptions/" + id, request(form, signRedemption(t, holderKey, redeemed.Message)), http.StatusOK},
+		{"Redeem again", "POST", "/redemptions/" + id, request(form, signRedemption(t, holderKey, redeemed.Message)), http.StatusConflict},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, bytes.NewBufferString(tc.body)))
+			if rr.Code != tc.status {
+				t.Errorf("handler returned %v, want %v: %s", rr.Code, tc.status, rr.Body.String())
+			}
+			if bytes.Contains(rr.Body.Bytes(), []byte(form.Address)) {
+				t.Errorf("handler returned the form: %s", rr.Body.String())
+			}
+		})
+	}
+
+	// the fulfillment team sees the form
+	req := httptest.NewRequest("GET", "/admin/redemptions?status=submitted", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	submitted := []*redemption{}
+	if err := json.NewDecoder(rr.Body).Decode(&submitted); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted) != 1 || submitted[0].Form == nil || *submitted[0].Form != form || submitted[0].Status != redemptionSubmitted {
+		t.Errorf("admin listed %+v", submitted)
+	}
+}
+
+func TestBurnOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = contract.Hex()
+	m.redemptions = newRedemptions(store)
+	chainID, err := m.client.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.chainID = chainID.Uint64()
+	// the contract is watched from here on
+	if err := m.scanBurns(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	holderKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := crypto.PubkeyToAddress(holderKey.PublicKey)
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*ecdsa.PrivateKey{holderKey, otherKey} {
+		m.client.(*SimulatedBackend).FundAddress(context.Background(), crypto.PubkeyToAddress(key.PublicKey))
+	}
+
+	// the token of a code of a campaign, minted to the holder
+	tx, err := m.mint(context.Background(), contract, holder, "QmToken", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenID, err := m.mintedToken(contract, receipt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: "202203R", TokenID: tokenID.String()})
+	store.Set(tokenKey(m.chainID, contract, tokenID.String()), "U6fxRAqxMo")
+
+	nft, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var burns = []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		revert string // empty if the token is burned
+	}{
+		{"Burned by another wallet", otherKey, "NFTLink: caller is not owner nor approved"},
+		{"Burned by the holder", holderKey, ""},
+	}
+	for _, burn := range burns {
+		auth, err := bind.NewKeyedTransactorWithChainID(burn.key, chainID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = nft.Burn(auth, tokenID)
+		if burn.revert == "" && err != nil {
+			t.Fatalf("%s: burn reverted: %v", burn.name, err)
+		}
+		if burn.revert != "" && (err == nil || !strings.Contains(err.Error(), burn.revert)) {
+			t.Fatalf("%s: burn returned %v, want a revert with %q", burn.name, err, burn.revert)
+		}
+	}
+
+	// the burn opens the redemption of the code, the holder redeems it
+	if err := m.scanBurns(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	list, err := m.redemptions.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("%d redemptions, want 1 for the burned token", len(list))
+	}
+	burned := list[0]
+	if burned.ID != redemptionID(m.chainID, contract, tokenID) || burned.Holder != holder.Hex() || burned.Code != "U6fxRAqxMo" || burned.Campaign != "202203R" {
+		t.Errorf("unexpected redemption %+v", burned)
+	}
+
+	form := redemptionForm{Name: "Ada Lovelace", Email: "ada@example.com", Delivery: "shipping", Address: "12 St James's Square, London"}
+	body, err := json.Marshal(&redemptionRequest{redemptionForm: form, Signature: signRedemption(t, holderKey, burned.Message)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Handle("/redemptions/{id}", &redeemer{minter: m})
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/redemptions/"+burned.ID, bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("redeem returned %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestScanBurnsRange(t *testing.T) {
+	var cases = []struct {
+		name   string
+		cursor uint64 // 0 for a contract never scanned
+		want   [][2]uint64
+	}{
+		{"New contract", 0, [][2]uint64{{4500, 4500}}},
+		{"Up to date", 4501, nil},
+		{"Behind", 100, [][2]uint64{{100, 2099}, {2100, 4099}, {4100, 4500}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			m.chainID = 1337
+			m.redemptions = newRedemptions(store)
+			contract := common.HexToAddress(m.contractAddress)
+			backend := &burnBackend{ethBackend: m.client, head: big.NewInt(4500)}
+			m.client = backend
+			if tc.cursor != 0 {
+				store.Set(burnCursorKey(m.chainID, contract), tc.cursor)
+			}
+
+			if err := m.scanBurns(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(backend.scanned) != fmt.Sprint(tc.want) {
+				t.Errorf("scanned %v, want %v", backend.scanned, tc.want)
+			}
+			var next uint64
+			store.Get(burnCursorKey(m.chainID, contract), &next)
+			if next != 4501 {
+				t.Errorf("cursor at %d, want 4501", next)
+			}
+		})
+	}
+}
+
+func TestRedemptionFormValidate(t *testing.T) {
+	var cases = []struct {
+		name  string
+		form  redemptionForm
+		valid bool
+	}{
+		{"Shipping", redemptionForm{Name: "Ada", Email: "ada@example.com", Delivery: "shipping", Address: "London"}, true},
+		{"Pickup", redemptionForm{Name: "Ada", Email: "ada@example.com", Delivery: "pickup"}, true},
+		{"No name", redemptionForm{Email: "ada@example.com", Delivery: "pickup"}, false},
+		{"Invalid email", redemptionForm{Name: "Ada", Email: "ada", Delivery: "pickup"}, false},
+		{"Unknown delivery", redemptionForm{Name: "Ada", Email: "ada@example.com", Delivery: "drone"}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.form.validate()
+			if tc.valid && err != nil {
+				t.Errorf("form refused: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("form accepted")
+			}
+		})
+	}
+}
+
+func TestSubmitAcrossInstances(t *testing.T) {
+	store := newVersionedStore()
+	holderKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &redemption{ID: "1337-0x5FbDB2315678afecb367f032d93F642f64180aa3-7", Holder: crypto.PubkeyToAddress(holderKey.PublicKey).Hex(), Message: "Redeem token 7", Status: redemptionPending}
+	for i := 0; i < 2; i++ {
+		created, err := newRedemptions(store).Create(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != (i == 0) {
+			t.Errorf("Create() = %v the %d. time", created, i+1)
+		}
+	}
+
+	// every form is sent to an instance of its own
+	sig := signRedemption(t, holderKey, r.Message)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			form := &redemptionForm{Name: fmt.Sprintf("Holder %d", i), Email: "ada@example.com", Delivery: "pickup"}
+			_, err := newRedemptions(store).Submit(r.ID, form, sig)
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			} else if err != errAlreadyRedeemed {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("%d forms accepted, want exactly one", accepted)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+var errBadSignature = errors.New("invalid forward request signature")
+
+// forwardRequest is the ForwardRequest of the MinimalForwarder, as signed by
+// the wallet in the browser.
+type forwardRequest struct {
+	From  common.Address `json:"from"`
+	To    common.Address `json:"to"`
+	Value string         `json:"value"`
+	Gas   string         `json:"gas"`
+	Nonce string         `json:"nonce"`
+	Data  hexutil.Bytes  `json:"data"`
+}
+
+// relayRequest is the body of a gasless redeem.
+type relayRequest struct {
+	Request   forwardRequest `json:"request"`
+	Signature hexutil.Bytes  `json:"signature"`
+}
+
+// forwarderRequest converts the request to the struct of the bindings.
+func (r forwardRequest) forwarderRequest() (nftlink.MinimalForwarderForwardRequest, error) {
+	value, ok := new(big.Int).SetString(r.Value, 10)
+	if !ok {
+		return nftlink.MinimalForwarderForwardRequest{}, fmt.Errorf("invalid value %q", r.Value)
+	}
+	gas, ok := new(big.Int).SetString(r.Gas, 10)
+	if !ok {
+		return nftlink.MinimalForwarderForwardRequest{}, fmt.Errorf("invalid gas %q", r.Gas)
+	}
+	nonce, ok := new(big.Int).SetString(r.Nonce, 10)
+	if !ok {
+		return nftlink.MinimalForwarderForwardRequest{}, fmt.Errorf("invalid nonce %q", r.Nonce)
+	}
+	return nftlink.MinimalForwarderForwardRequest{From: r.From, To: r.To, Value: value, Gas: gas, Nonce: nonce, Data: r.Data}, nil
+}
+
+// relayer sends the gasless redeems of voucher campaigns through the trusted
+// forwarder of their chain, paying the gas from the hot wallet. The wallet
+// only signs the forward request, the contract sees it as the caller.
+type relayer struct {
+	minter *minter
+}
+
+func (rl *relayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["id"]
+
+	req := &relayRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid relay request: %v", err)
+		return
+	}
+
+	claim, found, err := rl.minter.claims.Get(code)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Redeem code %s not found", code)
+		return
+	}
+
+	c, err := rl.minter.campaign(claim.Campaign)
+	var chain *minter
+	if err == nil {
+		chain, err = rl.minter.on(c.Chain)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if chain.forwarder == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Redeem code %s can't be claimed without gas", code)
+		return
+	}
+
+	job, found, err := rl.minter.queue.Get(claim.JobID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if !found || claim.Status != claimVoucher || job.Voucher == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Redeem code %s has no voucher to redeem", code)
+		return
+	}
+	if time.Now().After(claim.VoucherExpiry) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "The voucher of redeem code %s expired", code)
+		return
+	}
+
+	if err := chain.checkForwardRequest(req.Request, job.Voucher); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	// the relayer pays, don't take redeems the hot wallet can't afford
+	if err := chain.guard.Allow(c, chain.signer.Address()); err != nil {
+		log.Printf("refusing to relay %s: %v", code, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Minting is temporarily unavailable, please try again later")
+		return
+	}
+
+	err = chain.relay(r.Context(), job, req)
+	switch {
+	case err == errBadSignature:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	case err == errCodeReserved:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Redeem code %s is being claimed", code)
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// checkForwardRequest makes sure the relayer only pays for redeeming the
+// voucher of the code, and nothing else the wallet might have signed.
+func (m *minter) checkForwardRequest(req forwardRequest, v *signedVoucher) error {
+	if req.To != common.HexToAddress(v.ContractAddress) {
+		return fmt.Errorf("forward request calls %s, expected the contract %s", req.To.Hex(), v.ContractAddress)
+	}
+	if req.From != v.Voucher.Recipient {
+		return fmt.Errorf("forward request is signed by %s, the voucher is for %s", req.From.Hex(), v.Voucher.Recipient.Hex())
+	}
+	if req.Value != "0" {
+		return errors.New("forward request sends value")
+	}
+	gas, ok := new(big.Int).SetString(req.Gas, 10)
+	if !ok {
+		return fmt.Errorf("invalid gas %q", req.Gas)
+	}
+	if m.gas != nil && m.gas.cap != 0 && gas.Cmp(new(big.Int).SetUint64(m.gas.cap)) > 0 {
+		return fmt.Errorf("forward request asks for %v gas, the limit is %d", gas, m.gas.cap)
+	}
+
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		return err
+	}
+	if len(req.Data) < 4 {
+		return errors.New("forward request has no call")
+	}
+	method, err := parsed.MethodById(req.Data[:4])
+	if err != nil || method.Name != "redeem" {
+		return errors.New("forward request doesn't call redeem")
+	}
+	args, err := method.Inputs.Unpack(req.Data[4:])
+	if err != nil {
+		return err
+	}
+	redeemed := *abi.ConvertType(args[0], new(nftlink.NFTLinkNFTVoucher)).(*nftlink.NFTLinkNFTVoucher)
+	if redeemed.Nonce.String() != v.Voucher.Nonce || redeemed.Recipient != v.Voucher.Recipient {
+		return errors.New("forward request redeems another voucher")
+	}
+	return nil
+}
+
+// relay checks the signature of the forward request with the forwarder and
+// sends it, moving the job of the code back into the mint pipeline to wait
+// for the transaction.
+func (m *minter) relay(ctx context.Context, job *mintJob, req *relayRequest) error {
+	forwarder := common.HexToAddress(m.forwarder)
+	request, err := req.Request.forwarderRequest()
+	if err != nil {
+		return err
+	}
+
+	fwd, err := nftlink.NewMinimalForwarder(forwarder, m.client)
+	if err != nil {
+		return err
+	}
+	valid, err := fwd.Verify(&bind.CallOpts{Context: ctx}, request, req.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errBadSignature
+	}
+
+	// only one relay per voucher
+	err = m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		if claim.Status != claimVoucher || claim.JobID != job.ID {
+			return errCodeReserved
+		}
+		claim.Status = claimReserving
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.claims.open.Add(job.Code); err != nil {
+		return err
+	}
+
+	contract := common.HexToAddress(job.Voucher.ContractAddress)
+	_, err = m.transact(ctx, nftlink.MinimalForwarderMetaData, forwarder, func(tx *types.Transaction) error {
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return m.submitted(job, contract, tx.Hash(), raw)
+	}, "execute", request, []byte(req.Signature))
+	if err != nil {
+		// the voucher is still good, the wallet may try again
+		job.State = jobVoucher
+		job.Error = err.Error()
+		m.queue.Update(job)
+		m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+			claim.Status = claimVoucher
+			return nil
+		})
+		return err
+	}
+
+	// a worker waits for the receipt, as for any other mint
+	return m.queue.Requeue(job.ID)
+}
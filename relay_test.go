@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/gorilla/mux"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// forwarderBackend answers every call with valid, as the forwarder's verify
+// would, and mines every transaction it captures into receipt.
+type forwarderBackend struct {
+	*capturingBackend
+	valid   bool
+	receipt *types.Receipt
+}
+
+func (f *forwarderBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	parsed, err := nftlink.MinimalForwarderMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Methods["verify"].Outputs.Pack(f.valid)
+}
+
+func (f *forwarderBackend) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	if f.receipt == nil {
+		return nil, ethereum.NotFound
+	}
+	receipt := *f.receipt
+	receipt.TxHash = hash
+	return &receipt, nil
+}
+
+func (f *forwarderBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(10), BaseFee: big.NewInt(1000000000)}, nil
+}
+
+// redeemCall is the calldata of redeem for the voucher.
+func redeemCall(t *testing.T, v *signedVoucher) []byte {
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redeemed, err := v.Voucher.contractVoucher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := parsed.Pack("redeem", redeemed, []byte(v.Signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCheckForwardRequest(t *testing.T) {
+	m := &minter{gas: &gasEstimator{cap: 300000}}
+	contract := common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	v := &signedVoucher{
+		Voucher:         voucher{Recipient: wallet, URI: "QmToken", Nonce: "4", Expiry: "1700000000"},
+		Signature:       make([]byte, 65),
+		ContractAddress: contract.Hex(),
+	}
+	other := *v
+	other.Voucher.Nonce = "5"
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mint, err := parsed.Pack("safeMint", wallet, "QmToken")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := forwardRequest{From: wallet, To: contract, Value: "0", Gas: "200000", Nonce: "0", Data: redeemCall(t, v)}
+	var cases = []struct {
+		name  string
+		edit  func(r *forwardRequest)
+		valid bool
+	}{
+		{"Redeem", func(r *forwardRequest) {}, true},
+		{"Other contract", func(r *forwardRequest) { r.To = wallet }, false},
+		{"Other wallet", func(r *forwardRequest) { r.From = contract }, false},
+		{"Value", func(r *forwardRequest) { r.Value = "1" }, false},
+		{"Gas above cap", func(r *forwardRequest) { r.Gas = "300001" }, false},
+		{"Invalid gas", func(r *forwardRequest) { r.Gas = "lots" }, false},
+		{"Other method", func(r *forwardRequest) { r.Data = mint }, false},
+		{"Other voucher", func(r *forwardRequest) { r.Data = redeemCall(t, &other) }, false},
+		{"No call", func(r *forwardRequest) { r.Data = nil }, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := valid
+			tc.edit(&r)
+			err := m.checkForwardRequest(r, v)
+			if tc.valid && err != nil {
+				t.Errorf("request refused: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("request accepted")
+			}
+		})
+	}
+}
+
+func TestRelay(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.voucherTTL = time.Hour
+	m.ipfs = &recordingIPFS{}
+	forwarder := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	m.forwarder = forwarder.Hex()
+
+	lot := &campaign{ID: "202203R", Lot: "202203R", Mode: modeVoucher}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: lot.ID})
+	job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	job.Campaign = lot.ID
+	if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.queue.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+	<-m.queue.jobs
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 250000}}}
+	m.client = backend
+	m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 0)
+
+	r := mux.NewRouter()
+	r.Handle("/relay/{id}", &relayer{minter: m})
+	relay := func() *httptest.ResponseRecorder {
+		body, err := json.Marshal(relayRequest{
+			Request: forwardRequest{
+				From:  common.HexToAddress(job.Wallet),
+				To:    common.HexToAddress(m.contractAddress),
+				Value: "0",
+				Gas:   "200000",
+				Nonce: "0",
+				Data:  redeemCall(t, job.Voucher),
+			},
+			Signature: hexutil.Bytes(make([]byte, 65)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/relay/"+job.Code, bytes.NewReader(body)))
+		return rr
+	}
+
+	// the forwarder doesn't recognise the signature, nothing is sent
+	if rr := relay(); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad signature got %v: %s", rr.Code, rr.Body.String())
+	}
+	if len(backend.sent) != 0 {
+		t.Fatalf("sent %d transactions for a bad signature", len(backend.sent))
+	}
+
+	backend.valid = true
+	rr := relay()
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if len(backend.sent) != 1 {
+		t.Fatalf("sent %d transactions, want 1", len(backend.sent))
+	}
+	tx := backend.sent[0]
+	if *tx.To() != forwarder {
+		t.Errorf("sent to %s, want the forwarder %s", tx.To().Hex(), forwarder.Hex())
+	}
+	parsed, err := nftlink.MinimalForwarderMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method, err := parsed.MethodById(tx.Data()[:4]); err != nil || method.Name != "execute" {
+		t.Errorf("sent %v, want execute", method)
+	}
+
+	// only one relay per voucher
+	if rr := relay(); rr.Code != http.StatusConflict {
+		t.Errorf("second relay got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// the redeem failed inside the forwarder, the voucher can be relayed again
+	job, _, err = m.queue.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobSubmitted || job.TxHash != tx.Hash().Hex() {
+		t.Fatalf("job %s not submitted with %s", job.State, tx.Hash().Hex())
+	}
+	backend.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5)}
+	if err := m.processJob(context.Background(), job); err == nil {
+		t.Errorf("redeem without a token succeeded")
+	}
+	claim, _, err := m.claims.Get(job.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobVoucher || claim.Status != claimVoucher {
+		t.Fatalf("job %s and claim %s after a failed redeem, want both back to voucher", job.State, claim.Status)
+	}
+
+	// the token is minted to the wallet
+	if rr := relay(); rr.Code != http.StatusAccepted {
+		t.Fatalf("relaying again returned %v: %s", rr.Code, rr.Body.String())
+	}
+	nftABI, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.receipt.Logs = []*types.Log{{
+		Address: common.HexToAddress(m.contractAddress),
+		Topics: []common.Hash{
+			nftABI.Events["Transfer"].ID,
+			{},
+			common.BytesToHash(common.HexToAddress(job.Wallet).Bytes()),
+			common.BigToHash(big.NewInt(1)),
+		},
+	}}
+	job, _, err = m.queue.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	claim, _, err = m.claims.Get(job.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobConfirmed || !claim.Claimed || claim.TokenID != "1" {
+		t.Errorf("job %s, claim %+v, want token 1 claimed", job.State, claim)
+	}
+}
+
+// forwardTypedData is the EIP-712 form of the request, as the wallet signs it
+// for the MinimalForwarder at forwarder.
+func forwardTypedData(chainID uint64, forwarder common.Address, r forwardRequest) apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"ForwardRequest": {
+				{Name: "from", Type: "address"},
+				{Name: "to", Type: "address"},
+				{Name: "value", Type: "uint256"},
+				{Name: "gas", Type: "uint256"},
+				{Name: "nonce", Type: "uint256"},
+				{Name: "data", Type: "bytes"},
+			},
+		},
+		PrimaryType: "ForwardRequest",
+		Domain: apitypes.TypedDataDomain{
+			Name:              "MinimalForwarder",
+			Version:           "0.0.1",
+			ChainId:           (*math.HexOrDecimal256)(new(big.Int).SetUint64(chainID)),
+			VerifyingContract: forwarder.Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"from":  r.From.Hex(),
+			"to":    r.To.Hex(),
+			"value": r.Value,
+			"gas":   r.Gas,
+			"nonce": r.Nonce,
+			"data":  []byte(r.Data),
+		},
+	}
+}
+
+func TestRelayOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	forwarder := deployBinding(t, m, nftlink.MinimalForwarderMetaData)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	chainID, err := m.client.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.chainID = chainID.Uint64()
+	m.contractAddress = contract.Hex()
+	m.forwarder = forwarder.Hex()
+	m.voucherTTL = time.Hour
+	m.ipfs = &recordingIPFS{}
+	if _, err := m.transact(context.Background(), nftlink.NFTLinkMetaData, contract, nil, "setTrustedForwarder", forwarder); err != nil {
+		t.Fatal(err)
+	}
+
+	// the wallet holds no ETH, it only signs
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := newKeySigner(key)
+
+	lot := &campaign{ID: "202203R", Lot: "202203R", Mode: modeVoucher}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: lot.ID})
+	job := newMintJob("U6fxRAqxMo", wallet.Address().Hex())
+	job.Campaign = lot.ID
+	if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.queue.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+	<-m.queue.jobs
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	// the forwarder only takes the request signed by the wallet
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := forwardRequest{From: wallet.Address(), To: contract, Value: "0", Gas: "300000", Nonce: "0", Data: redeemCall(t, job.Voucher)}
+	var relays = []struct {
+		name   string
+		signer Signer
+		status int
+	}{
+		{"Signed by another key", newKeySigner(otherKey), http.StatusBadRequest},
+		{"Signed by the wallet", wallet, http.StatusAccepted},
+	}
+	r := mux.NewRouter()
+	r.Handle("/relay/{id}", &relayer{minter: m})
+	for _, relay := range relays {
+		signature, err := relay.signer.SignTypedData(forwardTypedData(m.chainID, forwarder, request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(relayRequest{Request: request, Signature: signature})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/relay/"+job.Code, bytes.NewReader(body)))
+		if rr.Code != relay.status {
+			t.Fatalf("%s: handler returned %v: %s, want %v", relay.name, rr.Code, rr.Body.String(), relay.status)
+		}
+	}
+
+	// the forwarder called redeem on behalf of the wallet
+	job, _, err = m.queue.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobConfirmed {
+		t.Fatalf("job %s, want confirmed", job.State)
+	}
+	caller, err := nftlink.NewNFTLinkCaller(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := new(big.Int).SetString(job.TokenID, 10)
+	owner, err := caller.OwnerOf(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != wallet.Address() {
+		t.Errorf("token %v owned by %s, want the wallet %s", id, owner.Hex(), wallet.Address().Hex())
+	}
+	nonce, _ := new(big.Int).SetString(job.Voucher.Voucher.Nonce, 10)
+	if redeemed, err := caller.VoucherRedeemed(nil, nonce); err != nil || !redeemed {
+		t.Errorf("voucher not redeemed: %v", err)
+	}
+}
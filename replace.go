@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// bumpFees replaces the job's stuck transaction with one paying more for the
+// same nonce, and records the replacement on the job and the claim so support
+// can trace every hash that was sent.
+func (m *minter) bumpFees(ctx context.Context, job *mintJob) error {
+	if job.Batch != "" {
+		return m.bumpBatch(ctx, job)
+	}
+	tx, err := m.replace(ctx, job.RawTx)
+	if err != nil {
+		if isNonceError(err) {
+			// the stuck transaction was mined in the meantime
+			return nil
+		}
+		return err
+	}
+
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	job.Replaced = append(job.Replaced, job.TxHash)
+	job.TxHash = tx.Hash().Hex()
+	job.RawTx = hexutil.Encode(raw)
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+
+	return m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		claim.ReplacementTxs = append(claim.ReplacementTxs, job.TxHash)
+		return nil
+	})
+}
+
+// replace signs and sends a copy of the raw stuck transaction with bumped
+// fees and the same nonce.
+func (m *minter) replace(ctx context.Context, rawTx string) (*types.Transaction, error) {
+	raw, err := hexutil.Decode(rawTx)
+	if err != nil {
+		return nil, err
+	}
+	stuck := new(types.Transaction)
+	if err := stuck.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+
+	// the replacement must come from the account holding the nonce
+	key, err := m.keyOf(stuck)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := m.transactor(ctx, key.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &bind.TransactOpts{}
+	if err := m.fees.bump(ctx, m.client, stuck, opts); err != nil {
+		return nil, err
+	}
+
+	var data types.TxData
+	if opts.GasPrice != nil {
+		data = &types.LegacyTx{
+			Nonce:    stuck.Nonce(),
+			GasPrice: opts.GasPrice,
+			Gas:      stuck.Gas(),
+			To:       stuck.To(),
+			Value:    stuck.Value(),
+			Data:     stuck.Data(),
+		}
+	} else {
+		data = &types.DynamicFeeTx{
+			ChainID:   stuck.ChainId(),
+			Nonce:     stuck.Nonce(),
+			GasTipCap: opts.GasTipCap,
+			GasFeeCap: opts.GasFeeCap,
+			Gas:       stuck.Gas(),
+			To:        stuck.To(),
+			Value:     stuck.Value(),
+			Data:      stuck.Data(),
+		}
+	}
+
+	tx, err := auth.Signer(auth.From, types.NewTx(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.client.SendTransaction(ctx, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// royalty is the ERC-2981 royalty paid on secondary sales of the tokens of a
+// campaign.
+type royalty struct {
+	Receiver    string `json:"receiver" yaml:"receiver"`
+	BasisPoints uint16 `json:"basis_points" yaml:"basis_points"` // of the sale price, 10000 being all of it
+}
+
+func (r *royalty) validate() error {
+	if !common.IsHexAddress(r.Receiver) || common.HexToAddress(r.Receiver) == (common.Address{}) {
+		return fmt.Errorf("invalid royalty receiver %q", r.Receiver)
+	}
+	if r.BasisPoints > 10000 {
+		return fmt.Errorf("royalty of %d basis points is above the sale price", r.BasisPoints)
+	}
+	return nil
+}
+
+// setRoyalty sets the royalty of the campaign on the contract, nil for none,
+// and saves it once the transactions are mined. A campaign with a contract
+// of its own makes it the default royalty of the contract, one sharing the
+// contract of its chain sets it on every token it minted so far, and mints
+// the next ones with it.
+func (m *minter) setRoyalty(ctx context.Context, id string, r *royalty) error {
+	stored, err := m.campaigns.Get(id)
+	if err != nil {
+		return err
+	}
+	chain, err := m.on(stored.Chain)
+	if err != nil {
+		return err
+	}
+	c, err := chain.campaign(id)
+	if err != nil {
+		return err
+	}
+	if err := chain.sendRoyalty(ctx, c, r); err != nil {
+		return err
+	}
+
+	// the latest record, the campaign may have changed in the meantime
+	stored, err = m.campaigns.Get(id)
+	if err != nil {
+		return err
+	}
+	stored.Royalty = r
+	return m.campaigns.Save(stored)
+}
+
+// sendRoyalty sets the royalty on the contract of the campaign and waits for
+// the transactions to be mined.
+func (m *minter) sendRoyalty(ctx context.Context, c *campaign, r *royalty) error {
+	contract := common.HexToAddress(c.ContractAddress)
+	if m.ownContract(c) {
+		tx, err := m.transactRoyalty(ctx, contract, nil, r)
+		if err != nil {
+			return err
+		}
+		return m.waitRoyalty(ctx, []*types.Transaction{tx})
+	}
+
+	codes, err := m.campaigns.Codes(c.ID)
+	if err != nil {
+		return err
+	}
+	sent := []*types.Transaction{}
+	for _, code := range codes {
+		claim, found, err := m.claims.Get(code)
+		if err != nil {
+			return err
+		}
+		if !found || claim.TokenID == "" {
+			continue
+		}
+		tokenID, ok := new(big.Int).SetString(claim.TokenID, 10)
+		if !ok {
+			return fmt.Errorf("code %s has an invalid token id %q", code, claim.TokenID)
+		}
+		tx, err := m.transactRoyalty(ctx, contract, tokenID, r)
+		if err != nil {
+			return err
+		}
+		sent = append(sent, tx)
+	}
+	return m.waitRoyalty(ctx, sent)
+}
+
+// ownContract reports whether the campaign mints to a contract other than
+// the one of its chain, whose default royalty is then the campaign's.
+func (m *minter) ownContract(c *campaign) bool {
+	return !strings.EqualFold(c.ContractAddress, m.contractAddress)
+}
+
+// transactRoyalty sets, or removes for a nil royalty, the default royalty of
+// the contract, or the royalty of the token if tokenID isn't nil.
+func (m *minter) transactRoyalty(ctx context.Context, contract common.Address, tokenID *big.Int, r *royalty) (*types.Transaction, error) {
+	switch {
+	case tokenID == nil && r == nil:
+		return m.transact(ctx, nftlink.NFTLinkMetaData, contract, nil, "deleteDefaultRoyalty")
+	case tokenID == nil:
+		return m.transact(ctx, nftlink.NFTLinkMetaData, contract, nil, "setDefaultRoyalty", common.HexToAddress(r.Receiver), big.NewInt(int64(r.BasisPoints)))
+	case r == nil:
+		return m.transact(ctx, nftlink.NFTLinkMetaData, contract, nil, "resetTokenRoyalty", tokenID)
+	default:
+		return m.transact(ctx, nftlink.NFTLinkMetaData, contract, nil, "setTokenRoyalty", tokenID, common.HexToAddress(r.Receiver), big.NewInt(int64(r.BasisPoints)))
+	}
+}
+
+func (m *minter) waitRoyalty(ctx context.Context, sent []*types.Transaction) error {
+	for _, tx := range sent {
+		receipt, err := m.tracker.Wait(ctx, []common.Hash{tx.Hash()})
+		if err != nil {
+			return err
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return fmt.Errorf("transaction %s setting a royalty reverted", tx.Hash().Hex())
+		}
+	}
+	return nil
+}
+
+// admin serves the endpoints changing campaigns, to callers presenting the
+// admin token as a bearer token.
+type admin struct {
+	minter *minter
+	token  string
+}
+
+func (a *admin) authorized(r *http.Request) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return a.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+}
+
+// royaltyHandler sets the royalty of a campaign with PUT, taking a royalty
+// as JSON, and removes it with DELETE.
+func (a *admin) royaltyHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Invalid admin token")
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	var set *royalty // nil removes the royalty
+	switch r.Method {
+	case http.MethodPut:
+		set = &royalty{}
+		if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid royalty: %v", err)
+			return
+		}
+		if err := set.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Use PUT or DELETE")
+		return
+	}
+
+	err := a.minter.setRoyalty(r.Context(), id, set)
+	if errors.Is(err, errCampaignNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	c, err := a.minter.campaigns.Get(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gorilla/mux"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestRoyaltyValidate(t *testing.T) {
+	var cases = []struct {
+		name    string
+		royalty royalty
+		valid   bool
+	}{
+		{"Valid", royalty{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", 500}, true},
+		{"Whole sale price", royalty{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", 10000}, true},
+		{"Above sale price", royalty{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", 10001}, false},
+		{"Invalid receiver", royalty{"0xAb5801", 500}, false},
+		{"Zero receiver", royalty{"0x0000000000000000000000000000000000000000", 500}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.royalty.validate()
+			if tc.valid && err != nil {
+				t.Errorf("royalty refused: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("royalty accepted")
+			}
+		})
+	}
+}
+
+// sentCall is a decoded NFTLink call.
+type sentCall struct {
+	method string
+	args   []interface{}
+}
+
+func sentCalls(t *testing.T, txs []*types.Transaction) []sentCall {
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []sentCall{}
+	for _, tx := range txs {
+		method, err := parsed.MethodById(tx.Data()[:4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := method.Inputs.Unpack(tx.Data()[4:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = append(calls, sentCall{method.Name, args})
+	}
+	return calls
+}
+
+func TestSetRoyalty(t *testing.T) {
+	receiver := common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")
+	var cases = []struct {
+		name     string
+		contract string // of the campaign, empty for the one of the chain
+		royalty  *royalty
+		reverted bool
+		want     []string
+	}{
+		{"Own contract", "0x5FbDB2315678afecb367f032d93F642f64180aa3", &royalty{receiver.Hex(), 750}, false, []string{"setDefaultRoyalty"}},
+		{"Own contract removed", "0x5FbDB2315678afecb367f032d93F642f64180aa3", nil, false, []string{"deleteDefaultRoyalty"}},
+		{"Shared contract", "", &royalty{receiver.Hex(), 750}, false, []string{"setTokenRoyalty", "setTokenRoyalty"}},
+		{"Shared contract removed", "", nil, false, []string{"resetTokenRoyalty", "resetTokenRoyalty"}},
+		// the campaign keeps the royalty the contract has
+		{"Reverted", "0x5FbDB2315678afecb367f032d93F642f64180aa3", &royalty{receiver.Hex(), 750}, true, []string{"setDefaultRoyalty"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			backend := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 50000}}}
+			backend.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5)}
+			if tc.reverted {
+				backend.receipt.Status = types.ReceiptStatusFailed
+			}
+			m.client = backend
+			m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 0)
+
+			lot := &campaign{ID: "202203R", Lot: "202203R", ContractAddress: tc.contract}
+			if err := m.campaigns.Save(lot); err != nil {
+				t.Fatal(err)
+			}
+			// two of the three codes were minted
+			codes := []string{"U6fxRAqxMo", "wKcZ2ceDLs", "Pq9kT3mXvA"}
+			for i, code := range codes {
+				claim := &ClaimPrize{UUID: code, Campaign: lot.ID}
+				if i < 2 {
+					claim.Claimed, claim.Status, claim.TokenID = true, claimFinal, []string{"7", "9"}[i]
+				}
+				store.Set(code, claim)
+			}
+			if err := m.campaigns.SaveCodes(lot.ID, codes); err != nil {
+				t.Fatal(err)
+			}
+
+			err := m.setRoyalty(context.Background(), lot.ID, tc.royalty)
+			if tc.reverted != (err != nil) {
+				t.Fatalf("setRoyalty() = %v, want an error %v", err, tc.reverted)
+			}
+			calls := sentCalls(t, backend.sent)
+			if len(calls) != len(tc.want) {
+				t.Fatalf("sent %d transactions, want %v", len(calls), tc.want)
+			}
+			for i, call := range calls {
+				if call.method != tc.want[i] {
+					t.Errorf("transaction %d calls %s, want %s", i, call.method, tc.want[i])
+				}
+				switch call.method {
+				case "setDefaultRoyalty":
+					if call.args[0].(common.Address) != receiver || call.args[1].(*big.Int).Int64() != 750 {
+						t.Errorf("set default royalty %v", call.args)
+					}
+				case "setTokenRoyalty":
+					if call.args[0].(*big.Int).String() != []string{"7", "9"}[i] || call.args[1].(common.Address) != receiver || call.args[2].(*big.Int).Int64() != 750 {
+						t.Errorf("set token royalty %v", call.args)
+					}
+				}
+			}
+
+			saved, err := m.campaigns.Get(lot.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.royalty
+			if tc.reverted {
+				want = nil
+			}
+			if (saved.Royalty == nil) != (want == nil) || (saved.Royalty != nil && *saved.Royalty != *want) {
+				t.Errorf("campaign saved with royalty %+v, want %+v", saved.Royalty, want)
+			}
+		})
+	}
+}
+
+func TestRoyaltyAdmin(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	backend := &forwarderBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 50000}}}
+	backend.receipt = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(5)}
+	m.client = backend
+	m.tracker = newTxTracker(backend, 1, 10*time.Millisecond, 0)
+	if err := m.campaigns.Save(&campaign{ID: "202203R", ContractAddress: "0x5FbDB2315678afecb367f032d93F642f64180aa3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &admin{minter: m, token: "s3cret"}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/campaigns/{id}/royalty", a.royaltyHandler)
+
+	var cases = []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+		sent   int // transactions in total so far
+	}{
+		{"No token", "PUT", "/admin/campaigns/202203R/royalty", "", `{"receiver":"0x71C7656EC7ab88b098defB751B7401B5f6d8976F","basis_points":500}`, http.StatusUnauthorized, 0},
+		{"Wrong token", "PUT", "/admin/campaigns/202203R/royalty", "guess", `{"receiver":"0x71C7656EC7ab88b098defB751B7401B5f6d8976F","basis_points":500}`, http.StatusUnauthorized, 0},
+		{"Above sale price", "PUT", "/admin/campaigns/202203R/royalty", "s3cret", `{"receiver":"0x71C7656EC7ab88b098defB751B7401B5f6d8976F","basis_points":12000}`, http.StatusBadRequest, 0},
+		{"Unknown campaign", "PUT", "/admin/campaigns/nope/royalty", "s3cret", `{"receiver":"0x71C7656EC7ab88b098defB751B7401B5f6d8976F","basis_points":500}`, http.StatusNotFound, 0},
+		{"Wrong method", "POST", "/admin/campaigns/202203R/royalty", "s3cret", ``, http.StatusMethodNotAllowed, 0},
+		{"Set", "PUT", "/admin/campaigns/202203R/royalty", "s3cret", `{"receiver":"0x71C7656EC7ab88b098defB751B7401B5f6d8976F","basis_points":500}`, http.StatusOK, 1},
+		{"Remove", "DELETE", "/admin/campaigns/202203R/royalty", "s3cret", ``, http.StatusOK, 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tc.status {
+				t.Errorf("handler returned %v, want %v: %s", rr.Code, tc.status, rr.Body.String())
+			}
+			if len(backend.sent) != tc.sent {
+				t.Errorf("sent %d transactions, want %d", len(backend.sent), tc.sent)
+			}
+		})
+	}
+}
+
+func TestRoyaltyOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	shared := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	own := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = shared.Hex()
+
+	// two tokens of the shared contract were minted for the campaign
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	tokens := []string{}
+	for i := 0; i < 2; i++ {
+		tx, err := m.mint(context.Background(), shared, wallet, "QmToken", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receipt, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := m.mintedToken(shared, receipt, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, id.String())
+	}
+	codes := []string{"U6fxRAqxMo", "wKcZ2ceDLs"}
+	for _, lot := range []*campaign{{ID: "202203R", Lot: "202203R"}, {ID: "202204R", Lot: "202204R", ContractAddress: own.Hex()}} {
+		if err := m.campaigns.Save(lot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, code := range codes {
+		store.Set(code, &ClaimPrize{UUID: code, Campaign: "202203R", Claimed: true, Status: claimFinal, TokenID: tokens[i]})
+	}
+	if err := m.campaigns.SaveCodes("202203R", codes); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")
+	other := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	if err := m.setRoyalty(context.Background(), "202203R", &royalty{receiver.Hex(), 750}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setRoyalty(context.Background(), "202204R", &royalty{other.Hex(), 250}); err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens minted from now on carry it from the start
+	lot, err := m.campaign("202203R")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, method, args, err := m.mintCall(context.Background(), lot, []*mintJob{{Wallet: wallet.Hex(), TokenURI: "QmToken"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := m.transactWith(context.Background(), m.mintKey(shared), meta, shared, nil, method, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	minted, err := m.mintedToken(shared, receipt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		name     string
+		contract common.Address
+		token    string
+		receiver common.Address
+		amount   int64 // of a sale of 10000 wei
+	}{
+		{"Token of the campaign", shared, tokens[0], receiver, 750},
+		{"Other token of the campaign", shared, tokens[1], receiver, 750},
+		{"Token minted after", shared, minted.String(), receiver, 750},
+		{"Token of no campaign", shared, "1000", common.Address{}, 0},
+		{"Default of the own contract", own, "1000", other, 250},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			caller, err := nftlink.NewNFTLinkCaller(tc.contract, m.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := new(big.Int).SetString(tc.token, 10)
+			info, err := caller.RoyaltyInfo(nil, id, big.NewInt(10000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Receiver != tc.receiver || info.RoyaltyAmount.Int64() != tc.amount {
+				t.Errorf("royalty of token %s is %v to %s, want %d to %s", tc.token, info.RoyaltyAmount, info.Receiver.Hex(), tc.amount, tc.receiver.Hex())
+			}
+		})
+	}
+
+	// removed, the default royalty pays nothing
+	if err := m.setRoyalty(context.Background(), "202204R", nil); err != nil {
+		t.Fatal(err)
+	}
+	caller, err := nftlink.NewNFTLinkCaller(own, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := caller.RoyaltyInfo(nil, big.NewInt(1000), big.NewInt(10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Receiver != (common.Address{}) || info.RoyaltyAmount.Sign() != 0 {
+		t.Errorf("royalty after removing it is %v to %s", info.RoyaltyAmount, info.Receiver.Hex())
+	}
+}
@@ -13,6 +13,14 @@ async function main() {
   // manually to make sure everything is compiled
   // await hre.run('compile');
 
+  // The forwarder relays gasless redeems, the server's forwarder_address
+  const MinimalForwarder = await ethers.getContractFactory("MinimalForwarder");
+  const forwarder = await MinimalForwarder.deploy();
+
+  await forwarder.deployed();
+
+  console.log("MinimalForwarder deployed to:", forwarder.address);
+
   // We get the contract to deploy
   const NFTLink = await ethers.getContractFactory("NFTLink");
   const nftlink = await NFTLink.deploy();
@@ -20,6 +28,17 @@ async function main() {
   await nftlink.deployed();
 
   console.log("NFTLink deployed to:", nftlink.address);
+
+  // NFTLink takes the wallet signing a forwarded redeem as its caller
+  await (await nftlink.setTrustedForwarder(forwarder.address)).wait();
+
+  // and the ERC-1155 contract edition campaigns mint their units on
+  const NFTLinkEditions = await ethers.getContractFactory("NFTLinkEditions");
+  const editions = await NFTLinkEditions.deploy();
+
+  await editions.deployed();
+
+  console.log("NFTLinkEditions deployed to:", editions.address);
 }
 
 // We recommend this pattern to be able to use async/await everywhere
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/external"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Signer signs the mint transactions of one account. The key may live in
+// memory or behind an external signer the server never sees it from.
+type Signer interface {
+	Address() common.Address
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+	// SignTypedData returns the EIP-712 signature of data, V being 27 or 28
+	// as ecrecover in contracts expects.
+	SignTypedData(data apitypes.TypedData) ([]byte, error)
+}
+
+// keySigner signs with a private key held in memory, either given in the
+// config or decrypted from a keystore file at startup.
+type keySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func newKeySigner(key *ecdsa.PrivateKey) *keySigner {
+	return &keySigner{key: key}
+}
+
+// newHexKeySigner takes a hex encoded private key, as in the private_key setting.
+func newHexKeySigner(hexKey string) (*keySigner, error) {
+	key, err := crypto.HexToECDSA(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	return newKeySigner(key), nil
+}
+
+// loadKeystore decrypts a go-ethereum JSON keystore file.
+func loadKeystore(path string, passphrase string) (*keySigner, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keystore.DecryptKey(b, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting keystore %s: %v", path, err)
+	}
+	return newKeySigner(key.PrivateKey), nil
+}
+
+func (s *keySigner) Address() common.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *keySigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), s.key)
+}
+
+func (s *keySigner) SignTypedData(data apitypes.TypedData) ([]byte, error) {
+	hash, err := typedDataHash(data)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(hash, s.key)
+	if err != nil {
+		return nil, err
+	}
+	sig[64] += 27
+	return sig, nil
+}
+
+// externalSigner asks a clef compatible signer to sign every transaction
+// over JSON-RPC (account_signTransaction), and typed data with
+// account_signTypedData.
+type externalSigner struct {
+	signer  *external.ExternalSigner
+	client  *rpc.Client // ExternalSigner has no typed data signing
+	account accounts.Account
+}
+
+// dialExternalSigner connects to the signer at endpoint. If address is empty
+// the first account the signer lists is used.
+func dialExternalSigner(endpoint string, address string) (*externalSigner, error) {
+	signer, err := external.NewExternalSigner(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client, err := rpc.Dial(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if address != "" {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid signer address %q", address)
+		}
+		return &externalSigner{signer: signer, client: client, account: accounts.Account{Address: common.HexToAddress(address)}}, nil
+	}
+	accounts := signer.Accounts()
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("external signer %s has no accounts", endpoint)
+	}
+	return &externalSigner{signer: signer, client: client, account: accounts[0]}, nil
+}
+
+func (s *externalSigner) Address() common.Address {
+	return s.account.Address
+}
+
+func (s *externalSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return s.signer.SignTx(s.account, tx, chainID)
+}
+
+func (s *externalSigner) SignTypedData(data apitypes.TypedData) ([]byte, error) {
+	var sig hexutil.Bytes
+	address := common.NewMixedcaseAddress(s.account.Address)
+	if err := s.client.Call(&sig, "account_signTypedData", &address, data); err != nil {
+		return nil, err
+	}
+	if len(sig) != 65 {
+		return nil, fmt.Errorf("external signer returned a %d byte signature", len(sig))
+	}
+	return sig, nil
+}
+
+// signerTransactor returns transact options signing with s for the chain.
+func signerTransactor(s Signer, chainID *big.Int) *bind.TransactOpts {
+	from := s.Address()
+	return &bind.TransactOpts{
+		From: from,
+		Signer: func(address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != from {
+				return nil, bind.ErrNotAuthorized
+			}
+			return s.SignTx(tx, chainID)
+		},
+	}
+}
+
+// signer returns the signer of the profile: a PKCS#11 token, an external
+// signer, a keystore file or a raw private key.
+func (p chainProfile) signer() (Signer, error) {
+	set := 0
+	for _, v := range []string{p.PKCS11Module, p.ExternalSigner, p.Keystore, p.PrivateKey} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("set only one of pkcs11_module, external_signer, keystore and private_key")
+	}
+
+	switch {
+	case p.PKCS11Module != "":
+		pin, err := secret(p.PKCS11Pin, p.PKCS11PinFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := openPKCS11Signer(p.PKCS11Module, p.PKCS11Slot, p.PKCS11Label, pin)
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	case p.ExternalSigner != "":
+		return dialExternalSigner(p.ExternalSigner, p.SignerAddress)
+	case p.Keystore != "":
+		passphrase, err := secret(p.KeystorePassphrase, p.KeystorePassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return loadKeystore(p.Keystore, passphrase)
+	case p.PrivateKey != "":
+		return newHexKeySigner(p.PrivateKey)
+	}
+	return nil, errors.New("no signer configured, set pkcs11_module, external_signer, keystore or private_key")
+}
+
+// secret returns the contents of file if set, so passphrases and PINs can be
+// mounted as files instead of being passed in the environment.
+func secret(value string, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
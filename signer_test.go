@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// fakeClef answers the account_ methods of clef used by the external signer,
+// signing everything with key.
+type fakeClef struct {
+	key    *ecdsa.PrivateKey
+	signed int
+}
+
+func (c *fakeClef) Version() string {
+	return "6.0.0"
+}
+
+func (c *fakeClef) List() []common.Address {
+	return []common.Address{crypto.PubkeyToAddress(c.key.PublicKey)}
+}
+
+func (c *fakeClef) SignTransaction(args apitypes.SendTxArgs) (map[string]interface{}, error) {
+	if args.From.Address() != crypto.PubkeyToAddress(c.key.PublicKey) {
+		return nil, errors.New("unknown account")
+	}
+	if args.ChainID == nil {
+		return nil, errors.New("no chain id")
+	}
+	tx, err := types.SignTx(args.ToTransaction(), types.LatestSignerForChainID((*big.Int)(args.ChainID)), c.key)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	c.signed++
+	return map[string]interface{}{"raw": hexutil.Bytes(raw), "tx": tx}, nil
+}
+
+func (c *fakeClef) SignTypedData(address common.MixedcaseAddress, data apitypes.TypedData) (hexutil.Bytes, error) {
+	if address.Address() != crypto.PubkeyToAddress(c.key.PublicKey) {
+		return nil, errors.New("unknown account")
+	}
+	return newKeySigner(c.key).SignTypedData(data)
+}
+
+func newFakeClef(t *testing.T, key *ecdsa.PrivateKey) (*fakeClef, string) {
+	clef := &fakeClef{key: key}
+	server := rpc.NewServer()
+	if err := server.RegisterName("account", clef); err != nil {
+		t.Fatal(err)
+	}
+	http := httptest.NewServer(server)
+	t.Cleanup(func() {
+		http.Close()
+		server.Stop()
+	})
+	return clef, http.URL
+}
+
+func TestKeystoreSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	dir := t.TempDir()
+	account, err := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP).ImportECDSA(key, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := account.URL.Path
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(passphraseFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		profile chainProfile
+		valid   bool
+	}{
+		{"Passphrase", chainProfile{Keystore: path, KeystorePassphrase: "correct horse"}, true},
+		{"Passphrase file", chainProfile{Keystore: path, KeystorePassphraseFile: passphraseFile}, true},
+		{"Wrong passphrase", chainProfile{Keystore: path, KeystorePassphrase: "battery staple"}, false},
+		{"Missing keystore", chainProfile{Keystore: filepath.Join(dir, "missing.json")}, false},
+		{"Two signers", chainProfile{Keystore: path, KeystorePassphrase: "correct horse", PrivateKey: "0123"}, false},
+		{"No signer", chainProfile{}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, err := tc.profile.signer()
+			if !tc.valid {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signer.Address() != address {
+				t.Errorf("signer is %s, expected %s", signer.Address().Hex(), address.Hex())
+			}
+		})
+	}
+}
+
+func TestExternalSigner(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	// the contract owner's key now only lives in the signer
+	owner := m.signer.(*keySigner).key
+	clef, url := newFakeClef(t, owner)
+
+	if _, err := dialExternalSigner(url, "0xAb58"); err == nil {
+		t.Error("expected an invalid signer address to be rejected")
+	}
+	signer, err := (chainProfile{ExternalSigner: url}).signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Address() != crypto.PubkeyToAddress(owner.PublicKey) {
+		t.Fatalf("signer is %s, expected the first account of the signer", signer.Address().Hex())
+	}
+	m.signer = signer
+
+	wallet := common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), wallet, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	m.client.(*SimulatedBackend).Commit()
+
+	if clef.signed != 1 {
+		t.Errorf("signer signed %d transactions, expected 1", clef.signed)
+	}
+	nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(m.contractAddress), m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := nftcontract.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Int64() != 1 {
+		t.Errorf("minted %v tokens, expected 1", count)
+	}
+}
+
+func TestSignTypedData(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, url := newFakeClef(t, key)
+	external, err := dialExternalSigner(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &signedVoucher{
+		Voucher: voucher{
+			Recipient: common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"),
+			URI:       "QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5",
+			Nonce:     "1",
+			Expiry:    "1700000000",
+		},
+		ChainID:         1337,
+		ContractAddress: "0x71C7656EC7ab88b098defB751B7401B5f6d8976F",
+	}
+	for name, signer := range map[string]Signer{"key": newKeySigner(key), "external": external} {
+		t.Run(name, func(t *testing.T) {
+			v.Signature, err = signer.SignTypedData(v.Voucher.typedData(v.ChainID, common.HexToAddress(v.ContractAddress)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := v.Signature[64]; v != 27 && v != 28 {
+				t.Errorf("signature has V %d, expected 27 or 28", v)
+			}
+			recovered, err := voucherSigner(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recovered != crypto.PubkeyToAddress(key.PublicKey) {
+				t.Errorf("voucher signed by %s, expected %s", recovered.Hex(), crypto.PubkeyToAddress(key.PublicKey).Hex())
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"math/big"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
@@ -30,6 +31,9 @@ type SimulatedBackend struct {
 	backends.SimulatedBackend
 	faucetKey  *ecdsa.PrivateKey
 	faucetAddr common.Address
+
+	mu     sync.Mutex
+	future map[common.Address]map[uint64]*types.Transaction // transactions waiting for a nonce gap to be filled
 }
 
 func NewSimulatedBackend() *SimulatedBackend {
@@ -50,7 +54,12 @@ func NewSimulatedBackend() *SimulatedBackend {
 		faucetAddr:                       {Balance: new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(9))},
 	}
 	alloc := core.GenesisAlloc(addr)
-	return &SimulatedBackend{*backends.NewSimulatedBackend(alloc, 8000000), sk, faucetAddr}
+	return &SimulatedBackend{
+		SimulatedBackend: *backends.NewSimulatedBackend(alloc, 8000000),
+		faucetKey:        sk,
+		faucetAddr:       faucetAddr,
+		future:           make(map[common.Address]map[uint64]*types.Transaction),
+	}
 }
 
 func (s *SimulatedBackend) BlockByNumber(_ context.Context, number *big.Int) (*types.Block, error) {
@@ -64,11 +73,42 @@ func (s *SimulatedBackend) BlockByNumber(_ context.Context, number *big.Int) (*t
 	return block, nil
 }
 
+// SendTransaction mines the transaction right away. Like a real node it
+// rejects used nonces and holds transactions with a future nonce until the gap
+// before them is filled, where the embedded backend would just panic.
 func (s *SimulatedBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
-	if err := s.SimulatedBackend.SendTransaction(ctx, tx); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	nonce, err := s.PendingNonceAt(ctx, sender)
+	if err != nil {
 		return errors.WithStack(err)
 	}
-	s.Commit()
+	if tx.Nonce() < nonce {
+		return errors.WithStack(core.ErrNonceTooLow)
+	}
+	if tx.Nonce() > nonce {
+		if s.future[sender] == nil {
+			s.future[sender] = make(map[uint64]*types.Transaction)
+		}
+		s.future[sender][tx.Nonce()] = tx
+		return nil
+	}
+
+	for tx != nil {
+		if err := s.SimulatedBackend.SendTransaction(ctx, tx); err != nil {
+			return errors.WithStack(err)
+		}
+		s.Commit()
+
+		next := tx.Nonce() + 1
+		tx = s.future[sender][next]
+		delete(s.future[sender], next)
+	}
 	return nil
 }
 
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// The overloads of safeMint and safeMintBatch taking a soulbound flag, which
+// the bindings tell apart from the older ones with a 0 suffix.
+const (
+	safeMintSoulbound      = "safeMint0"
+	safeMintBatchSoulbound = "safeMintBatch0"
+)
+
+// erc5192 is the interface ID of EIP-5192, implemented by contracts that can
+// mint soulbound tokens.
+var erc5192 = [4]byte{0xb4, 0x5a, 0x3c, 0x0e}
+
+// mintsSoulbound reports whether the contract can mint soulbound tokens,
+// contracts deployed before NFTLink could revert every mint of a soulbound
+// campaign.
+func (m *minter) mintsSoulbound(ctx context.Context, contract common.Address) (bool, error) {
+	caller, err := nftlink.NewNFTLinkCaller(contract, m.client)
+	if err != nil {
+		return false, err
+	}
+	return caller.SupportsInterface(&bind.CallOpts{Context: ctx}, erc5192)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+func TestSoulboundMints(t *testing.T) {
+	wallets := []string{"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "0x71C7656EC7ab88b098defB751B7401B5f6d8976F"}
+	paid := &royalty{"0x71C7656EC7ab88b098defB751B7401B5f6d8976F", 750}
+	var cases = []struct {
+		name      string
+		soulbound bool
+		royalty   *royalty
+		contract  string // of the campaign, empty for the one of the chain
+		jobs      int
+		want      string
+	}{
+		{"Transferable", false, nil, "", 1, "safeMint"},
+		{"Soulbound", true, nil, "", 1, safeMintSoulbound},
+		{"Transferable batch", false, nil, "", 2, "safeMintBatch"},
+		{"Soulbound batch", true, nil, "", 2, safeMintBatchSoulbound},
+		// tokens of the contract of the chain carry the royalty of their lot
+		{"Royalty", false, paid, "", 1, "safeMintWithRoyalty"},
+		{"Soulbound batch with royalty", true, paid, "", 2, "safeMintBatchWithRoyalty"},
+		// the default royalty of a contract of its own pays it
+		{"Royalty of the contract", false, paid, "0x5FbDB2315678afecb367f032d93F642f64180aa3", 1, "safeMint"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			backend := &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 500000}}
+			m.client = backend
+			lot := &campaign{ID: "202203R", Soulbound: tc.soulbound, Royalty: tc.royalty, ContractAddress: tc.contract}
+			if err := m.campaigns.Save(lot); err != nil {
+				t.Fatal(err)
+			}
+			contract := common.HexToAddress(m.contractAddress)
+			if tc.contract != "" {
+				contract = common.HexToAddress(tc.contract)
+			}
+
+			jobs := []*mintJob{}
+			for i, code := range []string{"U6fxRAqxMo", "wKcZ2ceDLs"}[:tc.jobs] {
+				store.Set(code, &ClaimPrize{UUID: code, Campaign: "202203R"})
+				job := newMintJob(code, wallets[i])
+				job.Campaign, job.TokenURI = "202203R", "Qm"+code
+				jobs = append(jobs, job)
+			}
+			if err := m.mintJobs(context.Background(), contract, jobs); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := sentCalls(t, backend.sent)
+			if len(calls) != 1 || calls[0].method != tc.want {
+				t.Fatalf("sent %v, want one %s", calls, tc.want)
+			}
+			args := calls[0].args
+			if tc.royalty != nil && len(args) == 5 {
+				if args[3].(common.Address) != common.HexToAddress(tc.royalty.Receiver) || args[4].(*big.Int).Int64() != int64(tc.royalty.BasisPoints) {
+					t.Errorf("%s paying %v, want %+v", tc.want, args[3:], tc.royalty)
+				}
+				args = args[:3]
+			}
+			if tc.soulbound && !args[len(args)-1].(bool) {
+				t.Errorf("%s not soulbound: %v", tc.want, args)
+			}
+		})
+	}
+}
+
+func TestSoulboundOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = contract.Hex()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := crypto.PubkeyToAddress(key.PublicKey)
+	m.client.(*SimulatedBackend).FundAddress(context.Background(), holder)
+	chainID, err := m.client.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nft, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")
+
+	var cases = []struct {
+		name      string
+		soulbound bool
+		revert    string // of a transfer, empty if it goes through
+	}{
+		{"Transferable", false, ""},
+		{"Soulbound", true, "NFTLink: token is soulbound"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			lot := &campaign{ID: "202203R", Soulbound: tc.soulbound, ContractAddress: contract.Hex()}
+			meta, method, args, err := m.mintCall(context.Background(), lot, []*mintJob{{Wallet: holder.Hex(), TokenURI: "QmToken"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx, err := m.transactWith(context.Background(), m.mintKey(contract), meta, contract, nil, method, args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receipt, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := m.mintedToken(contract, receipt, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked, err := nft.Locked(nil, id); err != nil || locked != tc.soulbound {
+				t.Errorf("token %v locked = %v, want %v: %v", id, locked, tc.soulbound, err)
+			}
+
+			_, err = nft.TransferFrom(auth, holder, other, id)
+			if tc.revert == "" && err != nil {
+				t.Fatalf("transfer reverted: %v", err)
+			}
+			if tc.revert != "" && (err == nil || !strings.Contains(err.Error(), tc.revert)) {
+				t.Fatalf("transfer returned %v, want a revert with %q", err, tc.revert)
+			}
+			want := holder
+			if tc.revert == "" {
+				want = other
+			}
+			if owner, err := nft.OwnerOf(nil, id); err != nil || owner != want {
+				t.Errorf("token %v owned by %s, want %s: %v", id, owner.Hex(), want.Hex(), err)
+			}
+
+			// the holder can always burn it to redeem its reward
+			if tc.soulbound {
+				if _, err := nft.Burn(auth, id); err != nil {
+					t.Errorf("burning a soulbound token reverted: %v", err)
+				}
+			}
+		})
+	}
+}
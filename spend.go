@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/philippgille/gokv"
+)
+
+var (
+	errLowBalance       = errors.New("signer balance is below the minimum")
+	errDailySpendCap    = errors.New("daily gas spend cap reached")
+	errCampaignSpendCap = errors.New("campaign gas spend cap reached")
+)
+
+// alerter tells the operators about trouble with the hot wallets, in the log
+// and, if configured, by posting to a webhook.
+type alerter struct {
+	webhook string
+	client  *http.Client
+}
+
+func newAlerter(webhook string) *alerter {
+	return &alerter{webhook: webhook, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type alert struct {
+	Event   string    `json:"event"`
+	Chain   string    `json:"chain,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Send logs the alert and posts it to the webhook in the background.
+func (a *alerter) Send(event string, chain string, message string) {
+	log.Printf("ALERT %s: %s", event, message)
+	if a == nil || a.webhook == "" {
+		return
+	}
+
+	b, err := json.Marshal(alert{Event: event, Chain: chain, Message: message, Time: time.Now().UTC()})
+	if err != nil {
+		log.Printf("encoding alert: %v", err)
+		return
+	}
+	go func() {
+		resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(b))
+		if err != nil {
+			log.Printf("posting alert %s: %v", event, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("posting alert %s: webhook returned %s", event, resp.Status)
+		}
+	}()
+}
+
+// spendGuard keeps a chain's hot wallets from running dry: it tracks the
+// balance and the gas spent per day of every key sending transactions, and
+// the gas spent per campaign, and stops new mints when they cross a limit.
+type spendGuard struct {
+	chain      string
+	client     ethBackend
+	accounts   []common.Address // the owner and the keys of the minter pool
+	store      gokv.Store
+	alerts     *alerter
+	minBalance *big.Int // wei, nil for no minimum
+	dailyCap   *big.Int // wei per key, nil for no cap
+
+	mu       sync.Mutex
+	balances map[common.Address]*big.Int // as last read from the chain
+	tripped  map[string]bool
+}
+
+func newSpendGuard(chain string, client ethBackend, accounts []common.Address, store gokv.Store, alerts *alerter, minBalance *big.Int, dailyCap *big.Int) *spendGuard {
+	return &spendGuard{
+		chain:      chain,
+		client:     client,
+		accounts:   accounts,
+		store:      store,
+		alerts:     alerts,
+		minBalance: minBalance,
+		dailyCap:   dailyCap,
+		balances:   map[common.Address]*big.Int{},
+		tripped:    map[string]bool{},
+	}
+}
+
+// Run refreshes the balances now and then every interval, until ctx is
+// cancelled.
+func (g *spendGuard) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.Refresh(ctx); err != nil {
+			log.Printf("reading the balances of chain %q: %v", g.chain, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh reads the balance of every account from the chain. An account
+// that can't be read keeps its last balance.
+func (g *spendGuard) Refresh(ctx context.Context) error {
+	var failed error
+	for _, account := range g.accounts {
+		balance, err := g.client.BalanceAt(ctx, account, nil)
+		if err != nil {
+			failed = fmt.Errorf("%s: %v", account.Hex(), err)
+			continue
+		}
+
+		g.mu.Lock()
+		g.setBalance(account, balance, fmt.Sprintf("balance of %s is back to %v wei", account.Hex(), balance))
+		g.mu.Unlock()
+	}
+	return failed
+}
+
+// setBalance records the balance of account, alerting when it crosses the
+// minimum. Called with g.mu held.
+func (g *spendGuard) setBalance(account common.Address, balance *big.Int, recovered string) {
+	g.balances[account] = balance
+	if g.minBalance != nil {
+		g.trip("low_balance/"+account.Hex(), "low_balance", balance.Cmp(g.minBalance) < 0,
+			fmt.Sprintf("balance of %s is %v wei, below the minimum of %v", account.Hex(), balance, g.minBalance),
+			recovered)
+	}
+}
+
+// trip records whether the limit under key is crossed, alerting when that
+// changes. Called with g.mu held.
+func (g *spendGuard) trip(key string, event string, crossed bool, message string, recovered string) {
+	if crossed == g.tripped[key] {
+		return
+	}
+	g.tripped[key] = crossed
+	if crossed {
+		g.alerts.Send(event, g.chain, message)
+	} else if recovered != "" {
+		g.alerts.Send(event+"_recovered", g.chain, recovered)
+	}
+}
+
+// Allow reports whether a code of the campaign may be minted now by one of
+// the accounts. A nil guard allows everything.
+func (g *spendGuard) Allow(c *campaign, accounts ...common.Address) error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if c.SpendCap != 0 {
+		spent, err := g.spent(campaignSpendKey(c.ID))
+		if err != nil {
+			return err
+		}
+		if spent.Cmp(gwei(c.SpendCap)) >= 0 {
+			return errCampaignSpendCap
+		}
+	}
+
+	// one key able to pay is enough, the others are skipped
+	var paused error
+	for _, account := range accounts {
+		if paused = g.check(account); paused == nil {
+			return nil
+		}
+	}
+	return paused
+}
+
+// Usable reports whether account may send mints now. A nil guard allows
+// every account.
+func (g *spendGuard) Usable(account common.Address) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.check(account) == nil
+}
+
+// check returns why account can't pay for mints, nil if it can. Called with
+// g.mu held.
+func (g *spendGuard) check(account common.Address) error {
+	if balance := g.balances[account]; g.minBalance != nil && balance != nil && balance.Cmp(g.minBalance) < 0 {
+		return errLowBalance
+	}
+	if g.dailyCap != nil {
+		spent, err := g.spent(g.dailyKey(account, time.Now()))
+		if err != nil {
+			return err
+		}
+		if spent.Cmp(g.dailyCap) >= 0 {
+			return errDailySpendCap
+		}
+	}
+	return nil
+}
+
+// Record adds what the transaction of the receipt cost to the day's spend of
+// the key that sent it, to the campaign's spend and to the known balance of
+// the key.
+func (g *spendGuard) Record(ctx context.Context, c *campaign, receipt *types.Receipt) error {
+	if g == nil {
+		return nil
+	}
+	tx, _, err := g.client.TransactionByHash(ctx, receipt.TxHash)
+	if err != nil {
+		return err
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return err
+	}
+	cost, err := txCost(ctx, g.client, tx, receipt)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	day := g.dailyKey(from, time.Now())
+	daily, err := g.add(day, cost)
+	if err != nil {
+		return err
+	}
+	if g.dailyCap != nil && daily.Cmp(g.dailyCap) >= 0 {
+		g.trip(day, "daily_spend_cap", true,
+			fmt.Sprintf("%s spent %v wei on gas today, the daily cap is %v", from.Hex(), daily, g.dailyCap), "")
+	}
+
+	if c.ID != "" {
+		spent, err := g.add(campaignSpendKey(c.ID), cost)
+		if err != nil {
+			return err
+		}
+		if c.SpendCap != 0 && spent.Cmp(gwei(c.SpendCap)) >= 0 {
+			g.trip(campaignSpendKey(c.ID), "campaign_spend_cap", true,
+				fmt.Sprintf("campaign %s spent %v wei on gas, its cap is %v", c.ID, spent, gwei(c.SpendCap)), "")
+		}
+	}
+
+	if balance := g.balances[from]; balance != nil {
+		g.setBalance(from, new(big.Int).Sub(balance, cost), "")
+	}
+	return nil
+}
+
+// dailyKey is the spend counter of account on the chain for the UTC day of
+// t. The daily cap resets by moving on to a new key.
+func (g *spendGuard) dailyKey(account common.Address, t time.Time) string {
+	chain := g.chain
+	if chain == "" {
+		chain = "default"
+	}
+	return "spend/" + chain + "/" + account.Hex() + "/" + t.UTC().Format("2006-01-02")
+}
+
+func campaignSpendKey(id string) string {
+	return "spend/campaign/" + id
+}
+
+// spent reads a spend counter, kept as a decimal string of wei. Called with
+// g.mu held.
+func (g *spendGuard) spent(key string) (*big.Int, error) {
+	var s string
+	found, err := g.store.Get(key, &s)
+	if err != nil || !found {
+		return new(big.Int), err
+	}
+	return parseSpend(key, s)
+}
+
+func parseSpend(key string, s string) (*big.Int, error) {
+	spent, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid spend %q in %s", s, key)
+	}
+	return spent, nil
+}
+
+// add increases a spend counter and returns its new value. Other instances
+// record spend too, so it's updated atomically. Called with g.mu held.
+func (g *spendGuard) add(key string, cost *big.Int) (*big.Int, error) {
+	var s string
+	spent := new(big.Int)
+	err := storeUpdate(g.store, key, &s, func(found bool) error {
+		spent.SetInt64(0)
+		if found {
+			parsed, err := parseSpend(key, s)
+			if err != nil {
+				return err
+			}
+			spent.Set(parsed)
+		}
+		spent.Add(spent, cost)
+		s = spent.String()
+		return nil
+	})
+	return spent, err
+}
+
+// txCost returns what tx paid for gas, as mined in receipt. Receipts
+// don't carry the effective gas price yet, so it's worked out from the
+// transaction and the base fee of its block.
+func txCost(ctx context.Context, client ethBackend, tx *types.Transaction, receipt *types.Receipt) (*big.Int, error) {
+	price := tx.GasPrice()
+	if tx.Type() == types.DynamicFeeTxType {
+		head, err := client.HeaderByNumber(ctx, receipt.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
+		price = new(big.Int).Add(head.BaseFee, tx.GasTipCap())
+		if price.Cmp(tx.GasFeeCap()) > 0 {
+			price = tx.GasFeeCap()
+		}
+	}
+	return new(big.Int).Mul(price, new(big.Int).SetUint64(receipt.GasUsed)), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// newAlertWebhook returns an alerter posting to a test server, and the
+// channel the server delivers the alerts to.
+func newAlertWebhook(t *testing.T) (*alerter, <-chan alert) {
+	alerts := make(chan alert, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := alert{}
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		alerts <- a
+	}))
+	t.Cleanup(server.Close)
+	return newAlerter(server.URL), alerts
+}
+
+func expectAlert(t *testing.T, alerts <-chan alert, event string) {
+	t.Helper()
+	select {
+	case a := <-alerts:
+		if a.Event != event {
+			t.Errorf("got alert %q (%s), expected %q", a.Event, a.Message, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no %q alert", event)
+	}
+}
+
+func TestLowBalance(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	alerter, alerts := newAlertWebhook(t)
+
+	// the signer was funded with about 18 ETH
+	m.guard = newSpendGuard("", m.client, []common.Address{m.signer.Address()}, store, alerter, gwei(100000000000), nil)
+	if err := m.guard.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert(t, alerts, "low_balance")
+
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Body.String() != "Minting is temporarily unavailable, please try again later" {
+		t.Errorf("handler returned %v: %s", rr.Code, rr.Body.String())
+	}
+	claim, _, err := m.claims.Get("U6fxRAqxMo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.Status != claimAvailable {
+		t.Errorf("refused code is %q, expected it to stay available", claim.Status)
+	}
+
+	// topped up, or in this case the threshold lowered
+	m.guard.minBalance = gwei(1000000000)
+	if err := m.guard.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert(t, alerts, "low_balance_recovered")
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("handler returned %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSpendCaps(t *testing.T) {
+	var tests = []struct {
+		name     string
+		dailyCap int64 // gwei
+		spendCap int64 // gwei
+		expected error
+		event    string
+	}{
+		{"No caps", 0, 0, nil, ""},
+		{"Under the caps", 100000000, 100000000, nil, ""},
+		{"Daily cap", 1, 0, errDailySpendCap, "daily_spend_cap"},
+		{"Campaign cap", 0, 1, errCampaignSpendCap, "campaign_spend_cap"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			alerter, alerts := newAlertWebhook(t)
+			m.guard = newSpendGuard("", m.client, []common.Address{m.signer.Address()}, store, alerter, nil, gwei(tc.dailyCap))
+
+			lot := &campaign{ID: "202203R", SpendCap: tc.spendCap}
+			if err := m.campaigns.Save(lot); err != nil {
+				t.Fatal(err)
+			}
+			for _, code := range []string{"U6fxRAqxMo", "Nq3Lp0ZsWd"} {
+				store.Set(code, &ClaimPrize{UUID: code, Campaign: lot.ID})
+			}
+
+			job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+			job.Campaign = lot.ID
+			if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.processJob(context.Background(), job); err != nil {
+				t.Fatal(err)
+			}
+			if tc.event != "" {
+				expectAlert(t, alerts, tc.event)
+			}
+
+			if err := m.guard.Allow(lot, m.signer.Address()); err != tc.expected {
+				t.Errorf("Allow() = %v, expected %v", err, tc.expected)
+			}
+
+			// a queued job over the cap fails before sending anything
+			job = newMintJob("Nq3Lp0ZsWd", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+			job.Campaign = lot.ID
+			if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+				t.Fatal(err)
+			}
+			err := m.processJob(context.Background(), job)
+			if err != tc.expected {
+				t.Errorf("second mint returned %v, expected %v", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSpendRecordedOnce(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.guard = newSpendGuard("", m.client, []common.Address{m.signer.Address()}, store, nil, nil, nil)
+
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+	job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	spent, err := m.guard.spent(m.guard.dailyKey(m.signer.Address(), time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent.Sign() == 0 {
+		t.Fatal("no gas spend recorded for the mint")
+	}
+
+	// a restart finalizing the same job again
+	if err := m.finalize(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.guard.spent(m.guard.dailyKey(m.signer.Address(), time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Cmp(spent) != 0 {
+		t.Errorf("spent %v wei after finalizing again, expected %v", again, spent)
+	}
+}
+
+func TestSpendPerKey(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	alerter, alerts := newAlertWebhook(t)
+
+	// only the first key of the pool is funded
+	signers := testMinterSigners(t, 2)
+	funded, empty := signers[0].Address(), signers[1].Address()
+	m.client.(*SimulatedBackend).FundAddress(context.Background(), funded)
+	m.pool = newMinterPool(m.client, signers)
+	m.guard = newSpendGuard("", m.client, accountsOf(append([]Signer{m.signer}, signers...)), store, alerter, gwei(1), gwei(1000000))
+	if err := m.guard.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert(t, alerts, "low_balance")
+
+	lot := &campaign{ID: "202203R"}
+	if err := m.guard.Allow(lot, m.mintAccounts(common.HexToAddress(m.contractAddress))...); err != nil {
+		t.Errorf("Allow() = %v with a funded key", err)
+	}
+	for i := 0; i < 3; i++ {
+		if key := m.mintKey(common.HexToAddress(m.contractAddress)); key.signer.Address() != funded {
+			t.Errorf("mint %d sent by %s, want the funded key %s", i, key.signer.Address().Hex(), funded.Hex())
+		}
+	}
+
+	// the funded key spent its daily cap too
+	if err := store.Set(m.guard.dailyKey(funded, time.Now()), gwei(1000000).String()); err != nil {
+		t.Fatal(err)
+	}
+	if m.guard.Usable(funded) {
+		t.Errorf("key over its daily cap is usable")
+	}
+	if err := m.guard.Allow(lot, m.mintAccounts(common.HexToAddress(m.contractAddress))...); err == nil {
+		t.Errorf("Allow() = nil with every key paused")
+	}
+	// the owner has a cap of its own
+	if !m.guard.Usable(m.signer.Address()) || m.guard.Usable(empty) {
+		t.Errorf("Usable() mixed up the owner and the empty key")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/philippgille/gokv"
+)
+
+// atomicStore is a store that can change a value with no other change to it
+// in between, from this process or any other sharing the store.
+type atomicStore interface {
+	gokv.Store
+	// Update reads the value of k into v, calls fn and saves v unless fn
+	// fails. fn may be called more than once when others change the value
+	// at the same time.
+	Update(k string, v interface{}, fn func(found bool) error) error
+}
+
+// storeUpdate changes the value of k in the store atomically, see
+// atomicStore. Stores that can't, like the in-memory one, are only guarded
+// against the other goroutines of this process.
+func storeUpdate(store gokv.Store, k string, v interface{}, fn func(found bool) error) error {
+	if s, ok := store.(atomicStore); ok {
+		return s.Update(k, v, fn)
+	}
+
+	l, _ := localLocks.LoadOrStore(k, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	found, err := store.Get(k, v)
+	if err != nil {
+		return err
+	}
+	if err := fn(found); err != nil {
+		return err
+	}
+	return store.Set(k, v)
+}
+
+// localLocks serializes storeUpdate by key for stores that aren't atomic.
+var localLocks sync.Map // key -> *sync.Mutex
+
+// datastoreKind is where gokv keeps its values, the records written before
+// datastoreStore existed stay readable.
+const datastoreKind = "gokv"
+
+// datastoreEntity is the JSON of a value, the way gokv saves it.
+type datastoreEntity struct {
+	V []byte `datastore:"v,noindex"`
+}
+
+// datastoreStore keeps the values in Cloud Datastore and updates them in
+// transactions.
+type datastoreStore struct {
+	client *datastore.Client
+}
+
+func newDatastoreStore(projectID string) (*datastoreStore, error) {
+	client, err := datastore.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreStore{client: client}, nil
+}
+
+func datastoreKey(k string) *datastore.Key {
+	return datastore.NameKey(datastoreKind, k, nil)
+}
+
+func (s *datastoreStore) Set(k string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = s.client.Put(ctx, datastoreKey(k), &datastoreEntity{V: b})
+	return err
+}
+
+func (s *datastoreStore) Get(k string, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	e := &datastoreEntity{}
+	if err := s.client.Get(ctx, datastoreKey(k), e); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, json.Unmarshal(e.V, v)
+}
+
+func (s *datastoreStore) Delete(k string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return s.client.Delete(ctx, datastoreKey(k))
+}
+
+func (s *datastoreStore) Close() error {
+	return s.client.Close()
+}
+
+// Update runs fn in a transaction, which is retried when another one changed
+// the value first. The indexes are written by every claim, so it is retried
+// more than Datastore's default.
+func (s *datastoreStore) Update(k string, v interface{}, fn func(found bool) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key := datastoreKey(k)
+	_, err := s.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		// start every attempt from what is stored now
+		value := reflect.ValueOf(v).Elem()
+		value.Set(reflect.Zero(value.Type()))
+
+		e := &datastoreEntity{}
+		found := true
+		switch err := tx.Get(key, e); err {
+		case nil:
+			if err := json.Unmarshal(e.V, v); err != nil {
+				return err
+			}
+		case datastore.ErrNoSuchEntity:
+			found = false
+		default:
+			return err
+		}
+
+		if err := fn(found); err != nil {
+			return err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Put(key, &datastoreEntity{V: b})
+		return err
+	}, datastore.MaxAttempts(10))
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// versionedStore updates values optimistically, like a Datastore
+// transaction: an update whose value changed in the meantime runs again.
+type versionedStore struct {
+	*syncmap.Store
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+func newVersionedStore() *versionedStore {
+	store := syncmap.NewStore(syncmap.Options{})
+	return &versionedStore{Store: &store, versions: map[string]int{}}
+}
+
+func (s *versionedStore) Set(k string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[k]++
+	return s.Store.Set(k, v)
+}
+
+func (s *versionedStore) Update(k string, v interface{}, fn func(found bool) error) error {
+	for {
+		s.mu.Lock()
+		version := s.versions[k]
+		raw := json.RawMessage{}
+		found, err := s.Store.Get(k, &raw)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		value := reflect.ValueOf(v).Elem()
+		value.Set(reflect.Zero(value.Type()))
+		if found {
+			if err := json.Unmarshal(raw, v); err != nil {
+				return err
+			}
+		}
+		if err := fn(found); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		if s.versions[k] == version {
+			s.versions[k]++
+			err := s.Store.Set(k, v)
+			s.mu.Unlock()
+			return err
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestReserveAcrossInstances(t *testing.T) {
+	store := newVersionedStore()
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+
+	// every request is served by an instance of its own
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := []string{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jobID := fmt.Sprintf("job-%d", i)
+			_, err := newClaims(store).Reserve("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", jobID)
+			if err == nil {
+				mu.Lock()
+				winners = append(winners, jobID)
+				mu.Unlock()
+			} else if err != errCodeReserved {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(winners) != 1 {
+		t.Fatalf("%d callers reserved the code, want exactly one: %v", len(winners), winners)
+	}
+}
+
+func TestStoreIndexAcrossInstances(t *testing.T) {
+	store := newVersionedStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := newStoreIndex(store, openJobsKey).Add(fmt.Sprintf("job-%d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ids, err := newStoreIndex(store, openJobsKey).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 50 {
+		t.Errorf("index lists %d IDs, want 50", len(ids))
+	}
+}
+
+// TestDatastoreUpdate needs the Datastore emulator, e.g.
+// gcloud beta emulators datastore start with DATASTORE_EMULATOR_HOST set.
+func TestDatastoreUpdate(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	store, err := newDatastoreStore("nftlink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	key := "test/counter/" + newJobID()
+	defer store.Delete(key)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int
+			err := storeUpdate(store, key, &n, func(found bool) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var n int
+	if _, err := store.Get(key, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("counter is %d after 10 updates", n)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+var (
+	errClaimsPaused = errors.New("claims paused")
+	errSoldOut      = errors.New("sold out")
+)
+
+// contractState is what the contract last said about its mints.
+type contractState struct {
+	paused    bool
+	maxSupply uint64 // 0 for no limit
+	minted    uint64
+}
+
+// supplyGuard follows whether the contracts of a chain are paused or sold
+// out, so no claim is taken for a mint that would revert. A contract that
+// can't be read is stopped.
+type supplyGuard struct {
+	client ethBackend
+
+	mu        sync.Mutex
+	contracts map[common.Address]*contractState // nil until read
+}
+
+func newSupplyGuard(client ethBackend) *supplyGuard {
+	return &supplyGuard{client: client, contracts: map[common.Address]*contractState{}}
+}
+
+// Watch adds the contract to the ones read on every refresh.
+func (g *supplyGuard) Watch(contract common.Address) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.contracts[contract]; !ok {
+		g.contracts[contract] = nil
+	}
+}
+
+// Run reads every watched contract now and then every interval, until ctx is
+// cancelled.
+func (g *supplyGuard) Run(ctx context.Context, interval time.Duration) {
+	if g == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		g.Refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh reads every watched contract, keeping what was known of the ones
+// that fail to answer.
+func (g *supplyGuard) Refresh(ctx context.Context) {
+	g.mu.Lock()
+	contracts := []common.Address{}
+	for contract := range g.contracts {
+		contracts = append(contracts, contract)
+	}
+	g.mu.Unlock()
+
+	for _, contract := range contracts {
+		if _, err := g.refresh(ctx, contract); err != nil {
+			log.Printf("reading the supply of %s: %v", contract.Hex(), err)
+		}
+	}
+}
+
+func (g *supplyGuard) refresh(ctx context.Context, contract common.Address) (*contractState, error) {
+	caller, err := nftlink.NewNFTLinkCaller(contract, g.client)
+	if err != nil {
+		return nil, err
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	state := &contractState{}
+	paused, err := caller.Paused(opts)
+	if err != nil {
+		return nil, err
+	}
+	state.paused = paused
+	maxSupply, err := caller.MaxSupply(opts)
+	if err != nil {
+		return nil, err
+	}
+	state.maxSupply = maxSupply.Uint64()
+	// without a max supply the count doesn't matter
+	if state.maxSupply != 0 {
+		minted, err := caller.Count(opts)
+		if err != nil {
+			return nil, err
+		}
+		state.minted = minted.Uint64()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.contracts[contract] = state
+	return state, nil
+}
+
+// Allow reports whether the contract takes mints, errClaimsPaused or
+// errSoldOut if it doesn't. A contract not read yet is read now, and the
+// error reading it returned. A nil guard allows everything.
+func (g *supplyGuard) Allow(ctx context.Context, contract common.Address) error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	state := g.contracts[contract]
+	g.mu.Unlock()
+	if state == nil {
+		var err error
+		state, err = g.refresh(ctx, contract)
+		if err != nil {
+			g.Watch(contract)
+			return fmt.Errorf("reading the supply of %s: %v", contract.Hex(), err)
+		}
+	}
+
+	switch {
+	case state.paused:
+		return errClaimsPaused
+	case state.maxSupply != 0 && state.minted >= state.maxSupply:
+		return errSoldOut
+	}
+	return nil
+}
+
+// Minted counts a token minted by the contract, so it sells out without
+// waiting for the next refresh.
+func (g *supplyGuard) Minted(contract common.Address) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if state := g.contracts[contract]; state != nil {
+		g.contracts[contract] = &contractState{paused: state.paused, maxSupply: state.maxSupply, minted: state.minted + 1}
+	}
+}
+
+// checksSupply reports whether claims of the campaign are checked against
+// the supply of its contract. Editions enforce their supply on the contract,
+// which can't be paused, and legacy contracts have neither.
+func checksSupply(c *campaign) bool {
+	return c.Standard != standardERC1155 && !c.LegacyContract
+}
+
+// allowSupply reports whether the contract of the campaign takes mints.
+func (m *minter) allowSupply(ctx context.Context, c *campaign) error {
+	if !checksSupply(c) {
+		return nil
+	}
+	return m.supply.Allow(ctx, common.HexToAddress(c.ContractAddress))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// supplyBackend answers paused, maxSupply and count as the contract would.
+type supplyBackend struct {
+	ethBackend
+	paused    bool
+	maxSupply int64
+	minted    int64
+}
+
+func (s *supplyBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	method, err := parsed.MethodById(call.Data[:4])
+	if err != nil {
+		return nil, err
+	}
+	switch method.Name {
+	case "paused":
+		return method.Outputs.Pack(s.paused)
+	case "maxSupply":
+		return method.Outputs.Pack(big.NewInt(s.maxSupply))
+	case "count":
+		return method.Outputs.Pack(big.NewInt(s.minted))
+	}
+	return s.ethBackend.CallContract(ctx, call, blockNumber)
+}
+
+func TestSupplyGuard(t *testing.T) {
+	contract := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	var cases = []struct {
+		name    string
+		backend supplyBackend
+		want    error
+	}{
+		{"No limit", supplyBackend{minted: 5000}, nil},
+		{"Paused", supplyBackend{paused: true, minted: 5}, errClaimsPaused},
+		{"Below max supply", supplyBackend{maxSupply: 10, minted: 9}, nil},
+		{"Sold out", supplyBackend{maxSupply: 10, minted: 10}, errSoldOut},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := tc.backend
+			g := newSupplyGuard(&backend)
+			if err := g.Allow(context.Background(), contract); err != tc.want {
+				t.Errorf("Allow() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+
+	// the last token sells out without waiting for a refresh
+	backend := &supplyBackend{maxSupply: 10, minted: 9}
+	g := newSupplyGuard(backend)
+	if err := g.Allow(context.Background(), contract); err != nil {
+		t.Fatal(err)
+	}
+	g.Minted(contract)
+	if err := g.Allow(context.Background(), contract); err != errSoldOut {
+		t.Errorf("Allow() after minting the last token = %v, want %v", err, errSoldOut)
+	}
+
+	// pausing and unpausing are picked up by the next refresh
+	backend.paused, backend.maxSupply = true, 0
+	g.Refresh(context.Background())
+	if err := g.Allow(context.Background(), contract); err != errClaimsPaused {
+		t.Errorf("Allow() after pausing = %v, want %v", err, errClaimsPaused)
+	}
+	backend.paused = false
+	g.Refresh(context.Background())
+	if err := g.Allow(context.Background(), contract); err != nil {
+		t.Errorf("Allow() after unpausing = %v", err)
+	}
+}
+
+func TestSupplyGuardLegacyContract(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.supply = newSupplyGuard(m.client)
+
+	// the deployed contract predates paused and maxSupply, it is only
+	// minted to when configured as such
+	contract := common.HexToAddress(m.contractAddress)
+	if err := m.allowSupply(context.Background(), &campaign{ContractAddress: contract.Hex()}); err == nil {
+		t.Errorf("allowed mints to a contract without paused")
+	}
+	if err := m.allowSupply(context.Background(), &campaign{ContractAddress: contract.Hex(), LegacyContract: true}); err != nil {
+		t.Errorf("legacy contract was stopped: %v", err)
+	}
+	m.legacyContract = true
+	c, err := m.campaign("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.allowSupply(context.Background(), c); err != nil {
+		t.Errorf("legacy contract of the chain was stopped: %v", err)
+	}
+
+	// and one that can't be read isn't taken for it
+	var cases = []struct {
+		name     string
+		client   ethBackend
+		contract common.Address
+	}{
+		{"Node unreachable", &callErrorBackend{ethBackend: m.client, err: errors.New("dial tcp 127.0.0.1:8545: connect: connection refused")}, contract},
+		{"Reverted with a reason", &callErrorBackend{ethBackend: m.client, err: errors.New("execution reverted: Pausable: paused")}, contract},
+		{"Reverted without data", &callErrorBackend{ethBackend: m.client, err: errors.New("execution reverted")}, contract},
+		{"No contract", m.client, common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := newSupplyGuard(tc.client).Allow(context.Background(), tc.contract); err == nil {
+				t.Errorf("allowed mints to a contract that couldn't be read")
+			}
+		})
+	}
+}
+
+// callErrorBackend fails every contract call with err.
+type callErrorBackend struct {
+	ethBackend
+	err error
+}
+
+func (c *callErrorBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return nil, c.err
+}
+
+func TestMintPausedOrSoldOut(t *testing.T) {
+	var cases = []struct {
+		name    string
+		backend supplyBackend
+		status  int
+		body    string
+	}{
+		{"Paused", supplyBackend{paused: true}, http.StatusServiceUnavailable, "Claims paused"},
+		{"Sold out", supplyBackend{maxSupply: 3, minted: 3}, http.StatusGone, "Sold out"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			backend := tc.backend
+			backend.ethBackend = m.client
+			m.supply = newSupplyGuard(&backend)
+			store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+
+			r := mux.NewRouter()
+			r.Handle("/mint/{id}/{wallet}", m)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+			if rr.Code != tc.status || !strings.Contains(rr.Body.String(), tc.body) {
+				t.Errorf("handler returned %v %q, want %v %q", rr.Code, rr.Body.String(), tc.status, tc.body)
+			}
+
+			claim, _, err := m.claims.Get("U6fxRAqxMo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claim.Status != claimAvailable || claim.JobID != "" {
+				t.Errorf("code was reserved: %+v", claim)
+			}
+		})
+	}
+}
+
+func TestPauseOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	m.contractAddress = contract.Hex()
+	m.supply = newSupplyGuard(m.client)
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+
+	var steps = []struct {
+		method string
+		status int
+		body   string
+	}{
+		{"pause", http.StatusServiceUnavailable, "Claims paused"},
+		{"unpause", http.StatusAccepted, "U6fxRAqxMo"},
+	}
+	for _, step := range steps {
+		tx, err := m.transact(context.Background(), nftlink.NFTLinkMetaData, contract, nil, step.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.tracker.Wait(context.Background(), []common.Hash{tx.Hash()}); err != nil {
+			t.Fatal(err)
+		}
+		m.supply.Refresh(context.Background())
+
+		r := mux.NewRouter()
+		r.Handle("/mint/{id}/{wallet}", m)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil))
+		if rr.Code != step.status || !strings.Contains(rr.Body.String(), step.body) {
+			t.Errorf("after %s handler returned %v %q, want %v %q", step.method, rr.Code, rr.Body.String(), step.status, step.body)
+		}
+	}
+}
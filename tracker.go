@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var errTxStuck = errors.New("transaction not mined")
+
+// txTracker follows a sent transaction until its receipt is buried under
+// enough blocks to call it final.
+type txTracker struct {
+	client        ethBackend
+	confirmations uint64        // blocks on top of and including the one with the transaction
+	interval      time.Duration // how often to poll the node
+	stuckAfter    time.Duration // give up waiting for a transaction that isn't mined, 0 waits forever
+}
+
+func newTxTracker(client ethBackend, confirmations uint64, interval time.Duration, stuckAfter time.Duration) *txTracker {
+	if confirmations == 0 {
+		confirmations = 1
+	}
+	return &txTracker{client: client, confirmations: confirmations, interval: interval, stuckAfter: stuckAfter}
+}
+
+// Wait blocks until one of the transactions, all sharing a nonce, is mined
+// with the required number of confirmations, or is mined and reverted. The
+// receipts are read again on every poll so a reorg moving a transaction to
+// another block is noticed. If none of them is mined within stuckAfter it
+// returns errTxStuck.
+func (t *txTracker) Wait(ctx context.Context, hashes []common.Hash) (*types.Receipt, error) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var stuck <-chan time.Time
+	if t.stuckAfter > 0 {
+		timer := time.NewTimer(t.stuckAfter)
+		defer timer.Stop()
+		stuck = timer.C
+	}
+
+	for {
+		mined := false
+		for _, hash := range hashes {
+			receipt, confirmations, err := t.check(ctx, hash)
+			if err != nil {
+				return nil, err
+			}
+			if receipt == nil {
+				continue
+			}
+			mined = true
+			if receipt.Status != types.ReceiptStatusSuccessful || confirmations >= t.confirmations {
+				return receipt, nil
+			}
+		}
+
+		select {
+		case <-stuck:
+			if !mined {
+				return nil, errTxStuck
+			}
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// check returns the receipt of the transaction, if mined, and how many blocks
+// confirm it.
+func (t *txTracker) check(ctx context.Context, hash common.Hash) (*types.Receipt, uint64, error) {
+	receipt, err := t.client.TransactionReceipt(ctx, hash)
+	if err == ethereum.NotFound || (err == nil && receipt == nil) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	head, err := t.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if head.Number.Cmp(receipt.BlockNumber) < 0 {
+		return receipt, 0, nil
+	}
+	return receipt, new(big.Int).Sub(head.Number, receipt.BlockNumber).Uint64() + 1, nil
+}
+
+// receiptStatus is the human readable form of a receipt's status saved on the
+// claim record.
+func receiptStatus(receipt *types.Receipt) string {
+	if receipt.Status == types.ReceiptStatusSuccessful {
+		return "success"
+	}
+	return "reverted"
+}
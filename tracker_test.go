@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// fixedEstimate is a backend whose gas estimate always succeeds, even for
+// calls that revert.
+type fixedEstimate struct {
+	ethBackend
+	gas uint64
+}
+
+func (f *fixedEstimate) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return f.gas, nil
+}
+
+func TestTrackerConfirmations(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	client := m.client.(*SimulatedBackend)
+
+	tx, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := newTxTracker(client, 3, 5*time.Millisecond, 0)
+	done := make(chan *types.Receipt)
+	go func() {
+		receipt, err := tracker.Wait(context.Background(), []common.Hash{tx.Hash()})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- receipt
+	}()
+
+	// the block with the transaction is the first confirmation
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+			t.Fatalf("receipt returned with %d confirmations, want 3", i+1)
+		case <-time.After(50 * time.Millisecond):
+		}
+		client.Commit()
+	}
+
+	select {
+	case receipt := <-done:
+		if receipt.TxHash != tx.Hash() {
+			t.Errorf("got receipt for %s, want %s", receipt.TxHash.Hex(), tx.Hash().Hex())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receipt not returned after 3 confirmations")
+	}
+}
+
+func TestMintReverted(t *testing.T) {
+	for _, release := range []bool{true, false} {
+		t.Run(fmt.Sprintf("release on revert %v", release), func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			m.releaseOnRevert = release
+
+			// safeMint is onlyOwner, minting with any other key reverts
+			client := m.client.(*SimulatedBackend)
+			key, err := crypto.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			from := crypto.PubkeyToAddress(key.PublicKey)
+			client.FundAddress(context.Background(), from)
+			m.signer = newKeySigner(key)
+			m.nonces = newNonceManager(client, from)
+			// skip the estimate so the transaction is actually sent and mined
+			m.client = &fixedEstimate{ethBackend: client, gas: 300000}
+
+			store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+			job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+			if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.queue.Enqueue(job); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.processJob(context.Background(), job); err == nil {
+				t.Fatal("reverted mint reported no error")
+			}
+			if job.State != jobFailed {
+				t.Errorf("job is %s, want %s", job.State, jobFailed)
+			}
+
+			claim := &ClaimPrize{}
+			store.Get("U6fxRAqxMo", claim)
+			if claim.ReceiptStatus != "reverted" || claim.TxHash != job.TxHash || claim.BlockNumber == 0 || claim.GasUsed == 0 {
+				t.Errorf("receipt not recorded on the claim: %+v", claim)
+			}
+			if claim.Claimed {
+				t.Errorf("reverted claim marked as claimed")
+			}
+
+			want := claimFailed
+			if release {
+				want = claimAvailable
+			}
+			if claim.Status != want {
+				t.Errorf("claim is %q after the revert, want %q", claim.Status, want)
+			}
+		})
+	}
+}
+
+// stallingBackend swallows the first transactions it is asked to send, as if
+// they sat in the mempool forever because their fees were too low.
+type stallingBackend struct {
+	*SimulatedBackend
+	mu    sync.Mutex
+	stall int
+	held  []*types.Transaction
+}
+
+func (s *stallingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	s.mu.Lock()
+	if s.stall > 0 {
+		s.stall--
+		s.held = append(s.held, tx)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	return s.SimulatedBackend.SendTransaction(ctx, tx)
+}
+
+func TestStuckMintReplaced(t *testing.T) {
+	for _, fees := range []*feePolicy{{mode: feeDynamic, bumpPercent: 20}, {mode: feeLegacy, bumpPercent: 20}} {
+		t.Run(string(fees.mode), func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+
+			backend := &stallingBackend{SimulatedBackend: m.client.(*SimulatedBackend), stall: 2}
+			m.client = backend
+			m.fees = fees
+			m.tracker = newTxTracker(backend, 1, 5*time.Millisecond, 50*time.Millisecond)
+
+			store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+			job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+			if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.queue.Enqueue(job); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.processJob(context.Background(), job); err != nil {
+				t.Fatal(err)
+			}
+			if job.State != jobConfirmed {
+				t.Fatalf("job is %s: %s", job.State, job.Error)
+			}
+
+			claim := &ClaimPrize{}
+			store.Get("U6fxRAqxMo", claim)
+			if len(claim.ReplacementTxs) != 2 {
+				t.Fatalf("claim recorded replacements %v, want 2", claim.ReplacementTxs)
+			}
+			if claim.TxHash != claim.ReplacementTxs[1] {
+				t.Errorf("mined transaction %s is not the last replacement %s", claim.TxHash, claim.ReplacementTxs[1])
+			}
+			if len(job.Replaced) != 2 || job.Replaced[0] != backend.held[0].Hash().Hex() {
+				t.Errorf("job replaced %v, want the two stalled transactions", job.Replaced)
+			}
+
+			// every replacement pays at least 20% more for the same nonce
+			sent := append(backend.held, nil)
+			receiptTx, _, err := backend.TransactionByHash(context.Background(), common.HexToHash(claim.TxHash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent[2] = receiptTx
+			for i := 1; i < len(sent); i++ {
+				old, replacement := sent[i-1], sent[i]
+				if replacement.Nonce() != old.Nonce() {
+					t.Errorf("replacement has nonce %d, want %d", replacement.Nonce(), old.Nonce())
+				}
+				min := new(big.Int).Div(new(big.Int).Mul(old.GasFeeCap(), big.NewInt(120)), big.NewInt(100))
+				if replacement.GasFeeCap().Cmp(min) < 0 {
+					t.Errorf("replacement fee cap %v is less than 120%% of %v", replacement.GasFeeCap(), old.GasFeeCap())
+				}
+			}
+		})
+	}
+}
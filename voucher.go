@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+)
+
+// modeVoucher campaigns don't mint, they hand the wallet a voucher it
+// redeems on the contract itself, paying for the gas.
+const modeVoucher = "voucher"
+
+var errVoucherRedeemed = errors.New("voucher already redeemed")
+
+// voucher is the NFTVoucher struct of the contract. Nonce and expiry are
+// decimal strings so JavaScript reads them without losing precision.
+type voucher struct {
+	Recipient common.Address `json:"recipient"`
+	URI       string         `json:"uri"`
+	Nonce     string         `json:"nonce"`
+	Expiry    string         `json:"expiry"` // unix time
+}
+
+// signedVoucher is what the wallet needs to call redeem.
+type signedVoucher struct {
+	Voucher         voucher       `json:"voucher"`
+	Signature       hexutil.Bytes `json:"signature"`
+	ChainID         uint64        `json:"chain_id"`
+	ContractAddress string        `json:"contract_address"`
+}
+
+// typedData is the EIP-712 form of the voucher for the contract at address
+// on the given chain, matching the domain NFTLink is deployed with.
+func (v voucher) typedData(chainID uint64, contract common.Address) apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"NFTVoucher": {
+				{Name: "recipient", Type: "address"},
+				{Name: "uri", Type: "string"},
+				{Name: "nonce", Type: "uint256"},
+				{Name: "expiry", Type: "uint256"},
+			},
+		},
+		PrimaryType: "NFTVoucher",
+		Domain: apitypes.TypedDataDomain{
+			Name:              "NFTLink",
+			Version:           "1",
+			ChainId:           (*math.HexOrDecimal256)(new(big.Int).SetUint64(chainID)),
+			VerifyingContract: contract.Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"recipient": v.Recipient.Hex(),
+			"uri":       v.URI,
+			"nonce":     v.Nonce,
+			"expiry":    v.Expiry,
+		},
+	}
+}
+
+// contractVoucher converts the voucher to the struct of the bindings.
+func (v voucher) contractVoucher() (nftlink.NFTLinkNFTVoucher, error) {
+	nonce, ok := new(big.Int).SetString(v.Nonce, 10)
+	if !ok {
+		return nftlink.NFTLinkNFTVoucher{}, fmt.Errorf("invalid voucher nonce %q", v.Nonce)
+	}
+	expiry, ok := new(big.Int).SetString(v.Expiry, 10)
+	if !ok {
+		return nftlink.NFTLinkNFTVoucher{}, fmt.Errorf("invalid voucher expiry %q", v.Expiry)
+	}
+	return nftlink.NFTLinkNFTVoucher{Recipient: v.Recipient, Uri: v.URI, Nonce: nonce, Expiry: expiry}, nil
+}
+
+// typedDataHash is the EIP-712 digest of data, the hash that gets signed.
+func typedDataHash(data apitypes.TypedData) ([]byte, error) {
+	domainSeparator, err := data.HashStruct("EIP712Domain", data.Domain.Map())
+	if err != nil {
+		return nil, err
+	}
+	messageHash, err := data.HashStruct(data.PrimaryType, data.Message)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256([]byte("\x19\x01"), domainSeparator, messageHash), nil
+}
+
+// voucherSigner recovers the address that signed the voucher.
+func voucherSigner(v *signedVoucher) (common.Address, error) {
+	hash, err := typedDataHash(v.Voucher.typedData(v.ChainID, common.HexToAddress(v.ContractAddress)))
+	if err != nil {
+		return common.Address{}, err
+	}
+	if len(v.Signature) != 65 {
+		return common.Address{}, errors.New("invalid signature length")
+	}
+	sig := append([]byte{}, v.Signature...)
+	sig[64] -= 27
+	pubkey, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pubkey), nil
+}
+
+// issueVoucher signs a voucher for the job instead of minting its token. A
+// code whose earlier voucher expired gets a new one, unless the old one was
+// redeemed before expiring.
+func (m *minter) issueVoucher(ctx context.Context, job *mintJob, c *campaign) error {
+	contract := common.HexToAddress(c.ContractAddress)
+
+	claim, _, err := m.claims.Get(job.Code)
+	if err != nil {
+		return err
+	}
+	if claim.VoucherNonce != "" {
+		redeemed, err := m.voucherRedeemed(ctx, contract, claim.VoucherNonce)
+		if err != nil {
+			return err
+		}
+		if redeemed {
+			err := m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+				claim.Claimed = true
+				claim.Status = claimFinal
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			job.State = jobFailed
+			job.Error = errVoucherRedeemed.Error()
+			if err := m.queue.Update(job); err != nil {
+				return err
+			}
+			return errVoucherRedeemed
+		}
+	}
+
+	job.State = jobUploading
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+	if job.TokenURI == "" {
+		number, err := m.claimNumber(job.Code, c)
+		if err != nil {
+			return m.fail(job, err)
+		}
+		cid, err := m.uploadMetadata(job, c, number)
+		if err != nil {
+			return m.fail(job, err)
+		}
+		job.TokenURI = cid.Hash
+	}
+
+	nonce, err := m.campaigns.VoucherNonces(m.chain, contract).Next(func() (uint64, error) { return 1, nil })
+	if err != nil {
+		return m.fail(job, err)
+	}
+	expiry := time.Now().Add(m.voucherTTL).UTC().Truncate(time.Second)
+	v := voucher{
+		Recipient: common.HexToAddress(job.Wallet),
+		URI:       job.TokenURI,
+		Nonce:     fmt.Sprint(nonce),
+		Expiry:    fmt.Sprint(expiry.Unix()),
+	}
+	sig, err := m.signer.SignTypedData(v.typedData(m.chainID, contract))
+	if err != nil {
+		return m.fail(job, err)
+	}
+	job.Voucher = &signedVoucher{Voucher: v, Signature: sig, ChainID: m.chainID, ContractAddress: contract.Hex()}
+
+	err = m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		claim.Status = claimVoucher
+		claim.Chain = m.chain
+		claim.ChainID = m.chainID
+		claim.ContractAddress = contract.Hex()
+		claim.VoucherNonce = v.Nonce
+		claim.VoucherExpiry = expiry
+		return nil
+	})
+	if err != nil {
+		return m.fail(job, err)
+	}
+
+	job.State = jobVoucher
+	return m.queue.Update(job)
+}
+
+// voucherRedeemed asks the contract whether the voucher with the nonce was
+// redeemed.
+func (m *minter) voucherRedeemed(ctx context.Context, contract common.Address, nonce string) (bool, error) {
+	n, ok := new(big.Int).SetString(nonce, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid voucher nonce %q", nonce)
+	}
+	nftcontract, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		return false, err
+	}
+	return nftcontract.VoucherRedeemed(&bind.CallOpts{Context: ctx}, n)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv/syncmap"
+)
+
+// TestVoucherDigest checks the digest against the one NFTLink.redeem builds
+// with _hashTypedDataV4, spelled out with abi.encode.
+func TestVoucherDigest(t *testing.T) {
+	v := voucher{
+		Recipient: common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"),
+		URI:       "QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5",
+		Nonce:     "42",
+		Expiry:    "1700000000",
+	}
+	contract := common.HexToAddress("0x71C7656EC7ab88b098defB751B7401B5f6d8976F")
+
+	bytes32, _ := abi.NewType("bytes32", "", nil)
+	uint256, _ := abi.NewType("uint256", "", nil)
+	address, _ := abi.NewType("address", "", nil)
+	encode := func(types []abi.Type, values ...interface{}) []byte {
+		args := abi.Arguments{}
+		for _, typ := range types {
+			args = append(args, abi.Argument{Type: typ})
+		}
+		b, err := args.Pack(values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crypto.Keccak256(b)
+	}
+	hash := func(s string) [32]byte {
+		return crypto.Keccak256Hash([]byte(s))
+	}
+
+	domain := encode([]abi.Type{bytes32, bytes32, bytes32, uint256, address},
+		hash("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"),
+		hash("NFTLink"), hash("1"), big.NewInt(1337), contract)
+	message := encode([]abi.Type{bytes32, address, bytes32, uint256, uint256},
+		hash("NFTVoucher(address recipient,string uri,uint256 nonce,uint256 expiry)"),
+		v.Recipient, hash(v.URI), big.NewInt(42), big.NewInt(1700000000))
+	expected := crypto.Keccak256([]byte("\x19\x01"), domain, message)
+
+	digest, err := typedDataHash(v.typedData(1337, contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, expected) {
+		t.Errorf("digest is %x, expected %x", digest, expected)
+	}
+
+	// and the voucher fits the redeem call of the bindings
+	cv, err := v.contractVoucher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := nftlink.NFTLinkMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Pack("redeem", cv, make([]byte, 65)); err != nil {
+		t.Errorf("packing redeem: %v", err)
+	}
+}
+
+func TestVoucherClaim(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	m.voucherTTL = time.Hour
+	m.ipfs = &recordingIPFS{}
+	// vouchers cost the server nothing, an empty hot wallet doesn't stop them
+	m.guard = newSpendGuard("", m.client, []common.Address{m.signer.Address()}, store, nil, big.NewInt(1), nil)
+	m.guard.balances[m.signer.Address()] = big.NewInt(0)
+
+	lot := &campaign{ID: "202203R", Lot: "202203R", Mode: modeVoucher}
+	if err := m.campaigns.Save(lot); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo", Campaign: lot.ID})
+
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+	request := func(wallet string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/mint/U6fxRAqxMo/"+wallet, nil))
+		return rr
+	}
+
+	rr := request("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned %v: %s", rr.Code, rr.Body.String())
+	}
+	job := &mintJob{}
+	if err := json.Unmarshal(rr.Body.Bytes(), job); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.processJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobVoucher || job.Voucher == nil {
+		t.Fatalf("job is %s without a voucher: %s", job.State, job.Error)
+	}
+	v := job.Voucher
+	if v.Voucher.Recipient != common.HexToAddress(job.Wallet) || v.Voucher.URI == "" || v.Voucher.Nonce != "1" {
+		t.Errorf("unexpected voucher %+v", v.Voucher)
+	}
+	if v.ContractAddress != common.HexToAddress(m.contractAddress).Hex() {
+		t.Errorf("voucher for contract %s, expected %s", v.ContractAddress, m.contractAddress)
+	}
+	signer, err := voucherSigner(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != m.signer.Address() {
+		t.Errorf("voucher signed by %s, expected the minting key %s", signer.Hex(), m.signer.Address().Hex())
+	}
+
+	claim, _, err := m.claims.Get("U6fxRAqxMo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.Status != claimVoucher || claim.Claimed || claim.VoucherNonce != "1" || claim.TxHash != "" {
+		t.Errorf("claim = %+v, expected an unminted claim holding voucher 1", claim)
+	}
+
+	// the same wallet gets the same voucher back, anybody else is refused
+	rr = request("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+	again := &mintJob{}
+	if err := json.Unmarshal(rr.Body.Bytes(), again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != job.ID || again.Voucher == nil || again.Voucher.Voucher.Nonce != "1" {
+		t.Errorf("second request got %+v, expected job %s and its voucher", again, job.ID)
+	}
+	if rr := request("0x71C7656EC7ab88b098defB751B7401B5f6d8976F"); rr.Code != http.StatusConflict {
+		t.Errorf("another wallet got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// once the voucher expires the code can be claimed again
+	m.claims.Update("U6fxRAqxMo", func(claim *ClaimPrize) error {
+		claim.VoucherExpiry = time.Now().Add(-time.Minute)
+		return nil
+	})
+	if _, err := m.claims.Reserve("U6fxRAqxMo", "0x71C7656EC7ab88b098defB751B7401B5f6d8976F", newJobID()); err != nil {
+		t.Errorf("expired voucher still holds the code: %v", err)
+	}
+}
+
+func TestRedeemOnChain(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+	contract := deployBinding(t, m, nftlink.NFTLinkMetaData)
+	chainID, err := m.client.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.chainID = chainID.Uint64()
+
+	// the simulated chain starts in 1970, bring its clock to now so the
+	// contract sees the expiry of the vouchers the way the server does
+	sim := m.client.(*SimulatedBackend)
+	head, err := sim.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.AdjustTime(time.Since(time.Unix(int64(head.Time), 0))); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := crypto.PubkeyToAddress(key.PublicKey)
+	sim.FundAddress(context.Background(), wallet)
+	auth, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nft, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signed by the owner below, as the server hands them out
+	newVoucher := func(nonce string, expiry time.Time) voucher {
+		return voucher{Recipient: wallet, URI: "QmToken" + nonce, Nonce: nonce, Expiry: fmt.Sprint(expiry.Unix())}
+	}
+	var cases = []struct {
+		name    string
+		voucher voucher
+		revert  string // reason the redeem reverts with, empty if it mints
+	}{
+		{"Redeemed", newVoucher("1", time.Now().Add(time.Hour)), ""},
+		{"Replayed", newVoucher("1", time.Now().Add(time.Hour)), "NFTLink: voucher already redeemed"},
+		{"Expired", newVoucher("2", time.Now().Add(-time.Hour)), "NFTLink: voucher expired"},
+		{"Another nonce", newVoucher("3", time.Now().Add(time.Hour)), ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sig, err := m.signer.SignTypedData(tc.voucher.typedData(m.chainID, contract))
+			if err != nil {
+				t.Fatal(err)
+			}
+			redeemed, err := tc.voucher.contractVoucher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := nft.BalanceOf(nil, wallet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = nft.Redeem(auth, redeemed, sig)
+			if tc.revert == "" && err != nil {
+				t.Fatalf("redeem reverted: %v", err)
+			}
+			if tc.revert != "" && (err == nil || !strings.Contains(err.Error(), tc.revert)) {
+				t.Fatalf("redeem returned %v, want a revert with %q", err, tc.revert)
+			}
+
+			after, err := nft.BalanceOf(nil, wallet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := int64(0)
+			if tc.revert == "" {
+				want = 1
+			}
+			if minted := new(big.Int).Sub(after, before).Int64(); minted != want {
+				t.Errorf("redeem minted %d tokens, want %d", minted, want)
+			}
+		})
+	}
+}
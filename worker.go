@@ -2,17 +2,20 @@ package main
 
 import (
 	"context"
-	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"math/big"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/gorilla/mux"
 	nftlink "github.com/nicocesar/nftlink/lib/contracts/nftlink"
 	"github.com/philippgille/gokv"
@@ -23,18 +26,44 @@ type ethBackend interface {
 	bind.DeployBackend
 	ethereum.TransactionReader
 	NetworkID(ctx context.Context) (*big.Int, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
 }
 
+// maxNonceRetries is how many times a mint is resent with a fresh nonce after
+// the node says the one we used is taken.
+const maxNonceRetries = 3
+
 type minter struct {
+	chain           string             // name of the chain profile, empty for the default one
+	chainID         uint64             // of the chain, as reported by the node
+	chains          map[string]*minter // the other chains, campaigns pick theirs
 	store           gokv.Store
+	claims          *claims
+	serials         *serials
+	queue           *jobQueue
 	ipfs            IIPFSClient
+	metadata        *metadataTemplate // for codes outside of any campaign
+	campaigns       *campaigns
 	client          ethBackend // this might have to be an interface for testing
-	privateKey      string
-	contractAddress string
-	gasLimit        uint64
-	gasPrice        *big.Int
+	signer          Signer
+	nonces          *nonceManager
+	pool            *minterPool // hot wallets minting in parallel, nil to mint with signer
+	tracker         *txTracker
+	releaseOnRevert bool   // make the code claimable again when its mint reverts, instead of leaving it failed
+	contractAddress string // for codes outside of any campaign
+	legacyContract  bool   // contractAddress predates pause and maxSupply
+	forwarder       string // trusted forwarder relaying voucher redeems, empty for none
+	gas             *gasEstimator
+	fees            *feePolicy
+	guard           *spendGuard  // nil for no balance and spend limits
+	supply          *supplyGuard // nil to mint without checking the contract is paused or sold out
+	batcher         *batcher     // nil to mint every job on its own
+	redemptions     *redemptions
+	voucherTTL      time.Duration // how long a voucher can be redeemed for
 }
 
+// ServeHTTP validates the redeem code and wallet and queues a mint job for
+// them. The response carries the job, whose state can be polled at /job/{id}.
 func (m *minter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["id"]
@@ -73,163 +102,658 @@ func (m *minter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	c, err := m.campaign(retrievedVal.Campaign)
+	var chain *minter
+	if err == nil {
+		chain, err = m.on(c.Chain)
+	}
+	if err == nil {
+		// the contract of the chain is the campaign's unless it has one
+		c, err = chain.campaign(retrievedVal.Campaign)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
+	switch c.Open(time.Now()) {
+	case errCampaignNotStarted:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Redeem code %s can't be claimed until %s", key, c.StartsAt.Format("2006-01-02"))
+		return
+	case errCampaignEnded:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Redeem code %s expired on %s", key, c.EndsAt.Format("2006-01-02"))
+		return
+	}
 
-	nftAddress := common.HexToAddress(m.contractAddress)
-	nftcontract, err := nftlink.NewNFTLink(nftAddress, m.client)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
+	if c.Mode == modeMerkle {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Redeem code %s is claimed on the contract, get its proof at /proof/%s", key, key)
 		return
 	}
 
-	privateKey, err := crypto.HexToECDSA(m.privateKey)
-	if err != nil {
+	switch err := chain.allowSupply(r.Context(), c); err {
+	case nil:
+	case errClaimsPaused:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Claims paused, please try again later")
+		return
+	case errSoldOut:
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "Sold out")
+		return
+	default:
+		log.Printf("refusing to mint %s: %v", key, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Minting is temporarily unavailable, please try again later")
+		return
+	}
+
+	// don't take codes the hot wallet can't pay to mint, vouchers are paid
+	// by the wallet redeeming them
+	if err := chain.guard.Allow(c, chain.mintAccounts(common.HexToAddress(c.ContractAddress))...); err != nil && c.Mode != modeVoucher {
+		log.Printf("refusing to mint %s: %v", key, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Minting is temporarily unavailable, please try again later")
+		return
+	}
+
+	// reserve the code before doing any IPFS or chain work, only one request
+	// can ever win a given code
+	job := newMintJob(key, A.Address().Hex())
+	job.Campaign = retrievedVal.Campaign
+	claim, err := m.claims.Reserve(key, job.Wallet, job.ID)
+	switch err {
+	case nil:
+	case errCodeNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Redeem code %s not found", key)
+		return
+	case errAlreadyClaimed:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Already claimed")
+		return
+	case errClaimFailed:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Redeem code %s could not be minted, please contact support", key)
+		return
+	case errCodeReserved:
+		// a job is already working on this code, hand it back to the same
+		// wallet instead of minting twice
+		existing, found, err := m.queue.Get(claim.JobID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		if found && strings.EqualFold(claim.Wallet, job.Wallet) {
+			writeJSON(w, http.StatusAccepted, existing)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Redeem code %s is being claimed", key)
+		return
+	default:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
 
-	publicKey := privateKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
+	err = m.queue.Enqueue(job)
+	if err != nil {
+		m.claims.Release(key, job.ID)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// processJob runs a queued job through the mint pipeline, saving every state
+// change so clients polling the job see its progress.
+func (m *minter) processJob(ctx context.Context, job *mintJob) error {
+	c, err := m.campaign(job.Campaign)
+	if err != nil {
+		return m.fail(job, err)
+	}
+	// every chain has its own client, signer and nonces
+	if c.Chain != m.chain {
+		other, err := m.on(c.Chain)
+		if err != nil {
+			return m.fail(job, err)
+		}
+		return other.processJob(ctx, job)
+	}
+	contract := common.HexToAddress(c.ContractAddress)
+
+	// a job waiting in a batch is already taken care of
+	if m.batcher.Holds(job.ID) {
+		return nil
+	}
+	// the transaction went out before a restart, only its outcome is missing
+	if job.State == jobSubmitted {
+		return m.finalize(ctx, job)
+	}
+	if c.Mode == modeVoucher {
+		return m.issueVoucher(ctx, job, c)
+	}
+
+	// nothing was sent for a job without metadata, its mint can only be in
+	// a later block
+	if job.TokenURI == "" && job.StartBlock == 0 {
+		head, err := m.client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return err
+		}
+		job.StartBlock = head.Number.Uint64()
+	}
+	job.State = jobUploading
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+
+	// a resumed job may have minted before dying without saving the
+	// transaction, don't mint the same token twice
+	if job.TokenURI != "" {
+		var hash common.Hash
+		var found bool
+		if c.Standard == standardERC1155 {
+			hash, found, err = m.findEditionMint(ctx, contract, job.Code, job.StartBlock)
+		} else {
+			hash, found, err = m.findMint(ctx, contract, common.HexToAddress(job.Wallet), job.TokenURI, job.StartBlock)
+		}
+		if err != nil {
+			return err
+		}
+		if found {
+			log.Printf("claim %s was already minted in %s", job.Code, hash.Hex())
+			if err := m.submitted(job, contract, hash, nil); err != nil {
+				return err
+			}
+			return m.finalize(ctx, job)
+		}
+	}
+
+	if err := m.guard.Allow(c, m.mintAccounts(contract)...); err != nil {
+		return m.fail(job, err)
+	}
+	if err := m.allowSupply(ctx, c); err != nil {
+		return m.fail(job, err)
+	}
+
+	// editions upload their metadata once, for the whole lot
+	if job.TokenURI == "" && c.Standard == standardERC1155 {
+		e, err := m.edition(ctx, c)
+		if err != nil {
+			return m.fail(job, err)
+		}
+		job.TokenURI = e.URI
+		if err := m.queue.Update(job); err != nil {
+			return err
+		}
+	}
+
+	// metadata survives a restart, so a resumed job doesn't upload it again
+	if job.TokenURI == "" {
+		number, err := m.claimNumber(job.Code, c)
+		if err != nil {
+			return m.fail(job, err)
+		}
+
+		cid, err := m.uploadMetadata(job, c, number)
+		if err != nil {
+			return m.fail(job, err)
+		}
+
+		job.TokenURI = cid.Hash
+		if err := m.queue.Update(job); err != nil {
+			return err
+		}
+	}
+
+	if m.batcher != nil {
+		// the batch mints and settles the job along with others
+		m.batcher.Add(ctx, c, contract, job)
+		return nil
+	}
+	if err := m.mintJobs(ctx, contract, []*mintJob{job}); err != nil {
+		if ctx.Err() != nil {
+			// the transaction may still go out, the sweeper resumes the job
+			return err
+		}
+		return m.fail(job, err)
+	}
+
+	return m.finalize(ctx, job)
+}
+
+// submitted records the transaction of the job on the job and the claim,
+// along with the chain and contract it mints on, before it is broadcast. raw
+// is the signed transaction, if known.
+func (m *minter) submitted(job *mintJob, contract common.Address, hash common.Hash, raw []byte) error {
+	job.State = jobSubmitted
+	job.TxHash = hash.Hex()
+	if raw != nil {
+		job.RawTx = hexutil.Encode(raw)
+	}
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+
+	return m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		claim.Status = claimSubmitted
+		claim.TxHash = job.TxHash
+		claim.Chain = m.chain
+		claim.ChainID = m.chainID
+		claim.ContractAddress = contract.Hex()
+		return nil
+	})
+}
+
+// unsent undoes submitted for a job whose transaction never left, so the
+// job can fail and free its code.
+func (m *minter) unsent(job *mintJob) error {
+	if job.State != jobSubmitted {
+		return nil
+	}
+	job.State = jobUploading
+	job.TxHash = ""
+	job.RawTx = ""
+	job.Batch = ""
+	job.BatchIndex = 0
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+	return m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		claim.Status = claimReserving
+		claim.TxHash = ""
+		return nil
+	})
+}
+
+// maxReplaceFailures is how many times in a row replacing a stuck
+// transaction may fail before its job is given up.
+const maxReplaceFailures = 3
 
-	//Now we can read the nonce that we should use for the account's transaction.
+// finalize waits for the job's transaction to be confirmed and settles the
+// claim from its receipt. If waiting is interrupted the claim stays submitted.
+func (m *minter) finalize(ctx context.Context, job *mintJob) error {
+	var receipt *types.Receipt
+	failed := 0
+	for receipt == nil {
+		var err error
+		receipt, err = m.tracker.Wait(ctx, job.txHashes())
+		if err == errTxStuck {
+			// the fees were too low, send it again paying more
+			if err := m.bumpFees(ctx, job); err != nil {
+				log.Printf("replacing stuck transaction %s of job %s: %v", job.TxHash, job.ID, err)
+				if failed++; failed >= maxReplaceFailures {
+					return m.giveUp(job, fmt.Errorf("transaction %s is stuck and can't be replaced: %v", job.TxHash, err))
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-	nonce, err := m.client.PendingNonceAt(context.Background(), fromAddress)
+	c, err := m.campaign(job.Campaign)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return err
+	}
+	reverted := receipt.Status != types.ReceiptStatusSuccessful
+	relayed := job.Voucher != nil
+	if !reverted {
+		var tokenID *big.Int
+		if c.Standard == standardERC1155 {
+			tokenID, err = m.mintedEdition(common.HexToAddress(c.ContractAddress), receipt, job.Code)
+		} else {
+			tokenID, err = m.mintedToken(common.HexToAddress(c.ContractAddress), receipt, job.BatchIndex)
+		}
+		switch {
+		case err != nil && relayed:
+			// the forwarder doesn't revert when the redeem it calls does
+			reverted = true
+		case err != nil:
+			return err
+		default:
+			job.TokenID = tokenID.String()
+		}
 	}
 
-	chainID, err := m.client.NetworkID(context.Background())
+	recorded := false
+	err = m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		// finalizing again after a restart must not count the gas twice
+		recorded = claim.ReceiptStatus != "" && claim.TxHash == receipt.TxHash.Hex() && claim.BlockNumber == receipt.BlockNumber.Uint64()
+		claim.TxHash = receipt.TxHash.Hex()
+		claim.BlockNumber = receipt.BlockNumber.Uint64()
+		claim.GasUsed = receipt.GasUsed
+		claim.ReceiptStatus = receiptStatus(receipt)
+		switch {
+		case !reverted:
+			// prize has been claimed now let's write it to the database
+			claim.Claimed = true
+			claim.Status = claimFinal
+			claim.TokenID = job.TokenID
+		case relayed:
+			// the voucher is still good, the wallet may redeem it again
+			claim.Status = claimVoucher
+		case m.releaseOnRevert:
+			claim.Status = claimAvailable
+			claim.JobID = ""
+		default:
+			claim.Status = claimFailed
+		}
+		return nil
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return err
+	}
+	// reverted transactions pay for their gas too, a batch is paid once by
+	// its first job
+	if !recorded && job.BatchIndex == 0 {
+		if err := m.guard.Record(ctx, c, receipt); err != nil {
+			log.Printf("recording the gas spent by %s: %v", receipt.TxHash.Hex(), err)
+		}
 	}
 
-	// TODO: get this from config
-	value := big.NewInt(0) // in wei (0 eth)
-	gasLimit := m.gasLimit // in units
-	gasPrice := m.gasPrice // in wei
+	if reverted {
+		job.State = jobFailed
+		if relayed {
+			job.State = jobVoucher
+		}
+		job.Error = fmt.Sprintf("transaction %s reverted", job.TxHash)
+		if err := m.queue.Update(job); err != nil {
+			return err
+		}
+		return errors.New(job.Error)
+	}
+
+	job.State = jobConfirmed
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+	// a burn of the token is redeemed for the code's campaign, units of an
+	// edition are all the same token
+	if c.Standard != standardERC1155 {
+		if err := m.store.Set(tokenKey(m.chainID, common.HexToAddress(c.ContractAddress), job.TokenID), job.Code); err != nil {
+			return err
+		}
+	}
+	m.supply.Minted(common.HexToAddress(c.ContractAddress))
+	return nil
+}
 
-	auth, err := bind.NewKeyedTransactorWithChainID(privateKey, chainID)
+// fail marks the job as failed and frees the code so it can be claimed again.
+func (m *minter) fail(job *mintJob, cause error) error {
+	job.State = jobFailed
+	job.Error = cause.Error()
+	if err := m.queue.Update(job); err != nil {
+		return err
+	}
+
+	if err := m.claims.Release(job.Code, job.ID); err != nil {
+		return err
+	}
+	return cause
+}
+
+// giveUp fails a job whose transaction may still be mined. Its code can't be
+// freed for another mint, so the claim is left failed for support to check.
+func (m *minter) giveUp(job *mintJob, cause error) error {
+	err := m.claims.Update(job.Code, func(claim *ClaimPrize) error {
+		if claim.JobID == job.ID && claim.Status == claimSubmitted {
+			claim.Status = claimFailed
+		}
+		return nil
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return err
+	}
+	return m.fail(job, cause)
+}
+
+// campaign returns the campaign a code belongs to. Codes outside of any
+// campaign, and campaigns without a contract of their own, mint to the
+// contract configured for the chain.
+func (m *minter) campaign(id string) (*campaign, error) {
+	if id == "" {
+		return &campaign{Chain: m.chain, ContractAddress: m.contractAddress, LegacyContract: m.legacyContract}, nil
+	}
+	c, err := m.campaigns.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.ContractAddress == "" && c.Chain == m.chain {
+		c.ContractAddress = m.contractAddress
+		c.LegacyContract = m.legacyContract
 	}
+	return c, nil
+}
 
-	opts := &bind.TransactOpts{
-		Nonce:    new(big.Int).SetUint64(nonce),
-		From:     fromAddress,
-		Signer:   auth.Signer,
-		Value:    value,
-		GasPrice: gasPrice,
-		GasLimit: gasLimit,
+// claimNumber returns the metadata number of the code, handing out a new one
+// the first time the code is minted. Campaigns number their bottles from 1,
+// codes outside of any campaign carry on from the tokens of the contract.
+func (m *minter) claimNumber(code string, c *campaign) (uint64, error) {
+	serials, seed := m.serials, func() (uint64, error) {
+		return m.mintedCount(common.HexToAddress(c.ContractAddress))
 	}
-	// FIXME! Safe mint should point to the IPFS metadata of the NFT
-	type Attribute struct {
-		TraitType   string `json:"trait_type"`
-		DisplayType string `json:"display_type,omitempty"`
-		Value       string `json:"value"`
+	if c.ID != "" {
+		serials, seed = m.campaigns.Serials(c), func() (uint64, error) { return 1, nil }
 	}
 
-	type Metadata struct {
-		Name        string      `json:"name"`
-		Description string      `json:"description"`
-		Image       string      `json:"image"`
-		Attributes  []Attribute `json:"attributes"`
+	var number uint64
+	err := m.claims.Update(code, func(claim *ClaimPrize) error {
+		if claim.Number == nil {
+			n, err := serials.Next(seed)
+			if err != nil {
+				return err
+			}
+			claim.Number = &n
+		}
+		number = *claim.Number
+		return nil
+	})
+	return number, err
+}
+
+// mintedCount seeds the metadata numbers from the tokens the contract minted
+// before they were kept in the store.
+func (m *minter) mintedCount(contract common.Address) (uint64, error) {
+	nftcontract, err := nftlink.NewNFTLink(contract, m.client)
+	if err != nil {
+		return 0, err
 	}
+	count, err := nftcontract.NFTLinkCaller.Count(nil)
+	if err != nil {
+		return 0, err
+	}
+	return count.Uint64(), nil
+}
 
-	number, err := nftcontract.NFTLinkCaller.Count(nil)
+// mintedToken returns the ID of the index-th token minted in the receipt,
+// read from the Transfer events out of the zero address. A batch mints its
+// tokens in the order of its jobs.
+func (m *minter) mintedToken(contractAddress common.Address, receipt *types.Receipt, index int) (*big.Int, error) {
+	nftcontract, err := nftlink.NewNFTLink(contractAddress, m.client)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return nil, err
+	}
+
+	for _, l := range receipt.Logs {
+		if l.Address != contractAddress || len(l.Topics) == 0 {
+			continue
+		}
+		transfer, err := nftcontract.NFTLinkFilterer.ParseTransfer(*l)
+		if err != nil {
+			// some other event
+			continue
+		}
+		if transfer.From != (common.Address{}) {
+			continue
+		}
+		if index == 0 {
+			return transfer.TokenId, nil
+		}
+		index--
+	}
+	return nil, fmt.Errorf("no Transfer event for token %d in transaction %s", index, receipt.TxHash.Hex())
+}
+
+// uploadMetadata renders the token metadata of the job with the template of
+// its campaign and adds it to IPFS.
+func (m *minter) uploadMetadata(job *mintJob, c *campaign, number uint64) (IPFSUploadResponse, error) {
+	return m.upload(c, metadataData{
+		Number:    number,
+		Code:      job.Code,
+		Wallet:    job.Wallet,
+		ClaimDate: job.CreatedAt,
+		Campaign:  *c,
+	})
+}
+
+// upload renders data with the metadata template of the campaign and adds
+// the metadata to IPFS.
+func (m *minter) upload(c *campaign, data metadataData) (IPFSUploadResponse, error) {
+	template := m.metadata
+	if c.ID != "" {
+		var err error
+		template, err = m.campaigns.Template(c)
+		if err != nil {
+			return IPFSUploadResponse{}, err
+		}
 	}
 
-	metadata := Metadata{
-		Name:        "Ma'hai #" + number.String(),
-		Description: "Ma'hai #" + number.String(),
-		Image:       "ipfs://QmWCsTr7EiVFpDsWkogrm7qidu2t7jHkiYVueCWCwD7ZA5",
-		//Image: "ipfs://QmcxSwJ5PhYSArq1s1RS6Dt7Ji1m8YrDRQKPdt6Apizosw/mahai.jpeg",
-		Attributes: []Attribute{
-			{
-				TraitType: "Producto",
-				Value:     "London Dry Gin",
-			},
-			{
-				TraitType: "Lote",
-				Value:     "202112R",
-			},
-			{
-				TraitType: "Partida",
-				Value:     "840 botellas",
-			},
-			{
-				TraitType: "Fabricado en",
-				Value:     "Coronel Vidal, Buenos Aires, Argentina",
-			},
-			{
-				TraitType:   "Fecha de produccion",
-				DisplayType: "date",
-				Value:       "1638421200",
-			},
-		},
+	metadata, err := template.Render(data)
+	if err != nil {
+		return IPFSUploadResponse{}, err
 	}
 
 	metadataJson, err := json.Marshal(metadata)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return IPFSUploadResponse{}, err
 	}
 
-	cid, err := m.ipfs.Add(strings.NewReader(string(metadataJson)))
+	return m.ipfs.Add(strings.NewReader(string(metadataJson)))
+}
+
+// mint sends the SafeMint transaction for the given wallet and token URI to
+// the contract.
+// beforeSend, if set, is given the signed transaction before it is broadcast,
+// so it can be saved and a crash can't lose track of it.
+func (m *minter) mint(ctx context.Context, contractAddress common.Address, to common.Address, uri string, beforeSend func(*types.Transaction) error) (*types.Transaction, error) {
+	return m.transactWith(ctx, m.mintKey(contractAddress), nftlink.NFTLinkMetaData, contractAddress, beforeSend, "safeMint", to, uri)
+}
+
+// transact sends a transaction calling method of the contract described by
+// meta with the owner key, estimating its gas and taking the next nonce.
+func (m *minter) transact(ctx context.Context, meta *bind.MetaData, contractAddress common.Address, beforeSend func(*types.Transaction) error, method string, args ...interface{}) (*types.Transaction, error) {
+	return m.transactWith(ctx, m.ownerKey(), meta, contractAddress, beforeSend, method, args...)
+}
+
+// transactWith is transact sending with key.
+func (m *minter) transactWith(ctx context.Context, key *hotKey, meta *bind.MetaData, contractAddress common.Address, beforeSend func(*types.Transaction) error, method string, args ...interface{}) (*types.Transaction, error) {
+	parsed, err := meta.GetAbi()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return nil, err
 	}
+	contract := bind.NewBoundContract(contractAddress, *parsed, m.client, m.client, m.client)
+
+	// TODO: get this from config
+	value := big.NewInt(0) // in wei (0 eth)
 
-	rtn_tx, err := nftcontract.NFTLinkTransactor.SafeMint(opts, A.Address(), cid.Hash)
+	auth, err := m.transactor(ctx, key.signer)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return nil, err
 	}
+	fromAddress := auth.From
 
-	b, err := rtn_tx.MarshalJSON()
+	// estimate the gas for this exact call, the token URI changes its cost
+	input, err := parsed.Pack(method, args...)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		return nil, err
+	}
+	gasLimit, err := m.gas.limit(ctx, m.client, ethereum.CallMsg{
+		From:  fromAddress,
+		To:    &contractAddress,
+		Value: value,
+		Data:  input,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, "%s", b)
+	// parallel mints can share the key, its nonce manager keeps them in sequence
+	for attempt := 0; ; attempt++ {
+		opts := &bind.TransactOpts{
+			From:     fromAddress,
+			Signer:   auth.Signer,
+			Value:    value,
+			GasLimit: gasLimit,
+			Context:  ctx,
+			NoSend:   true,
+		}
+		if err := m.fees.apply(ctx, m.client, opts); err != nil {
+			return nil, err
+		}
 
-	// prize has been claimed now let's write it to the database
-	val := ClaimPrize{UUID: key, Wallet: wallet, Claimed: true}
-	err = m.store.Set(key, val)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v", err)
-		return
+		nonce, err := key.nonces.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts.Nonce = new(big.Int).SetUint64(nonce)
+
+		tx, err := contract.Transact(opts, method, args...)
+		if err == nil && beforeSend != nil {
+			err = beforeSend(tx)
+		}
+		if err != nil {
+			key.nonces.Release(nonce)
+			return nil, err
+		}
+		err = m.client.SendTransaction(ctx, tx)
+		switch {
+		case err == nil || isKnownTxError(err):
+			return tx, nil
+		case isNonceTakenError(err):
+			// a pending transaction holds the nonce, sending the call again
+			// under another one could mine it twice
+			key.nonces.Resync()
+			return nil, err
+		case isNonceError(err):
+			// our view of the account is stale, read it again from the chain
+			key.nonces.Resync()
+			if attempt >= maxNonceRetries {
+				return nil, err
+			}
+		case isRejectedTxError(err):
+			// the node refused it, nothing went out and the nonce is free
+			key.nonces.Release(nonce)
+			if strings.Contains(err.Error(), "insufficient funds") {
+				return nil, fmt.Errorf("%w: %s has %v", errLowBalance, fromAddress.Hex(), err)
+			}
+			return nil, err
+		case beforeSend != nil:
+			// the transaction is recorded as sent and the node may have taken
+			// it despite the error, e.g. a timeout: keep its nonce and let the
+			// tracker find out, it replaces the transaction if it never shows up
+			log.Printf("sending %s: %v", tx.Hash().Hex(), err)
+			return tx, nil
+		default:
+			key.nonces.Release(nonce)
+			return nil, err
+		}
 	}
+}
 
+// transactor returns the sender and signer of transactions sent by signer.
+func (m *minter) transactor(ctx context.Context, signer Signer) (*bind.TransactOpts, error) {
+	chainID, err := m.client.NetworkID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return signerTransactor(signer, chainID), nil
 }
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"io"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gorilla/mux"
 	"github.com/nicocesar/nftlink/lib/contracts/nftlink"
+	"github.com/philippgille/gokv"
 	"github.com/philippgille/gokv/syncmap"
 )
 
@@ -55,7 +62,7 @@ func TestWorker(t *testing.T) {
 		expectedStatus     int
 		expectedBodyRegexp string
 	}{
-		{"Unredeemed code", "U6fxRAqxMo", false, "0x", "GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", http.StatusOK, `'input': '0xd204c45e000000000000000000000000ab5801a7d398351b8be11c439e05c5b3259aec9b00000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000000'`},
+		{"Unredeemed code", "U6fxRAqxMo", false, "0x", "GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", http.StatusAccepted, `"state":"pending"`},
 		{"Unredeemed code invalid wallet", "U6fxRAqxMo", false, "0x", "GET", "/mint/U6fxRAqxMo/0x123456", http.StatusBadRequest, `Invalid wallet address`},
 		{"Already redeemed", "U6fxRAqxMo", true, "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", http.StatusOK, `Already claimed`},
 		{"Redeem code not found", "U6fxRAqxMo", false, "0x", "GET", "/mint/not_found/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", http.StatusNotFound, `Redeem code not_found not found`},
@@ -76,44 +83,11 @@ func TestWorker(t *testing.T) {
 			ipfsMock := &ipfsMock{}
 			clientMock := NewSimulatedBackend()
 
-			deployerPublicKey := deployerKey.Public()
-			deployerPublicKeyECDSA, ok := deployerPublicKey.(*ecdsa.PublicKey)
-			if !ok {
-				t.Errorf("error casting public key to ECDSA")
-			}
-
-			deployerFromAddress := crypto.PubkeyToAddress(*deployerPublicKeyECDSA)
-			nonce, err := clientMock.PendingNonceAt(context.Background(), deployerFromAddress)
-			if err != nil {
-				t.Fatal(err)
-			}
+			address := deployNFTLink(t, clientMock, deployerKey)
 			gasPrice, err := clientMock.SuggestGasPrice(context.Background())
 			if err != nil {
 				t.Fatal(err)
 			}
-
-			networkID, err := clientMock.NetworkID(context.Background())
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			auth, err := bind.NewKeyedTransactorWithChainID(deployerKey, networkID)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			auth.Nonce = big.NewInt(int64(nonce))
-			auth.Value = big.NewInt(0)      // in wei
-			auth.GasLimit = uint64(3000000) // in units
-			auth.GasPrice = gasPrice
-			auth.From = deployerFromAddress
-
-			clientMock.FundAddress(context.Background(), deployerFromAddress)
-
-			address, _, _, err := nftlink.DeployNFTLink(auth, clientMock)
-			if err != nil {
-				t.Fatal(err)
-			}
 			/*
 				c := waitTxConfirmed(context.Background(), clientMock, tx.Hash())
 
@@ -124,12 +98,18 @@ func TestWorker(t *testing.T) {
 			*/
 			m := minter{
 				store:           store,
+				claims:          newClaims(store),
+				serials:         newSerials(store, address.Hex()),
+				queue:           newJobQueue(store, 16),
 				ipfs:            ipfsMock,
+				metadata:        testMetadata(t),
+				campaigns:       newCampaigns(store),
 				client:          clientMock,
-				privateKey:      fmt.Sprintf("%x", crypto.FromECDSA(deployerKey)),
+				signer:          newKeySigner(deployerKey),
+				nonces:          newNonceManager(clientMock, crypto.PubkeyToAddress(deployerKey.PublicKey)),
 				contractAddress: address.Hex(),
-				gasLimit:        3000000,
-				gasPrice:        gasPrice, //big.NewInt(1000000000),
+				gas:             &gasEstimator{multiplier: 1.2, cap: 3000000},
+				fees:            &feePolicy{mode: feeLegacy, gasPrice: gasPrice}, //big.NewInt(1000000000),
 			}
 
 			m.store.Set(tc.uuid, &ClaimPrize{
@@ -169,3 +149,379 @@ func TestWorker(t *testing.T) {
 		})
 	}
 }
+
+// deployNFTLink funds the deployer on the simulated chain and deploys a fresh
+// NFTLink contract owned by it.
+func deployNFTLink(t *testing.T, clientMock *SimulatedBackend, deployerKey *ecdsa.PrivateKey) common.Address {
+	deployerPublicKey := deployerKey.Public()
+	deployerPublicKeyECDSA, ok := deployerPublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		t.Errorf("error casting public key to ECDSA")
+	}
+
+	deployerFromAddress := crypto.PubkeyToAddress(*deployerPublicKeyECDSA)
+	nonce, err := clientMock.PendingNonceAt(context.Background(), deployerFromAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gasPrice, err := clientMock.SuggestGasPrice(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	networkID, err := clientMock.NetworkID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := bind.NewKeyedTransactorWithChainID(deployerKey, networkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth.Nonce = big.NewInt(int64(nonce))
+	auth.Value = big.NewInt(0)      // in wei
+	auth.GasLimit = uint64(3000000) // in units
+	auth.GasPrice = gasPrice
+	auth.From = deployerFromAddress
+
+	clientMock.FundAddress(context.Background(), deployerFromAddress)
+
+	address, _, _, err := nftlink.DeployNFTLink(auth, clientMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+// deployBinding deploys the contract of a binding from the owner key of m,
+// which must be on the simulated chain. It fails the test when the bytecode
+// of the binding doesn't implement its ABI, as happens when a contract
+// changes and its binding isn't regenerated.
+func deployBinding(t *testing.T, m *minter, meta *bind.MetaData, args ...interface{}) common.Address {
+	t.Helper()
+	if missing := missingMethods(meta); len(missing) > 0 {
+		t.Fatalf("the bytecode of the binding lacks %s, regenerate it with go generate ./lib/contracts/nftlink", strings.Join(missing, ", "))
+	}
+	parsed, err := meta.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := m.transactor(context.Background(), m.signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, _, _, err := bind.DeployContract(auth, *parsed, common.FromHex(meta.Bin), m.client, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+// missingMethods returns the methods of a binding whose selector its
+// bytecode doesn't dispatch on, all of them without bytecode.
+func missingMethods(meta *bind.MetaData) []string {
+	code := common.FromHex(meta.Bin)
+	missing := []string{}
+	for selector, method := range meta.Sigs {
+		push := append([]byte{0x63}, common.FromHex(selector)...) // PUSH4 selector
+		if push[1] == 0 {
+			push = append([]byte{0x62}, push[2:]...) // PUSH3, leading zero dropped
+		}
+		if len(code) == 0 || !bytes.Contains(code, push) {
+			missing = append(missing, method)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// newTestMinter deploys NFTLink on a fresh simulated chain and returns a
+// minter wired to it, with the deployer key as the contract owner.
+func newTestMinter(t *testing.T, store gokv.Store) *minter {
+	deployerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientMock := NewSimulatedBackend()
+	address := deployNFTLink(t, clientMock, deployerKey)
+
+	return &minter{
+		store:           store,
+		claims:          newClaims(store),
+		serials:         newSerials(store, address.Hex()),
+		queue:           newJobQueue(store, 16),
+		ipfs:            &ipfsMock{},
+		metadata:        testMetadata(t),
+		campaigns:       newCampaigns(store),
+		client:          clientMock,
+		signer:          newKeySigner(deployerKey),
+		nonces:          newNonceManager(clientMock, crypto.PubkeyToAddress(deployerKey.PublicKey)),
+		tracker:         newTxTracker(clientMock, 1, 10*time.Millisecond, 0),
+		releaseOnRevert: true,
+		contractAddress: address.Hex(),
+		gas:             &gasEstimator{multiplier: 1.2, cap: 3000000},
+		fees:            &feePolicy{mode: feeDynamic},
+	}
+}
+
+func TestMintJob(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+
+	m := newTestMinter(t, store)
+	queue := m.queue
+	store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+
+	r := mux.NewRouter()
+	r.Handle("/mint/{id}/{wallet}", m)
+	r.Handle("/job/{id}", &jobStatus{queue: queue})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mint/U6fxRAqxMo/0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", nil)
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusAccepted)
+	}
+	job := &mintJob{}
+	if err := json.Unmarshal(rr.Body.Bytes(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	// asking again while the job is queued hands back the same job
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	again := &mintJob{}
+	if err := json.Unmarshal(rr.Body.Bytes(), again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != job.ID {
+		t.Errorf("second request queued job %s, want %s", again.ID, job.ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := queue.Start(ctx, 2, m.processJob); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !job.State.done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", job.ID, job.State)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/job/"+job.ID, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status handler returned %v: %s", rr.Code, rr.Body.String())
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if job.State != jobConfirmed {
+		t.Fatalf("job ended %s: %s", job.State, job.Error)
+	}
+	if job.TxHash == "" {
+		t.Errorf("confirmed job has no transaction hash")
+	}
+
+	claim := &ClaimPrize{}
+	if _, err := store.Get("U6fxRAqxMo", claim); err != nil {
+		t.Fatal(err)
+	}
+	if !claim.Claimed {
+		t.Errorf("code not marked as claimed after the job was confirmed")
+	}
+	if claim.TxHash != job.TxHash || claim.ReceiptStatus != "success" || claim.BlockNumber == 0 {
+		t.Errorf("receipt not recorded on the claim: %+v", claim)
+	}
+
+	open, err := queue.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 0 {
+		t.Errorf("confirmed job still open: %v", open)
+	}
+}
+
+func TestMintTokenIDs(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	m := newTestMinter(t, store)
+
+	codes := []string{"U6fxRAqxMo", "wKcZ2ceDLs", "5mHqQ1rjxU", "pD0tMBIbYv"}
+	jobs := []*mintJob{}
+	for _, code := range codes {
+		store.Set(code, &ClaimPrize{UUID: code})
+		job := newMintJob(code, "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+		if _, err := m.claims.Reserve(code, job.Wallet, job.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.queue.Enqueue(job); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.queue.Start(ctx, len(codes), m.processJob); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		open, err := m.queue.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(open) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs still open: %v", open)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	nftcontract, err := nftlink.NewNFTLink(common.HexToAddress(m.contractAddress), m.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numbers := map[uint64]bool{}
+	tokens := map[string]bool{}
+	for _, job := range jobs {
+		claim := &ClaimPrize{}
+		store.Get(job.Code, claim)
+		if claim.Status != claimFinal {
+			t.Fatalf("claim %s is %q", job.Code, claim.Status)
+		}
+		if claim.Number == nil || numbers[*claim.Number] {
+			t.Errorf("claim %s has a missing or repeated number", job.Code)
+		} else {
+			numbers[*claim.Number] = true
+		}
+		if claim.TokenID == "" || tokens[claim.TokenID] {
+			t.Errorf("claim %s has a missing or repeated token ID %q", job.Code, claim.TokenID)
+		}
+		tokens[claim.TokenID] = true
+
+		tokenID, ok := new(big.Int).SetString(claim.TokenID, 10)
+		if !ok {
+			t.Fatalf("invalid token ID %q", claim.TokenID)
+		}
+		owner, err := nftcontract.OwnerOf(nil, tokenID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != common.HexToAddress(job.Wallet) {
+			t.Errorf("token %s owned by %s, want %s", claim.TokenID, owner.Hex(), job.Wallet)
+		}
+		// burning the token redeems it for the code
+		var code string
+		if store.Get(tokenKey(m.chainID, common.HexToAddress(m.contractAddress), claim.TokenID), &code); code != job.Code {
+			t.Errorf("token %s recorded for code %q, want %s", claim.TokenID, code, job.Code)
+		}
+	}
+}
+
+func TestEnqueueFullQueue(t *testing.T) {
+	store := syncmap.NewStore(syncmap.Options{})
+	defer store.Close()
+	queue := newJobQueue(store, 1)
+
+	// nobody works the queue, the second job must not block the request
+	done := make(chan error)
+	go func() {
+		for _, code := range []string{"U6fxRAqxMo", "wKcZ2ceDLs"} {
+			if err := queue.Enqueue(newMintJob(code, "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue blocked on a full queue")
+	}
+
+	// the job that didn't fit is still open for the sweeper
+	open, err := queue.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 2 {
+		t.Errorf("%d open jobs, want 2", len(open))
+	}
+}
+
+func TestSendErrorKeepsClaim(t *testing.T) {
+	var cases = []struct {
+		name       string
+		err        string
+		wantState  jobState
+		wantStatus claimStatus
+	}{
+		// the node may have the transaction, only its receipt can tell
+		{"Timeout", "context deadline exceeded", jobSubmitted, claimSubmitted},
+		// the node refused it, nothing was sent
+		{"Nonce taken", "replacement transaction underpriced", jobFailed, claimAvailable},
+		{"Out of ETH", "insufficient funds for gas * price + value", jobFailed, claimAvailable},
+		{"Fee cap too low", "max fee per gas less than block base fee: address 0x71562b71999873DB5b286dF957af199Ec94617F7, maxFeePerGas: 1 baseFee: 875000000", jobFailed, claimAvailable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := syncmap.NewStore(syncmap.Options{})
+			defer store.Close()
+			m := newTestMinter(t, store)
+			backend := &rejectingBackend{capturingBackend: &capturingBackend{fixedEstimate: &fixedEstimate{ethBackend: m.client, gas: 500000}}, err: errors.New(tc.err)}
+			m.client = backend
+
+			store.Set("U6fxRAqxMo", &ClaimPrize{UUID: "U6fxRAqxMo"})
+			job := newMintJob("U6fxRAqxMo", "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B")
+			if _, err := m.claims.Reserve(job.Code, job.Wallet, job.ID); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			m.processJob(ctx, job)
+
+			if job.State != tc.wantState {
+				t.Errorf("job is %s, want %s", job.State, tc.wantState)
+			}
+			claim, _, err := m.claims.Get(job.Code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claim.Status != tc.wantStatus {
+				t.Errorf("claim is %q, want %q", claim.Status, tc.wantStatus)
+			}
+
+			// the nonce of a transaction the node may have isn't used again
+			backend.err = nil
+			if _, err := m.mint(context.Background(), common.HexToAddress(m.contractAddress), common.HexToAddress(job.Wallet), "QmToken", nil); err != nil {
+				t.Fatal(err)
+			}
+			first, next := backend.sent[0].Nonce(), backend.sent[len(backend.sent)-1].Nonce()
+			if tc.wantState == jobSubmitted && next == first {
+				t.Errorf("nonce %d of a submitted job was reused", first)
+			}
+			// the nonce of a transaction the node refused is free again
+			if isRejectedTxError(errors.New(tc.err)) && next != first {
+				t.Errorf("nonce %d of a rejected transaction was skipped, sent %d", first, next)
+			}
+		})
+	}
+}